@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+)
+
+// runAPIKey manages API keys directly in the configured storage, it is the way
+// to create the first admin key before the admin endpoint can be used.
+func runAPIKey(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: shortener apikey create|list|revoke [flags]")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("apikey "+command, flag.ExitOnError)
+	name := flags.String("name", "", "name of the created api key")
+	owner := flags.String("owner", "", "user the links created with the key belong to, defaults to the key id")
+	scopes := flags.String("scopes", "shorten,read", "comma separated scopes of the created api key: shorten, read, delete, admin")
+	id := flags.String("id", "", "id of the revoked api key")
+	configVar := config.ParseFlags(flags, args[1:])
+
+	storageVar, closeStorage, err := openStorage("", configVar)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+	service := services.NewService(storageVar)
+	ctx := context.Background()
+
+	switch command {
+	case "create":
+		created, err := service.CreateAPIKey(ctx, models.APIKeyRequest{
+			Name:   *name,
+			Owner:  *owner,
+			Scopes: strings.Split(*scopes, ","),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "apikey: created %s for %s with scopes %s\n", created.ID, created.Owner, strings.Join(created.Scopes, ","))
+		fmt.Println(created.Token)
+	case "list":
+		keys, err := service.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, key := range keys {
+			if err := encoder.Encode(key); err != nil {
+				return err
+			}
+		}
+	case "revoke":
+		if err := service.RevokeAPIKey(ctx, *id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "apikey: revoked %s\n", *id)
+	default:
+		return fmt.Errorf("unknown apikey command %q", command)
+	}
+	return nil
+}
@@ -8,12 +8,28 @@ import (
 	"time"
 
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/enrich"
 	"github.com/TPizik/url-shortener/internal/app/server"
 	"github.com/TPizik/url-shortener/internal/app/services"
 	"github.com/TPizik/url-shortener/internal/app/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		if err := runTransfer(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := runAPIKey(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	configVar := config.ParseConfig()
 	storageVar, err := storage.NewStorage(&configVar)
 	if err != nil {
@@ -21,6 +37,14 @@ func main() {
 	}
 	defer storageVar.Close()
 	serviceVar := services.NewService(storageVar)
+	if configVar.Enrich {
+		enricher, err := enrich.NewWorker(storageVar, &configVar)
+		if err != nil {
+			panic(err)
+		}
+		defer enricher.Close()
+		serviceVar.SetEnricher(enricher)
+	}
 	serverVar := server.NewServer(serviceVar, configVar)
 	go serverVar.ListenAndServe()
 
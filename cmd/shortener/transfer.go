@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+	"github.com/TPizik/url-shortener/internal/app/transfer"
+)
+
+const (
+	jsonlScheme = "jsonl:"
+	csvScheme   = "csv:"
+)
+
+func runTransfer(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	from := flags.String("from", "", "links source: jsonl:<path>, csv:<path> or storage spec, empty means configured storage")
+	to := flags.String("to", "", "links destination: jsonl:<path>, csv:<path> or storage spec, empty means configured storage")
+	batchSize := flags.Int("batch-size", transfer.DefaultBatchSize, "number of links written at once")
+	configVar := config.ParseFlags(flags, args)
+
+	if command == "export" && *to == "" {
+		*to = jsonlScheme + "-"
+	}
+	if command == "import" && *from == "" {
+		*from = jsonlScheme + "-"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	source, closeSource, err := openSource(*from, configVar)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+	sink, closeSink, err := openSink(*to, configVar)
+	if err != nil {
+		return err
+	}
+
+	copied, err := transfer.Copy(ctx, source, sink, *batchSize, func(copied int) {
+		fmt.Fprintf(os.Stderr, "%s: %d links\n", command, copied)
+	})
+	if closeErr := closeSink(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: done, %d links\n", command, copied)
+	return nil
+}
+
+func openSource(spec string, configVar config.Config) (transfer.Source, func() error, error) {
+	switch {
+	case strings.HasPrefix(spec, jsonlScheme):
+		file, err := openInput(strings.TrimPrefix(spec, jsonlScheme))
+		if err != nil {
+			return nil, nil, err
+		}
+		return transfer.NewJSONLReader(file), file.Close, nil
+	case strings.HasPrefix(spec, csvScheme):
+		file, err := openInput(strings.TrimPrefix(spec, csvScheme))
+		if err != nil {
+			return nil, nil, err
+		}
+		return transfer.NewCSVReader(file), file.Close, nil
+	default:
+		return openStorage(spec, configVar)
+	}
+}
+
+func openSink(spec string, configVar config.Config) (transfer.Sink, func() error, error) {
+	var file *os.File
+	var err error
+	switch {
+	case strings.HasPrefix(spec, jsonlScheme):
+		if file, err = openOutput(strings.TrimPrefix(spec, jsonlScheme)); err != nil {
+			return nil, nil, err
+		}
+		writer := transfer.NewJSONLWriter(file)
+		return writer, closeAfter(writer.Flush, file), nil
+	case strings.HasPrefix(spec, csvScheme):
+		if file, err = openOutput(strings.TrimPrefix(spec, csvScheme)); err != nil {
+			return nil, nil, err
+		}
+		writer := transfer.NewCSVWriter(file)
+		return writer, closeAfter(writer.Flush, file), nil
+	default:
+		return openStorage(spec, configVar)
+	}
+}
+
+func openStorage(spec string, configVar config.Config) (*storage.Storage, func() error, error) {
+	if spec != "" {
+		configVar = configVar.WithStorage(spec)
+	}
+	storageVar, err := storage.NewStorage(&configVar)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storageVar, storageVar.Close, nil
+}
+
+func openInput(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func openOutput(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func closeAfter(flush func() error, file *os.File) func() error {
+	return func() error {
+		if err := flush(); err != nil {
+			file.Close()
+			return err
+		}
+		if file == os.Stdout {
+			return nil
+		}
+		return file.Close()
+	}
+}
@@ -0,0 +1,57 @@
+// Package audit carries the audit events of a change down to the storage,
+// which records them in the same transaction as the change itself.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+type eventsKey struct{}
+
+// WithEvents attaches the events of the change made within ctx. Events
+// without a key describe the links the change creates, they are recorded
+// once for every link that is actually created.
+func WithEvents(ctx context.Context, events ...models.AuditEvent) context.Context {
+	return context.WithValue(ctx, eventsKey{}, events)
+}
+
+// FromContext returns the events attached to ctx as they are.
+func FromContext(ctx context.Context) []models.AuditEvent {
+	events, _ := ctx.Value(eventsKey{}).([]models.AuditEvent)
+	return events
+}
+
+// Events returns the events to record for a change of the link key pointing
+// to url. Events about created links get key and url, and an id derived from
+// the key so every backend records the same event.
+func Events(ctx context.Context, key string, url string) []models.AuditEvent {
+	attached := FromContext(ctx)
+	events := make([]models.AuditEvent, 0, len(attached))
+	for _, event := range attached {
+		if event.Key == "" {
+			event.ID = CreatedID(event.ID, key)
+			event.Key = key
+			event.New = url
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// CreatedID is the id of the event id about the creation of the link key. It
+// is the start of the hex SHA-1 of both, which Redis scripts compute as well.
+func CreatedID(id string, key string) string {
+	sum := sha1.Sum([]byte(id + ":" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
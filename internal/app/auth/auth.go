@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	ScopeShorten = "shorten"
+	ScopeRead    = "read"
+	ScopeDelete  = "delete"
+	ScopeAdmin   = "admin"
+)
+
+var Scopes = []string{ScopeShorten, ScopeRead, ScopeDelete, ScopeAdmin}
+
+// Tokens look like sk_<id>_<secret>. The id is stored in plain text so a leaked
+// token can be identified and revoked, only the hash of the secret is stored.
+const tokenPrefix = "sk_"
+
+const (
+	idBytes     = 6
+	secretBytes = 24
+)
+
+type Principal struct {
+	KeyID  string
+	Owner  string
+	Scopes []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// UserID returns the owner of links created within ctx, empty for anonymous requests.
+func UserID(ctx context.Context) string {
+	principal, _ := FromContext(ctx)
+	return principal.Owner
+}
+
+func NewAPIKey(name string, owner string, scopes []string) (models.APIKey, string, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return models.APIKey{}, "", err
+	}
+	id, err := randomHex(idBytes)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret, err := randomHex(secretBytes)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	if owner == "" {
+		owner = id
+	}
+	key := models.APIKey{
+		ID:        id,
+		Name:      name,
+		Owner:     owner,
+		Scopes:    scopes,
+		Hash:      Hash(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	return key, tokenPrefix + id + "_" + secret, nil
+}
+
+func ParseToken(token string) (string, string, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !strings.HasPrefix(token, tokenPrefix) || !ok || id == "" || secret == "" {
+		return "", "", appErrors.ErrInvalidToken
+	}
+	return id, secret, nil
+}
+
+func Verify(key models.APIKey, secret string) bool {
+	if key.RevokedAt != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key.Hash), []byte(Hash(secret))) == 1
+}
+
+// Hash is a plain SHA-256, secrets are random so they need no salt or stretching.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return appErrors.New(appErrors.ErrValidation, "api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return appErrors.New(appErrors.ErrValidation, fmt.Sprintf("unknown scope %q", scope))
+		}
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
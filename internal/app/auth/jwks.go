@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefetch limits how often a token with an unknown kid may trigger a
+// reload, so garbage tokens can't be used to hammer the identity provider.
+const jwksMinRefetch = 30 * time.Second
+
+const maxJWKSSize = 1 << 20
+
+// errUnsupportedKey marks keys of a type or curve tokens are never verified
+// with, they are left out of the set instead of failing the whole set.
+var errUnsupportedKey = errors.New("unsupported key")
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type publicKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// JWKS is a cached JSON Web Key Set loaded from a local file or an http(s) URL.
+// Keys are reloaded every refresh interval and when a token is signed with an
+// unknown kid, which is how a rotated signing key is picked up.
+type JWKS struct {
+	source     string
+	refresh    time.Duration
+	minRefetch time.Duration
+	client     *http.Client
+	fetches    singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		source:     source,
+		refresh:    refresh,
+		minRefetch: jwksMinRefetch,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// key returns the key kid. Callers finding the keys stale share one fetch,
+// which runs without holding mu so the cached keys stay readable meanwhile.
+func (k *JWKS) key(ctx context.Context, kid string) (publicKey, error) {
+	key, ok, stale := k.cached(kid)
+	if stale {
+		_, err, _ := k.fetches.Do("jwks", func() (interface{}, error) {
+			return nil, k.reload(context.WithoutCancel(ctx))
+		})
+		if err != nil {
+			return publicKey{}, err
+		}
+		key, ok, _ = k.cached(kid)
+	}
+	if !ok {
+		return publicKey{}, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (k *JWKS) cached(kid string) (publicKey, bool, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	stale := k.keys == nil || (k.refresh > 0 && time.Since(k.fetchedAt) > k.refresh)
+	key, ok := k.keys[kid]
+	if !ok && time.Since(k.fetchedAt) > k.minRefetch {
+		stale = true
+	}
+	return key, ok, stale
+}
+
+func (k *JWKS) reload(ctx context.Context) error {
+	keys, err := k.load(ctx)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err != nil && k.keys == nil {
+		return appErrors.Wrap(appErrors.ErrUnavailable, "load jwks", err)
+	}
+	// A failed reload keeps serving the previous keys until the provider is back.
+	if err == nil {
+		k.keys = keys
+	}
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+func (k *JWKS) load(ctx context.Context) (map[string]publicKey, error) {
+	data, err := k.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]publicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key, err := raw.publicKey()
+		if errors.Is(err, errUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", raw.Kid, err)
+		}
+		keys[raw.Kid] = publicKey{key: key, alg: raw.Alg}
+	}
+	return keys, nil
+}
+
+func (k *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(k.source, "http://") && !strings.HasPrefix(k.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(k.source, "file:"))
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := k.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks responded with %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxJWKSSize))
+}
+
+func (raw jwk) publicKey() (crypto.PublicKey, error) {
+	switch raw.Kty {
+	case "RSA":
+		n, err := decodeBigInt(raw.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(raw.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 || e.Int64() < 3 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch raw.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %q", errUnsupportedKey, raw.Crv)
+		}
+		x, err := decodeBigInt(raw.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(raw.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if _, err := key.ECDH(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: type %q", errUnsupportedKey, raw.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// clockSkew is the leeway allowed when checking exp and nbf against the local clock.
+const clockSkew = time.Minute
+
+type JWTVerifier struct {
+	keys     *JWKS
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// NewJWTVerifier accepts RS256 and ES256 tokens signed by a key from keys.
+// Empty issuer or audience are not checked.
+func NewJWTVerifier(keys *JWKS, issuer string, audience string) *JWTVerifier {
+	return &JWTVerifier{keys: keys, issuer: issuer, audience: audience, now: time.Now}
+}
+
+// IsJWT tells a compact JWS from an API key, API keys contain no dots.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       json.RawMessage `json:"scp"`
+}
+
+// Verify checks the signature and claims of token and maps it into a principal
+// owned by the sub claim with scopes from the scope or scp claim.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	principal, err := v.verify(ctx, token)
+	if err != nil && appErrors.Kind(err) == nil {
+		return Principal{}, appErrors.Wrap(appErrors.ErrUnauthorized, "invalid jwt", err)
+	}
+	return principal, err
+}
+
+func (v *JWTVerifier) verify(ctx context.Context, token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, err
+	}
+	if header.Alg != AlgRS256 && header.Alg != AlgES256 {
+		return Principal{}, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, err
+	}
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return Principal{}, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return Principal{}, fmt.Errorf("key %q is not for %s", header.Kid, header.Alg)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key.key, digest[:], signature); err != nil {
+		return Principal{}, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, err
+	}
+	now := v.now()
+	switch {
+	case claims.Subject == "":
+		return Principal{}, errors.New("sub claim is required")
+	case claims.ExpiresAt == nil:
+		return Principal{}, errors.New("exp claim is required")
+	case now.After(time.Unix(*claims.ExpiresAt, 0).Add(clockSkew)):
+		return Principal{}, errors.New("token is expired")
+	case claims.NotBefore != nil && now.Add(clockSkew).Before(time.Unix(*claims.NotBefore, 0)):
+		return Principal{}, errors.New("token is not valid yet")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return Principal{}, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.audience != "" {
+		audience, err := stringOrList(claims.Audience)
+		if err != nil || !slices.Contains(audience, v.audience) {
+			return Principal{}, errors.New("token is not issued for this audience")
+		}
+	}
+	scopes := strings.Fields(claims.Scope)
+	if len(scopes) == 0 {
+		if scopes, err = stringOrList(claims.Scp); err != nil {
+			return Principal{}, err
+		}
+	}
+	return Principal{Owner: claims.Subject, Scopes: scopes}, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest []byte, signature []byte) error {
+	switch alg {
+	case AlgRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 token signed with a non RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature)
+	case AlgES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return errors.New("ES256 token signed with a non P-256 key")
+		}
+		// JWS encodes ECDSA signatures as fixed size r || s instead of ASN.1.
+		if len(signature) != 64 {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %q", alg)
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// stringOrList decodes claims like aud and scp that may be a single string or
+// a list of strings.
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return strings.Fields(value), nil
+}
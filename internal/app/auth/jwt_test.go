@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig", "alg": AlgRS256,
+		"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func marshalJWKS(t *testing.T, keys ...map[string]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sign(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(filename, marshalJWKS(t, rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewJWTVerifier(NewJWKS(filename, time.Hour), "https://sso.example.com", "shortener")
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub":   "alice",
+			"iss":   "https://sso.example.com",
+			"aud":   []string{"shortener", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "shorten read",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name   string
+		token  string
+		scopes []string
+	}{
+		{name: "rs256", token: sign(t, AlgRS256, "rsa", rsaKey, claims(nil)), scopes: []string{"shorten", "read"}},
+		{name: "es256", token: sign(t, AlgES256, "ec", ecKey, claims(nil)), scopes: []string{"shorten", "read"}},
+		{name: "scp list", token: sign(t, AlgES256, "ec", ecKey, claims(map[string]interface{}{"scope": nil, "scp": []string{"admin"}})), scopes: []string{"admin"}},
+		{name: "single audience", token: sign(t, AlgES256, "ec", ecKey, claims(map[string]interface{}{"aud": "shortener"})), scopes: []string{"shorten", "read"}},
+		{name: "expired", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}))},
+		{name: "no exp", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"exp": nil}))},
+		{name: "not yet valid", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}))},
+		{name: "no sub", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"sub": nil}))},
+		{name: "wrong issuer", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "wrong audience", token: sign(t, AlgRS256, "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"}))},
+		{name: "unknown kid", token: sign(t, AlgES256, "missing", ecKey, claims(nil))},
+		{name: "foreign key", token: sign(t, AlgES256, "ec", otherKey, claims(nil))},
+		{name: "alg mismatch", token: sign(t, AlgES256, "rsa", ecKey, claims(nil))},
+		{name: "alg none", token: b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + b64([]byte(`{"sub":"alice"}`)) + "."},
+		{name: "malformed", token: "a.b"},
+	}
+	tampered := strings.Split(tests[0].token, ".")
+	tampered[1] = b64([]byte(`{"sub":"mallory","exp":9999999999,"scope":"admin"}`))
+	tests = append(tests, struct {
+		name   string
+		token  string
+		scopes []string
+	}{name: "tampered", token: strings.Join(tampered, ".")})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := verifier.Verify(context.Background(), tt.token)
+			if tt.scopes == nil {
+				if !errors.Is(err, appErrors.ErrUnauthorized) {
+					t.Errorf("Expected unauthorized, got %+v, %v", principal, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal.Owner != "alice" || strings.Join(principal.Scopes, " ") != strings.Join(tt.scopes, " ") {
+				t.Errorf("Unexpected principal %+v", principal)
+			}
+		})
+	}
+}
+
+func TestJWKS_Rotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var rotated atomic.Bool
+	var fetches atomic.Int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if rotated.Load() {
+			w.Write(marshalJWKS(t, ecJWK("new", newKey)))
+			return
+		}
+		w.Write(marshalJWKS(t, ecJWK("old", oldKey)))
+	}))
+	defer provider.Close()
+
+	keys := NewJWKS(provider.URL, time.Hour)
+	verifier := NewJWTVerifier(keys, "", "")
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	ctx := context.Background()
+
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "old", oldKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "old", oldKey, claims)); err != nil || fetches.Load() != 1 {
+		t.Fatalf("Expected cached keys, got %d fetches, %v", fetches.Load(), err)
+	}
+
+	rotated.Store(true)
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "new", newKey, claims)); err == nil {
+		t.Errorf("Expected unknown kid to wait for the refetch interval")
+	}
+	keys.minRefetch = 0
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "new", newKey, claims)); err != nil {
+		t.Errorf("Expected rotated key to be fetched, got %v", err)
+	}
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "old", oldKey, claims)); err == nil {
+		t.Errorf("Expected retired key to be rejected")
+	}
+
+	provider.Close()
+	keys.minRefetch = time.Hour
+	keys.refresh = time.Nanosecond
+	if _, err := verifier.Verify(ctx, sign(t, AlgES256, "new", newKey, claims)); err != nil {
+		t.Errorf("Expected cached keys while the provider is down, got %v", err)
+	}
+}
+
+func TestJWKS_Unavailable(t *testing.T) {
+	verifier := NewJWTVerifier(NewJWKS(filepath.Join(t.TempDir(), "missing.json"), time.Hour), "", "")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	token := sign(t, AlgES256, "ec", key, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, appErrors.ErrUnavailable) {
+		t.Errorf("Expected unavailable, got %v", err)
+	}
+}
+
+func TestJWKS_ConcurrentFetch(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write(marshalJWKS(t, map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"}, ecJWK("ec", key)))
+	}))
+	defer provider.Close()
+
+	verifier := NewJWTVerifier(NewJWKS(provider.URL, time.Hour), "", "")
+	token := sign(t, AlgES256, "ec", key, map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := verifier.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected the supported key to verify, got %v", err)
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("Expected concurrent verifications to share one fetch, got %d", fetches.Load())
+	}
+}
@@ -3,23 +3,83 @@ package config
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	RunAddr         string
-	ShortAddr       string
-	FileStoragePath string
-	DBDSN           string
+	RunAddr              string
+	ShortAddr            string
+	FileStoragePath      string
+	DBDSN                string
+	DBReplicaDSNs        []string
+	DBReplicaWindow      time.Duration
+	StorageSpec          string
+	SecondaryStorageSpec string
+	ShadowRead           bool
+	CacheSize            int
+	CacheTTL             time.Duration
+	CacheNegative        bool
+	FileCompactInterval  time.Duration
+	FileSyncMode         string
+	FileSyncInterval     time.Duration
+	MaxURLLength         int
+	StorageRetries       int
+	BreakerThreshold     int
+	BreakerCooldown      time.Duration
+	IdempotencyTTL       time.Duration
+	JWKS                 string
+	JWKSRefresh          time.Duration
+	JWTIssuer            string
+	JWTAudience          string
+	Domains              string
+	Enrich               bool
+	EnrichTimeout        time.Duration
+	EnrichMaxSize        int
+	TemplatesDir         string
 }
 
 func ParseConfig() Config {
-	var flagRunAddr, flagShortAddr, flagStoragePath, flagDBDSN string
+	return ParseFlags(flag.CommandLine, os.Args[1:])
+}
+
+func ParseFlags(flags *flag.FlagSet, args []string) Config {
+	var flagRunAddr, flagShortAddr, flagStoragePath, flagDBDSN, flagDBReplicaDSNs, flagStorageSpec, flagSecondaryStorageSpec, flagFileSyncMode, flagJWKS, flagJWTIssuer, flagJWTAudience, flagDomains, flagTemplatesDir string
+	var flagCacheSize, flagMaxURLLength, flagStorageRetries, flagBreakerThreshold, flagEnrichMaxSize int
+	var flagDBReplicaWindow, flagCacheTTL, flagFileCompactInterval, flagFileSyncInterval, flagBreakerCooldown, flagIdempotencyTTL, flagJWKSRefresh, flagEnrichTimeout time.Duration
+	var flagCacheNegative, flagShadowRead, flagEnrich bool
 
-	flag.StringVar(&flagRunAddr, "a", "127.0.0.1:8080", "address and port to run server")
-	flag.StringVar(&flagShortAddr, "b", "http://127.0.0.1:8080", "base address of the resulting shorthand url")
-	flag.StringVar(&flagStoragePath, "f", "", "base path to storage file")
-	flag.StringVar(&flagDBDSN, "d", "", "base path to database")
-	flag.Parse()
+	flags.StringVar(&flagRunAddr, "a", "127.0.0.1:8080", "address and port to run server")
+	flags.StringVar(&flagShortAddr, "b", "http://127.0.0.1:8080", "base address of the resulting shorthand url")
+	flags.StringVar(&flagStoragePath, "f", "", "base path to storage file")
+	flags.StringVar(&flagDBDSN, "d", "", "base path to database")
+	flags.StringVar(&flagDBReplicaDSNs, "db-replicas", "", "comma separated database replica DSNs used for reads")
+	flags.DurationVar(&flagDBReplicaWindow, "db-replica-window", 5*time.Second, "time after a write during which the reads of its user go to the primary database")
+	flags.StringVar(&flagStorageSpec, "s", "", "storage backend, e.g. file:/path/to/storage.txt, kv:/path/to/links.db, redis://host:6379/0 or postgres://host/db")
+	flags.StringVar(&flagSecondaryStorageSpec, "secondary-storage", "", "storage spec receiving a copy of every write, used to migrate between backends")
+	flags.BoolVar(&flagShadowRead, "shadow-read", false, "compare reads from primary storage with secondary storage")
+	flags.IntVar(&flagCacheSize, "cache-size", 0, "max number of cached links, 0 disables cache")
+	flags.DurationVar(&flagCacheTTL, "cache-ttl", 0, "time to live of cached links, 0 means no expiration")
+	flags.BoolVar(&flagCacheNegative, "cache-negative", false, "cache missing keys")
+	flags.DurationVar(&flagFileCompactInterval, "file-compact-interval", 0, "interval of storage file compaction, 0 disables compaction")
+	flags.StringVar(&flagFileSyncMode, "file-sync", "always", "storage file durability mode: always, batch or interval")
+	flags.DurationVar(&flagFileSyncInterval, "file-sync-interval", 100*time.Millisecond, "interval of storage file sync in interval mode")
+	flags.IntVar(&flagMaxURLLength, "max-url-length", 16384, "max length of shortened url, 0 disables the limit")
+	flags.IntVar(&flagStorageRetries, "storage-retries", 2, "number of retries of idempotent storage calls on transient errors")
+	flags.IntVar(&flagBreakerThreshold, "breaker-threshold", 5, "consecutive storage failures opening the circuit breaker, 0 disables it")
+	flags.DurationVar(&flagBreakerCooldown, "breaker-cooldown", 10*time.Second, "time the circuit breaker stays open before probing storage")
+	flags.DurationVar(&flagIdempotencyTTL, "idempotency-ttl", 24*time.Hour, "time responses are replayed for a repeated Idempotency-Key, 0 disables idempotency keys")
+	flags.StringVar(&flagJWKS, "jwks", "", "file or http(s) URL of the JWKS used to verify bearer JWTs, empty disables JWT authentication")
+	flags.DurationVar(&flagJWKSRefresh, "jwks-refresh", 15*time.Minute, "interval of JWKS reload")
+	flags.StringVar(&flagJWTIssuer, "jwt-issuer", "", "required iss claim of bearer JWTs")
+	flags.StringVar(&flagJWTAudience, "jwt-audience", "", "required aud claim of bearer JWTs")
+	flags.StringVar(&flagDomains, "domains", "", "JSON file of the custom short domains, the host of the base address is the default domain")
+	flags.BoolVar(&flagEnrich, "enrich", false, "fetch the title, description and image of destination pages in the background")
+	flags.DurationVar(&flagEnrichTimeout, "enrich-timeout", 5*time.Second, "timeout of fetching a destination page")
+	flags.IntVar(&flagEnrichMaxSize, "enrich-max-size", 1<<20, "max number of bytes read from a destination page")
+	flags.StringVar(&flagTemplatesDir, "templates", "", "directory of HTML templates overriding the built-in ones, e.g. preview.html")
+	flags.Parse(args)
 
 	if envRunAddr := os.Getenv("SERVER_ADDRESS"); envRunAddr != "" {
 		flagRunAddr = envRunAddr
@@ -33,12 +93,132 @@ func ParseConfig() Config {
 	if envDBDSN := os.Getenv("DATABASE_DSN"); envDBDSN != "" {
 		flagDBDSN = envDBDSN
 	}
+	if envDBReplicaDSNs := os.Getenv("DATABASE_REPLICA_DSNS"); envDBReplicaDSNs != "" {
+		flagDBReplicaDSNs = envDBReplicaDSNs
+	}
+	if envDBReplicaWindow, err := time.ParseDuration(os.Getenv("DATABASE_REPLICA_WINDOW")); err == nil {
+		flagDBReplicaWindow = envDBReplicaWindow
+	}
+	if envStorageSpec := os.Getenv("STORAGE"); envStorageSpec != "" {
+		flagStorageSpec = envStorageSpec
+	}
+	if envSecondaryStorageSpec := os.Getenv("SECONDARY_STORAGE"); envSecondaryStorageSpec != "" {
+		flagSecondaryStorageSpec = envSecondaryStorageSpec
+	}
+	if envShadowRead, err := strconv.ParseBool(os.Getenv("SHADOW_READ")); err == nil {
+		flagShadowRead = envShadowRead
+	}
+	if envCacheSize, err := strconv.Atoi(os.Getenv("CACHE_SIZE")); err == nil {
+		flagCacheSize = envCacheSize
+	}
+	if envCacheTTL, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil {
+		flagCacheTTL = envCacheTTL
+	}
+	if envCacheNegative, err := strconv.ParseBool(os.Getenv("CACHE_NEGATIVE")); err == nil {
+		flagCacheNegative = envCacheNegative
+	}
+	if envFileCompactInterval, err := time.ParseDuration(os.Getenv("FILE_COMPACT_INTERVAL")); err == nil {
+		flagFileCompactInterval = envFileCompactInterval
+	}
+	if envFileSyncMode := os.Getenv("FILE_SYNC_MODE"); envFileSyncMode != "" {
+		flagFileSyncMode = envFileSyncMode
+	}
+	if envFileSyncInterval, err := time.ParseDuration(os.Getenv("FILE_SYNC_INTERVAL")); err == nil {
+		flagFileSyncInterval = envFileSyncInterval
+	}
+	if envMaxURLLength, err := strconv.Atoi(os.Getenv("MAX_URL_LENGTH")); err == nil {
+		flagMaxURLLength = envMaxURLLength
+	}
+	if envStorageRetries, err := strconv.Atoi(os.Getenv("STORAGE_RETRIES")); err == nil {
+		flagStorageRetries = envStorageRetries
+	}
+	if envBreakerThreshold, err := strconv.Atoi(os.Getenv("BREAKER_THRESHOLD")); err == nil {
+		flagBreakerThreshold = envBreakerThreshold
+	}
+	if envBreakerCooldown, err := time.ParseDuration(os.Getenv("BREAKER_COOLDOWN")); err == nil {
+		flagBreakerCooldown = envBreakerCooldown
+	}
+	if envIdempotencyTTL, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL")); err == nil {
+		flagIdempotencyTTL = envIdempotencyTTL
+	}
+	if envJWKS := os.Getenv("JWKS"); envJWKS != "" {
+		flagJWKS = envJWKS
+	}
+	if envJWKSRefresh, err := time.ParseDuration(os.Getenv("JWKS_REFRESH")); err == nil {
+		flagJWKSRefresh = envJWKSRefresh
+	}
+	if envJWTIssuer := os.Getenv("JWT_ISSUER"); envJWTIssuer != "" {
+		flagJWTIssuer = envJWTIssuer
+	}
+	if envJWTAudience := os.Getenv("JWT_AUDIENCE"); envJWTAudience != "" {
+		flagJWTAudience = envJWTAudience
+	}
+	if envDomains := os.Getenv("DOMAINS"); envDomains != "" {
+		flagDomains = envDomains
+	}
+	if envEnrich, err := strconv.ParseBool(os.Getenv("ENRICH")); err == nil {
+		flagEnrich = envEnrich
+	}
+	if envEnrichTimeout, err := time.ParseDuration(os.Getenv("ENRICH_TIMEOUT")); err == nil {
+		flagEnrichTimeout = envEnrichTimeout
+	}
+	if envEnrichMaxSize, err := strconv.Atoi(os.Getenv("ENRICH_MAX_SIZE")); err == nil {
+		flagEnrichMaxSize = envEnrichMaxSize
+	}
+	if envTemplatesDir := os.Getenv("TEMPLATES_DIR"); envTemplatesDir != "" {
+		flagTemplatesDir = envTemplatesDir
+	}
 
 	newConfig := Config{
-		RunAddr:         flagRunAddr,
-		ShortAddr:       flagShortAddr,
-		FileStoragePath: flagStoragePath,
-		DBDSN:           flagDBDSN,
+		RunAddr:              flagRunAddr,
+		ShortAddr:            flagShortAddr,
+		FileStoragePath:      flagStoragePath,
+		DBDSN:                flagDBDSN,
+		DBReplicaDSNs:        splitList(flagDBReplicaDSNs),
+		DBReplicaWindow:      flagDBReplicaWindow,
+		StorageSpec:          flagStorageSpec,
+		SecondaryStorageSpec: flagSecondaryStorageSpec,
+		ShadowRead:           flagShadowRead,
+		CacheSize:            flagCacheSize,
+		CacheTTL:             flagCacheTTL,
+		CacheNegative:        flagCacheNegative,
+		FileCompactInterval:  flagFileCompactInterval,
+		FileSyncMode:         flagFileSyncMode,
+		FileSyncInterval:     flagFileSyncInterval,
+		MaxURLLength:         flagMaxURLLength,
+		StorageRetries:       flagStorageRetries,
+		BreakerThreshold:     flagBreakerThreshold,
+		BreakerCooldown:      flagBreakerCooldown,
+		IdempotencyTTL:       flagIdempotencyTTL,
+		JWKS:                 flagJWKS,
+		JWKSRefresh:          flagJWKSRefresh,
+		JWTIssuer:            flagJWTIssuer,
+		JWTAudience:          flagJWTAudience,
+		Domains:              flagDomains,
+		Enrich:               flagEnrich,
+		EnrichTimeout:        flagEnrichTimeout,
+		EnrichMaxSize:        flagEnrichMaxSize,
+		TemplatesDir:         flagTemplatesDir,
 	}
 	return newConfig
 }
+
+// WithStorage returns the config of a backend other than the configured
+// one, it keeps neither the read replicas nor the secondary storage.
+func (c Config) WithStorage(spec string) Config {
+	c.StorageSpec = spec
+	c.DBReplicaDSNs = nil
+	c.DBReplicaWindow = 0
+	c.SecondaryStorageSpec = ""
+	return c
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
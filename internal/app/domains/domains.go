@@ -0,0 +1,182 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+)
+
+// Links of the default domain keep their plain keys, links of other domains
+// are stored as key@host so the same key can exist once per domain.
+const separator = "@"
+
+var (
+	ErrUnknown   error = appErrors.New(appErrors.ErrValidation, "unknown domain")
+	ErrForbidden error = appErrors.New(appErrors.ErrForbidden, "domain is not allowed")
+)
+
+type Domain struct {
+	Host    string   `json:"host"`
+	BaseURL string   `json:"base_url,omitempty"`
+	Owners  []string `json:"owners,omitempty"`
+}
+
+// Registry holds the short domains links can be created on. The host of the
+// base URL is the default domain, it is open to everyone and unknown hosts
+// resolve to it.
+type Registry struct {
+	baseURL     string
+	defaultHost string
+	domains     map[string]Domain
+}
+
+func NewRegistry(baseURL string, domains []Domain) (*Registry, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	registry := &Registry{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		defaultHost: normalize(parsed.Host),
+		domains:     make(map[string]Domain, len(domains)),
+	}
+	for _, domain := range domains {
+		host := normalize(domain.Host)
+		if host == "" || strings.ContainsAny(host, separator+"/") {
+			return nil, fmt.Errorf("invalid domain host %q", domain.Host)
+		}
+		if host == registry.defaultHost {
+			continue
+		}
+		domain.Host = host
+		if domain.BaseURL == "" {
+			domain.BaseURL = "https://" + host
+		}
+		domain.BaseURL = strings.TrimSuffix(domain.BaseURL, "/")
+		registry.domains[host] = domain
+	}
+	return registry, nil
+}
+
+// Load reads the domains from a JSON file, an empty filename gives a registry
+// with the default domain only.
+func Load(baseURL string, filename string) (*Registry, error) {
+	var domains []Domain
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &domains); err != nil {
+			return nil, fmt.Errorf("parse domains %s: %w", filename, err)
+		}
+	}
+	return NewRegistry(baseURL, domains)
+}
+
+// Resolve returns the domain serving requests for the Host header host.
+func (r *Registry) Resolve(host string) string {
+	host = normalize(host)
+	if _, ok := r.domains[host]; ok {
+		return host
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if _, ok := r.domains[hostname]; ok {
+			return hostname
+		}
+	}
+	return ""
+}
+
+// Lookup returns the domain name of the registered host name, an empty name
+// or the default host is the default domain.
+func (r *Registry) Lookup(name string) (string, error) {
+	name = normalize(name)
+	if name == "" || name == r.defaultHost {
+		return "", nil
+	}
+	if _, ok := r.domains[name]; !ok {
+		return "", ErrUnknown
+	}
+	return name, nil
+}
+
+// Use returns the domain name links requested for name are created on, as
+// long as the caller in ctx may use it.
+func (r *Registry) Use(ctx context.Context, name string) (string, error) {
+	name = normalize(name)
+	if name == "" || name == r.defaultHost {
+		return "", nil
+	}
+	domain, ok := r.domains[name]
+	if !ok {
+		return "", ErrUnknown
+	}
+	principal, ok := auth.FromContext(ctx)
+	switch {
+	case !ok:
+		return "", ErrForbidden
+	case principal.HasScope(auth.ScopeAdmin), len(domain.Owners) == 0, slices.Contains(domain.Owners, principal.Owner):
+		return name, nil
+	}
+	return "", ErrForbidden
+}
+
+// ShortURL returns the short URL of the link with the stored key id.
+func (r *Registry) ShortURL(id string) string {
+	domain, key := Split(id)
+	if d, ok := r.domains[domain]; ok {
+		return d.BaseURL + "/" + key
+	}
+	return r.baseURL + "/" + key
+}
+
+// Key returns the stored key of key on domain.
+func Key(domain string, key string) string {
+	if domain == "" {
+		return key
+	}
+	return key + separator + domain
+}
+
+// Split is the reverse of Key.
+func Split(id string) (string, string) {
+	if i := strings.LastIndex(id, separator); i >= 0 {
+		return id[i+1:], id[:i]
+	}
+	return "", id
+}
+
+// IndexKey namespaces url per domain in the url to key indexes of storages.
+func IndexKey(domain string, url string) string {
+	if domain == "" {
+		return url
+	}
+	return domain + "\x00" + url
+}
+
+type domainKey struct{}
+
+// WithDomain sets the domain links created within ctx belong to.
+func WithDomain(ctx context.Context, domain string) context.Context {
+	return context.WithValue(ctx, domainKey{}, domain)
+}
+
+// FromContext returns the domain of links created within ctx, empty for the
+// default domain.
+func FromContext(ctx context.Context) string {
+	domain, _ := ctx.Value(domainKey{}).(string)
+	return domain
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,135 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"go.uber.org/zap"
+)
+
+const (
+	queueSize = 1024
+	workers   = 4
+)
+
+var Sugar = *zap.NewNop().Sugar()
+
+type Storage interface {
+	GetLink(ctx context.Context, key string) (models.Link, error)
+	SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error
+}
+
+// Worker fetches the metadata of queued links in the background. The queue is
+// bounded, a key queued while it is full is dropped and its link stays
+// without metadata.
+type Worker struct {
+	storage Storage
+	fetcher *Fetcher
+	timeout time.Duration
+	queue   chan string
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func NewWorker(storage Storage, config *config.Config) (*Worker, error) {
+	if config.EnrichTimeout <= 0 {
+		return nil, fmt.Errorf("invalid enrich timeout %s", config.EnrichTimeout)
+	}
+	if config.EnrichMaxSize <= 0 {
+		return nil, fmt.Errorf("invalid enrich max size %d", config.EnrichMaxSize)
+	}
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		return nil, err
+	}
+	Sugar = *logger.Sugar()
+	return newWorker(storage, NewFetcher(config.EnrichTimeout, int64(config.EnrichMaxSize)), config.EnrichTimeout), nil
+}
+
+func newWorker(storage Storage, fetcher *Fetcher, timeout time.Duration) *Worker {
+	w := &Worker{
+		storage: storage,
+		fetcher: fetcher,
+		timeout: timeout,
+		queue:   make(chan string, queueSize),
+		done:    make(chan struct{}),
+	}
+	w.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.run()
+	}
+	return w
+}
+
+// Enqueue reports whether key was queued.
+func (w *Worker) Enqueue(key string) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.queue <- key:
+		return true
+	default:
+		Sugar.Warnln("enrichment queue is full, dropped", key)
+		return false
+	}
+}
+
+// Close stops the workers once the fetches in flight are done, queued keys
+// are dropped.
+func (w *Worker) Close() error {
+	w.once.Do(func() {
+		close(w.done)
+	})
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Worker) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case key := <-w.queue:
+			if err := w.enrich(key); err != nil {
+				Sugar.Infoln("enrich", key, err)
+			}
+		}
+	}
+}
+
+// enrich stores the metadata of the destination of key. The link may change
+// while its page is fetched, the storage only keeps the metadata as long as
+// the link still points to the fetched destination. Storing it leaves the
+// version of the link as it is, so an owner editing the link meanwhile does
+// not see a conflict.
+func (w *Worker) enrich(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*w.timeout)
+	defer cancel()
+	link, err := w.storage.GetLink(ctx, key)
+	if err != nil || link.Deleted {
+		return ignoreNotFound(err)
+	}
+	metadata, err := w.fetcher.Fetch(ctx, link.OriginalURL)
+	if err != nil {
+		return err
+	}
+	return ignoreNotFound(w.storage.SetMetadata(ctx, key, link.OriginalURL, metadata))
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, appErrors.ErrNotFound) {
+		return nil
+	}
+	return err
+}
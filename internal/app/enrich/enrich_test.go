@@ -0,0 +1,224 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+func allowAll(netip.AddrPort) bool {
+	return true
+}
+
+func newTestDestination(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	page := func(contentType string, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(body))
+		}
+	}
+	mux.HandleFunc("/article", page("text/html; charset=utf-8", `<!DOCTYPE html>
+<html><head>
+<!-- <title>Commented out</title> -->
+<TITLE>
+  Fish &amp; Chips
+</TITLE>
+<script>var s = "<title>not this</title>";</script>
+<meta name="Description" content="Crispy &quot;fresh&quot; food">
+<meta property="og:description" content="Open Graph description">
+<meta property=og:image content=/images/cover.png />
+</head><body><title>Body title</title></body></html>`))
+	mux.HandleFunc("/open-graph", page("text/html", `<head>
+<meta property="og:title" content="Open Graph title">
+<meta content='Only Open Graph' property='og:description'>
+<meta property="og:image" content="https://cdn.example.com/og.jpg">
+</head>`))
+	mux.HandleFunc("/unsafe-image", page("text/html", `<title>Unsafe</title><meta property="og:image" content="javascript:alert(1)">`))
+	mux.HandleFunc("/large", page("text/html", "<title>Large</title>"+strings.Repeat("x", 4096)+`<meta name="description" content="too far">`))
+	mux.HandleFunc("/document.pdf", page("application/pdf", "%PDF-1.4"))
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.Handle("/moved", http.RedirectHandler("/article", http.StatusFound))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	destination := newTestDestination(t)
+	fetcher := newFetcher(time.Second, 2048, allowAll)
+	article := models.LinkMetadata{
+		Title:       "Fish & Chips",
+		Description: `Crispy "fresh" food`,
+		Image:       destination.URL + "/images/cover.png",
+	}
+	tests := []struct {
+		name     string
+		path     string
+		metadata models.LinkMetadata
+		wantErr  bool
+	}{
+		{name: "title and meta tags", path: "/article", metadata: article},
+		{name: "open graph fallbacks", path: "/open-graph", metadata: models.LinkMetadata{
+			Title:       "Open Graph title",
+			Description: "Only Open Graph",
+			Image:       "https://cdn.example.com/og.jpg",
+		}},
+		{name: "unsafe image", path: "/unsafe-image", metadata: models.LinkMetadata{Title: "Unsafe"}},
+		{name: "cut at max size", path: "/large", metadata: models.LinkMetadata{Title: "Large"}},
+		{name: "not html", path: "/document.pdf"},
+		{name: "redirect", path: "/moved", metadata: article},
+		{name: "not found", path: "/missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := fetcher.Fetch(context.Background(), destination.URL+tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %t, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if metadata.FetchedAt.IsZero() {
+				t.Error("Expected fetch time")
+			}
+			metadata.FetchedAt = time.Time{}
+			if metadata != tt.metadata {
+				t.Errorf("Expected %+v, got %+v", tt.metadata, metadata)
+			}
+		})
+	}
+}
+
+func TestFetcher_privateAddresses(t *testing.T) {
+	destination := newTestDestination(t)
+	if _, err := NewFetcher(time.Second, 2048).Fetch(context.Background(), destination.URL+"/article"); !errors.Is(err, errForbiddenAddress) {
+		t.Errorf("Expected loopback destination to be refused, got %v", err)
+	}
+
+	// A public page redirecting to an internal one is refused as well.
+	public := httptest.NewServer(http.RedirectHandler(destination.URL+"/article", http.StatusFound))
+	defer public.Close()
+	publicURL, _ := url.Parse(public.URL)
+	onlyPublic := func(addrPort netip.AddrPort) bool {
+		return addrPort.String() == publicURL.Host
+	}
+	if _, err := newFetcher(time.Second, 2048, onlyPublic).Fetch(context.Background(), public.URL); !errors.Is(err, errForbiddenAddress) {
+		t.Errorf("Expected redirect to %s to be refused, got %v", destination.URL, err)
+	}
+
+	if _, err := NewFetcher(time.Second, 2048).Fetch(context.Background(), "file:///etc/passwd"); !errors.Is(err, errNotWebURL) {
+		t.Errorf("Expected file url to be refused, got %v", err)
+	}
+
+	addresses := map[string]bool{
+		"93.184.216.34:80":          true,
+		"[2606:2800:220:1::]:443":   true,
+		"127.0.0.1:80":              false,
+		"10.1.2.3:80":               false,
+		"172.16.0.1:80":             false,
+		"192.168.1.1:80":            false,
+		"169.254.169.254:80":        false,
+		"100.64.0.1:80":             false,
+		"0.0.0.0:80":                false,
+		"224.0.0.1:80":              false,
+		"[::1]:80":                  false,
+		"[fd00::1]:80":              false,
+		"[fe80::1]:80":              false,
+		"[::ffff:127.0.0.1]:80":     false,
+		"[64:ff9b::7f00:1]:80":      false,
+		"[2002:7f00:1::]:80":        false,
+		"[::ffff:93.184.216.34]:80": true,
+	}
+	for address, public := range addresses {
+		if got := publicAddress(netip.MustParseAddrPort(address)); got != public {
+			t.Errorf("%s: expected public %t, got %t", address, public, got)
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	destination := newTestDestination(t)
+	store := storage.NewInmemoryStorage(&config.Config{})
+	ctx := context.Background()
+	key, err := store.Add(ctx, destination.URL+"/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := newWorker(store, newFetcher(time.Second, 2048, allowAll), time.Second)
+	defer worker.Close()
+	if !worker.Enqueue(key) || !worker.Enqueue("missing") {
+		t.Fatal("Expected keys to be queued")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		link, err := store.GetLink(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Metadata != nil {
+			if link.Metadata.Title != "Fish & Chips" || link.Metadata.Image != destination.URL+"/images/cover.png" {
+				t.Errorf("Unexpected metadata %+v", link.Metadata)
+			}
+			if link.Version != 1 {
+				t.Errorf("Expected metadata to keep version 1, got %d", link.Version)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected metadata to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	worker.Close()
+	if worker.Enqueue(key) {
+		t.Error("Expected a closed worker to refuse keys")
+	}
+}
+
+func TestWorker_destinationChanged(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Old destination</title>"))
+	}))
+	defer slow.Close()
+	store := storage.NewInmemoryStorage(&config.Config{})
+	ctx := context.Background()
+	key, _ := store.Add(ctx, slow.URL+"/old")
+	worker := newWorker(store, newFetcher(time.Second, 2048, allowAll), time.Second)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.enrich(key)
+	}()
+	<-started
+	link, _ := store.GetLink(ctx, key)
+	link.OriginalURL = slow.URL + "/new"
+	if err := store.UpdateLink(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	worker.Close()
+	if link, _ := store.GetLink(ctx, key); link.Metadata != nil {
+		t.Errorf("Expected no metadata of the replaced destination, got %+v", link.Metadata)
+	}
+}
@@ -0,0 +1,144 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	maxRedirects = 5
+	userAgent    = "url-shortener-preview/1.0"
+)
+
+var (
+	errForbiddenAddress = errors.New("destination address is not public")
+	errNotWebURL        = errors.New("destination is not an http(s) url")
+)
+
+// Ranges net/netip doesn't consider private that still must not be reached
+// through a destination: this network, shared and benchmark addresses and
+// the IPv6 prefixes that embed an IPv4 address.
+var forbiddenPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// Fetcher downloads destination pages. Anyone can create a link, so the
+// address is checked when connecting, after DNS resolution and for every
+// redirect, and only public addresses are reached.
+type Fetcher struct {
+	client  *http.Client
+	maxSize int64
+}
+
+func NewFetcher(timeout time.Duration, maxSize int64) *Fetcher {
+	return newFetcher(timeout, maxSize, publicAddress)
+}
+
+func newFetcher(timeout time.Duration, maxSize int64, allow func(netip.AddrPort) bool) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allow(addrPort) {
+				return fmt.Errorf("%w: %s", errForbiddenAddress, address)
+			}
+			return nil
+		},
+	}
+	// No proxy from the environment, the proxy would connect on our behalf
+	// and bypass the address check.
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if !webURL(request.URL) {
+				return errNotWebURL
+			}
+			return nil
+		},
+	}
+	return &Fetcher{client: client, maxSize: maxSize}
+}
+
+// Fetch reads at most maxSize bytes of the page at rawURL. Destinations that
+// are not HTML have no metadata, which is not an error.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (models.LinkMetadata, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return models.LinkMetadata{}, err
+	}
+	if !webURL(request.URL) {
+		return models.LinkMetadata{}, errNotWebURL
+	}
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+	request.Header.Set("User-Agent", userAgent)
+	response, err := f.client.Do(request)
+	if err != nil {
+		return models.LinkMetadata{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return models.LinkMetadata{}, fmt.Errorf("destination responded with %s", response.Status)
+	}
+	metadata := models.LinkMetadata{FetchedAt: time.Now().UTC()}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return metadata, nil
+	}
+	// A page cut at maxSize still has its head, which is all that is read.
+	page, err := io.ReadAll(io.LimitReader(response.Body, f.maxSize))
+	if err != nil {
+		return models.LinkMetadata{}, err
+	}
+	parsed := parseMetadata(string(page), response.Request.URL)
+	parsed.FetchedAt = metadata.FetchedAt
+	return parsed, nil
+}
+
+func publicAddress(addrPort netip.AddrPort) bool {
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range forbiddenPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func webURL(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,173 @@
+package enrich
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+	maxImageLength       = 2048
+)
+
+// parseMetadata scans the head of page for the title, the description and
+// the Open Graph image. The <title> and <meta name="description"> win over
+// their Open Graph variants, a relative image is resolved against base.
+func parseMetadata(page string, base *url.URL) models.LinkMetadata {
+	meta := make(map[string]string)
+	var title string
+	for rest := page; ; {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		rest = rest[start:]
+		if strings.HasPrefix(rest, "<!--") {
+			end := strings.Index(rest, "-->")
+			if end < 0 {
+				break
+			}
+			rest = rest[end+3:]
+			continue
+		}
+		end := strings.IndexByte(rest, '>')
+		if end < 0 {
+			break
+		}
+		tag := rest[1:end]
+		rest = rest[end+1:]
+		raw := tagName(tag)
+		name := strings.ToLower(raw)
+		switch name {
+		case "title", "script", "style":
+			content, after := rawText(rest, name)
+			if name == "title" && title == "" {
+				title = content
+			}
+			rest = after
+		case "meta":
+			attributes := parseAttributes(tag[len(raw):])
+			key := strings.ToLower(attributes["name"])
+			if key == "" {
+				key = strings.ToLower(attributes["property"])
+			}
+			if _, ok := meta[key]; key != "" && !ok {
+				meta[key] = attributes["content"]
+			}
+		case "/head", "body":
+			rest = ""
+		}
+	}
+
+	metadata := models.LinkMetadata{
+		Title:       clean(firstNonEmpty(title, meta["og:title"]), maxTitleLength),
+		Description: clean(firstNonEmpty(meta["description"], meta["og:description"]), maxDescriptionLength),
+	}
+	image := strings.TrimSpace(firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["og:image:secure_url"]))
+	if imageURL, err := base.Parse(image); image != "" && err == nil && webURL(imageURL) && len(imageURL.String()) <= maxImageLength {
+		metadata.Image = imageURL.String()
+	}
+	return metadata
+}
+
+// tagName keeps the slash of a closing tag and drops the one of a self
+// closing tag.
+func tagName(tag string) string {
+	start := min(1, len(tag))
+	end := strings.IndexAny(tag[start:], " \t\n\r\f/")
+	if end < 0 {
+		return tag
+	}
+	return tag[:start+end]
+}
+
+// rawText returns the unescaped text up to the closing tag of name and what
+// follows it.
+func rawText(page string, name string) (string, string) {
+	end := indexFold(page, "</"+name)
+	if end < 0 {
+		return "", ""
+	}
+	after := page[end:]
+	if closing := strings.IndexByte(after, '>'); closing >= 0 {
+		after = after[closing+1:]
+	}
+	return html.UnescapeString(page[:end]), after
+}
+
+func indexFold(s string, substr string) int {
+	for i := strings.IndexByte(s, substr[0]); i >= 0 && i+len(substr) <= len(s); {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+		next := strings.IndexByte(s[i+1:], substr[0])
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return -1
+}
+
+// parseAttributes reads name=value pairs with quoted, unquoted or missing
+// values, names are lower cased.
+func parseAttributes(tag string) map[string]string {
+	attributes := make(map[string]string)
+	for {
+		tag = strings.TrimLeft(tag, " \t\n\r\f/")
+		if tag == "" {
+			return attributes
+		}
+		end := strings.IndexAny(tag, "= \t\n\r\f/")
+		if end < 0 {
+			end = len(tag)
+		}
+		name := strings.ToLower(tag[:end])
+		tag = strings.TrimLeft(tag[end:], " \t\n\r\f")
+		value := ""
+		if strings.HasPrefix(tag, "=") {
+			tag = strings.TrimLeft(tag[1:], " \t\n\r\f")
+			if tag != "" && (tag[0] == '"' || tag[0] == '\'') {
+				closing := strings.IndexByte(tag[1:], tag[0])
+				if closing < 0 {
+					closing = len(tag) - 1
+				}
+				value = tag[1 : closing+1]
+				tag = tag[min(closing+2, len(tag)):]
+			} else {
+				end := strings.IndexAny(tag, " \t\n\r\f")
+				if end < 0 {
+					end = len(tag)
+				}
+				value = tag[:end]
+				tag = tag[end:]
+			}
+		}
+		if _, ok := attributes[name]; name != "" && !ok {
+			attributes[name] = html.UnescapeString(value)
+		}
+	}
+}
+
+// clean collapses the white space of text and cuts it to maxLength runes.
+func clean(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if utf8.RuneCountInString(text) <= maxLength {
+		return text
+	}
+	return strings.TrimSpace(string([]rune(text)[:maxLength]))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -2,6 +2,62 @@ package errors
 
 import "errors"
 
-var ErrKey error = errors.New("key not exist")
+var (
+	ErrNotFound     error = errors.New("not found")
+	ErrGone         error = errors.New("gone")
+	ErrConflict     error = errors.New("conflict url is no exist")
+	ErrValidation   error = errors.New("validation failed")
+	ErrUnavailable  error = errors.New("storage is unavailable")
+	ErrUnauthorized error = errors.New("unauthorized")
+	ErrForbidden    error = errors.New("forbidden")
+)
+
+var ErrKey error = New(ErrNotFound, "key not exist")
+var ErrDeleted error = New(ErrGone, "link is deleted")
+var ErrDisabled error = New(ErrGone, "link is disabled")
+var ErrStaleVersion error = New(ErrConflict, "link was changed by another request")
+var ErrURLTaken error = New(ErrConflict, "url is already shortened by another link")
 var ErrWrite error = errors.New("error witch write key")
-var ErrConflict error = errors.New("conflict url is no exist")
+var ErrURLTooLong error = New(ErrValidation, "url is too long")
+var ErrInvalidToken error = New(ErrUnauthorized, "invalid api key")
+var ErrScope error = New(ErrForbidden, "api key has no required scope")
+
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func New(kind error, msg string) error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+func Wrap(kind error, msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Msg: msg, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+func Kind(err error) error {
+	for _, kind := range []error{ErrNotFound, ErrGone, ErrConflict, ErrValidation, ErrUnavailable, ErrUnauthorized, ErrForbidden} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
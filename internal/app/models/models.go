@@ -1,7 +1,11 @@
 package models
 
+import "time"
+
 type Redirect struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Domain string `json:"domain,omitempty"`
+	LinkDetails
 }
 
 type ResultString struct {
@@ -11,9 +15,214 @@ type ResultString struct {
 type URLRowOriginal struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	Domain        string `json:"domain,omitempty"`
 }
 
 type URLRowShort struct {
 	CorrelationID string `json:"correlation_id"`
 	ShortURL      string `json:"short_url"`
+	// Created is set when the link was created by the batch rather than
+	// already stored.
+	Created bool `json:"-"`
+}
+
+type Link struct {
+	Key         string    `json:"key"`
+	OriginalURL string    `json:"original_url"`
+	UserID      string    `json:"user_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Deleted     bool      `json:"is_deleted,omitempty"`
+	Disabled    bool      `json:"is_disabled,omitempty"`
+	// Version grows with every change, an update carrying a version only
+	// applies to that version of the link.
+	Version int64 `json:"version"`
+	LinkDetails
+	Metadata *LinkMetadata `json:"metadata,omitempty"`
+}
+
+// LinkDetails are the fields users organize their links with.
+type LinkDetails struct {
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+}
+
+// LinkMetadata is what the destination page says about itself, fetched in
+// the background after the link is created or its destination changes.
+type LinkMetadata struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// LinkPreview is what the preview page shows instead of redirecting.
+type LinkPreview struct {
+	Link
+	Clicks int64
+}
+
+// LinkEdit changes the fields that are set and keeps the others.
+type LinkEdit struct {
+	URL   *string   `json:"url,omitempty"`
+	Title *string   `json:"title,omitempty"`
+	Tags  *[]string `json:"tags,omitempty"`
+	Notes *string   `json:"notes,omitempty"`
+}
+
+// LinkVersion is a destination a link has pointed to, ReplacedAt is nil for
+// the current one.
+type LinkVersion struct {
+	Version    int        `json:"version"`
+	URL        string     `json:"url"`
+	ReplacedAt *time.Time `json:"replaced_at,omitempty"`
+}
+
+type Rollback struct {
+	Version int `json:"version"`
+}
+
+type LinkFilter struct {
+	Key           string
+	URL           string
+	Owner         string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Limit         int
+	Cursor        string
+}
+
+// UserLinkFilter selects links of the caller, Query matches whole words of
+// the URL, title and notes.
+type UserLinkFilter struct {
+	Tag    string
+	Query  string
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// LinkQuery selects the links of a listing, zero fields match every link.
+// URL is a case insensitive substring and Search matches whole words of the
+// URL, title and notes.
+type LinkQuery struct {
+	KeyPrefix      string
+	URL            string
+	Owner          string
+	Tag            string
+	Search         string
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	IncludeDeleted bool
+}
+
+// PageRequest picks a page of a listing, Cursor is the NextCursor of the
+// previous page.
+type PageRequest struct {
+	Limit      int
+	Cursor     string
+	Descending bool
+}
+
+type LinkPage struct {
+	Links      []Link `json:"links"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type LinkUpdate struct {
+	Owner    *string `json:"owner,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+	Version  *int64  `json:"version,omitempty"`
+}
+
+// AuditEvent is one change of the audit log. Seq is the position of the event
+// in the log, it is assigned by the storage.
+type AuditEvent struct {
+	Seq       int64     `json:"-"`
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Key       string    `json:"key,omitempty"`
+	Old       string    `json:"old,omitempty"`
+	New       string    `json:"new,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Key    string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Cursor string
+}
+
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Key    string
+	Since  time.Time
+	Until  time.Time
+}
+
+type AuditPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+type Health struct {
+	Status              string `json:"status"`
+	Breaker             string `json:"breaker,omitempty"`
+	ClickBreaker        string `json:"click_breaker,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+	RetryAt             string `json:"retry_at,omitempty"`
+}
+
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIKeyCreated struct {
+	APIKey
+	Token string `json:"token"`
 }
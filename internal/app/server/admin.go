@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func (s *Server) searchLinks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.LinkFilter{
+		Key:    query.Get("key"),
+		URL:    query.Get("url"),
+		Owner:  query.Get("owner"),
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if value := query.Get("created_after"); value != "" {
+		if filter.CreatedAfter, err = time.Parse(time.RFC3339, value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid created_after")
+			return
+		}
+	}
+	if value := query.Get("created_before"); value != "" {
+		if filter.CreatedBefore, err = time.Parse(time.RFC3339, value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid created_before")
+			return
+		}
+	}
+	page, err := s.service.SearchLinks(r.Context(), filter)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, page)
+}
+
+func (s *Server) getLink(w http.ResponseWriter, r *http.Request) {
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	link, err := s.service.GetLink(r.Context(), key)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, link)
+}
+
+func (s *Server) updateLink(w http.ResponseWriter, r *http.Request) {
+	dataBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, "invalid parse body")
+		return
+	}
+	var update models.LinkUpdate
+	if err := json.Unmarshal(dataBytes, &update); err != nil {
+		s.error(w, r, http.StatusBadRequest, "invalid parse body")
+		return
+	}
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	link, err := s.service.UpdateLink(r.Context(), key, update)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Update link", key, "by", auth.UserID(r.Context()))
+	s.json(w, r, http.StatusOK, link)
+}
+
+func (s *Server) deleteLink(w http.ResponseWriter, r *http.Request) {
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	if err := s.service.DeleteLink(r.Context(), key); err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Delete link", key, "by", auth.UserID(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) searchAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Key:    query.Get("key"),
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid since")
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid until")
+			return
+		}
+	}
+	page, err := s.service.SearchAudit(r.Context(), filter)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, page)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func TestServer_adminLinks(t *testing.T) {
+	s, storageTest, service := newAuthTestServer(t)
+	admin := createTestAPIKey(t, service, "ops", auth.ScopeAdmin)
+	team := createTestAPIKey(t, service, "team", auth.ScopeShorten)
+	keys := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		token := ""
+		if i%2 == 0 {
+			token = team.Token
+		}
+		res := doAuthorized(s, http.MethodPost, "/api/v1/shorten", token, fmt.Sprintf(`{"url": "https://example.com/page/%d"}`, i))
+		var result models.ResultString
+		json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		keys = append(keys, result.Result[len("http://127.0.0.1:8080/"):])
+	}
+
+	search := func(query string) models.LinkPage {
+		t.Helper()
+		res := doAuthorized(s, http.MethodGet, "/api/admin/links"+query, admin.Token, "")
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code 200 for %s, got %d", query, res.StatusCode)
+		}
+		var page models.LinkPage
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	if page := search("?owner=team"); len(page.Links) != 3 || page.NextCursor != "" {
+		t.Errorf("Expected 3 links owned by team, got %+v", page)
+	}
+	if page := search("?url=PAGE/4"); len(page.Links) != 1 || page.Links[0].Key != keys[4] {
+		t.Errorf("Expected link of page 4, got %+v", page)
+	}
+	if page := search("?key=" + keys[1][:6]); len(page.Links) == 0 || page.Links[0].Key != keys[1] {
+		t.Errorf("Expected link %s by key prefix, got %+v", keys[1], page)
+	}
+	if page := search("?created_before=2000-01-01T00:00:00Z"); len(page.Links) != 0 {
+		t.Errorf("Expected no links created before 2000, got %+v", page)
+	}
+	seen := make(map[string]bool)
+	query := "?limit=2"
+	for pages := 0; ; pages++ {
+		page := search(query)
+		for _, link := range page.Links {
+			seen[link.Key] = true
+		}
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Errorf("Expected 3 pages, got %d", pages+1)
+			}
+			break
+		}
+		query = "?limit=2&cursor=" + page.NextCursor
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected to page through 5 links, got %d", len(seen))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		body   string
+		code   int
+	}{
+		{name: "not admin", method: http.MethodGet, url: "/api/admin/links", token: team.Token, code: 403},
+		{name: "invalid cursor", method: http.MethodGet, url: "/api/admin/links?cursor=!!", token: admin.Token, code: 422},
+		{name: "limit too large", method: http.MethodGet, url: "/api/admin/links?limit=1000", token: admin.Token, code: 400},
+		{name: "disable", method: http.MethodPatch, url: "/api/admin/links/" + keys[0], token: admin.Token, body: `{"disabled": true}`, code: 200},
+		{name: "disabled redirect", method: http.MethodGet, url: "/" + keys[0], code: 410},
+		{name: "enable", method: http.MethodPatch, url: "/api/admin/links/" + keys[0], token: admin.Token, body: `{"disabled": false}`, code: 200},
+		{name: "enabled redirect", method: http.MethodGet, url: "/" + keys[0], code: 307},
+		{name: "reassign", method: http.MethodPatch, url: "/api/admin/links/" + keys[1], token: admin.Token, body: `{"owner": "bob"}`, code: 200},
+		{name: "unchanged", method: http.MethodPatch, url: "/api/admin/links/" + keys[1], token: admin.Token, body: `{"owner": "bob"}`, code: 200},
+		{name: "update missing", method: http.MethodPatch, url: "/api/admin/links/missing", token: admin.Token, body: `{"disabled": true}`, code: 404},
+		{name: "get", method: http.MethodGet, url: "/api/admin/links/" + keys[1], token: admin.Token, code: 200},
+		{name: "delete", method: http.MethodDelete, url: "/api/admin/links/" + keys[2], token: admin.Token, code: 204},
+		{name: "deleted redirect", method: http.MethodGet, url: "/" + keys[2], code: 404},
+		{name: "delete missing", method: http.MethodDelete, url: "/api/admin/links/" + keys[2], token: admin.Token, code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, tt.method, tt.url, tt.token, tt.body)
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+
+	if link, err := storageTest.GetLink(context.Background(), keys[1]); err != nil || link.UserID != "bob" {
+		t.Errorf("Expected link owned by bob, got %+v, %v", link, err)
+	}
+	actions := make([]string, 0)
+	storageTest.IterateAudit(context.Background(), func(event models.AuditEvent) error {
+		if event.Actor == "ops" {
+			actions = append(actions, event.Action)
+		}
+		return nil
+	})
+	if fmt.Sprint(actions) != "[disable enable reassign delete]" {
+		t.Errorf("Unexpected audit actions %v", actions)
+	}
+}
+
+func TestServer_adminLinksRequireAuth(t *testing.T) {
+	s := newTestServer()
+	request := httptest.NewRequest(http.MethodGet, "/api/admin/links", nil)
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, request)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code 401, got %d", w.Code)
+	}
+}
+
+func TestServer_audit(t *testing.T) {
+	s, _, service := newAuthTestServer(t)
+	admin := createTestAPIKey(t, service, "ops", auth.ScopeAdmin)
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(fmt.Sprintf(`{"url": "https://example.com/audit/%d"}`, i)))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+admin.Token)
+		request.Header.Set("X-Request-ID", fmt.Sprintf("create-%d", i))
+		request.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, request)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", w.Code)
+		}
+	}
+	res := doAuthorized(s, http.MethodPost, "/api/admin/keys", admin.Token, `{"name": "ci", "scopes": ["read"]}`)
+	var created models.APIKeyCreated
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	doAuthorized(s, http.MethodDelete, "/api/admin/keys/"+created.ID, admin.Token, "").Body.Close()
+
+	search := func(query string) models.AuditPage {
+		t.Helper()
+		res := doAuthorized(s, http.MethodGet, "/api/admin/audit"+query, admin.Token, "")
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code 200 for %s, got %d", query, res.StatusCode)
+		}
+		var page models.AuditPage
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	creates := search("?action=create&actor=ops")
+	if len(creates.Events) != 3 {
+		t.Fatalf("Expected 3 create events, got %+v", creates)
+	}
+	for i, event := range creates.Events {
+		if event.IP != "192.0.2.1" || event.RequestID != fmt.Sprintf("create-%d", i) ||
+			event.New != fmt.Sprintf("https://example.com/audit/%d", i) || event.Key == "" {
+			t.Errorf("Unexpected create event %+v", event)
+		}
+	}
+	if page := search("?key=" + created.ID); len(page.Events) != 2 ||
+		page.Events[0].Action != "create_api_key" || page.Events[1].Action != "revoke_api_key" {
+		t.Errorf("Expected api key create and revoke events, got %+v", page)
+	}
+	if page := search("?since=2999-01-01T00:00:00Z"); len(page.Events) != 0 {
+		t.Errorf("Expected no future events, got %+v", page)
+	}
+
+	first := search("?action=create&limit=2")
+	if len(first.Events) != 2 || first.NextCursor == "" {
+		t.Fatalf("Expected first page of 2 events, got %+v", first)
+	}
+	second := search("?action=create&limit=2&cursor=" + first.NextCursor)
+	if len(second.Events) != 1 || second.NextCursor != "" || second.Events[0].ID != creates.Events[2].ID {
+		t.Errorf("Expected last create event on the second page, got %+v", second)
+	}
+
+	res = doAuthorized(s, http.MethodPost, "/api/v1/shorten", admin.Token, `{"url": "https://example.com/audit/details", "title": "Docs"}`)
+	res.Body.Close()
+	if page := search("?action=details"); len(page.Events) != 1 || page.Events[0].Key == "" ||
+		page.Events[0].Actor != "ops" || !strings.Contains(page.Events[0].New, `"Docs"`) {
+		t.Errorf("Expected details event of the created link, got %+v", page)
+	}
+
+	for query, code := range map[string]int{"?action=unknown": http.StatusBadRequest, "?cursor=OTk5": http.StatusUnprocessableEntity} {
+		res = doAuthorized(s, http.MethodGet, "/api/admin/audit"+query, admin.Token, "")
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("Expected status code %d for %s, got %d", code, query, res.StatusCode)
+		}
+	}
+}
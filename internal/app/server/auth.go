@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+// authenticate resolves a Bearer API key or JWT into the request principal.
+// Requests without an Authorization header stay anonymous, a bad token is
+// always rejected.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		scheme, token, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			s.unauthorized(w, r, appErrors.ErrInvalidToken)
+			return
+		}
+		principal, err := s.principal(r.Context(), strings.TrimSpace(token))
+		if errors.Is(err, appErrors.ErrUnauthorized) {
+			s.unauthorized(w, r, err)
+			return
+		}
+		if err != nil {
+			s.problem(w, r, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func (s *Server) principal(ctx context.Context, token string) (auth.Principal, error) {
+	if s.jwt != nil && auth.IsJWT(token) {
+		return s.jwt.Verify(ctx, token)
+	}
+	return s.service.Authenticate(ctx, token)
+}
+
+// withScope lets anonymous requests through but requires API keys to carry scope.
+func (s *Server) withScope(scope string) func(http.Handler) http.Handler {
+	return s.scoped(scope, false)
+}
+
+// requireScope only lets through API keys carrying scope.
+func (s *Server) requireScope(scope string) func(http.Handler) http.Handler {
+	return s.scoped(scope, true)
+}
+
+func (s *Server) scoped(scope string, required bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.FromContext(r.Context())
+			switch {
+			case !ok && required:
+				s.unauthorized(w, r, appErrors.New(appErrors.ErrUnauthorized, "api key is required"))
+			case ok && !principal.HasScope(scope):
+				s.problem(w, r, appErrors.ErrScope)
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func (s *Server) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	s.problem(w, r, err)
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	dataBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, "invalid parse body")
+		return
+	}
+	var request models.APIKeyRequest
+	if err := json.Unmarshal(dataBytes, &request); err != nil {
+		s.error(w, r, http.StatusBadRequest, "invalid parse body")
+		return
+	}
+	created, err := s.service.CreateAPIKey(r.Context(), request)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Create api key", created.ID, "for", created.Owner, "by", auth.UserID(r.Context()))
+	s.json(w, r, http.StatusCreated, created)
+}
+
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.service.ListAPIKeys(r.Context())
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, keys)
+}
+
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("apiKeyID")
+	if err := s.service.RevokeAPIKey(r.Context(), id); err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Revoke api key", id, "by", auth.UserID(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) json(w http.ResponseWriter, r *http.Request, code int, value interface{}) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
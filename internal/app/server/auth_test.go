@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+func newAuthTestServer(t *testing.T) (Server, *storage.InmemoryStorage, services.Service) {
+	t.Helper()
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	storageTest := storage.NewInmemoryStorage(&configTest)
+	service := services.NewService(storageTest)
+	return NewServer(service, configTest), storageTest, service
+}
+
+func createTestAPIKey(t *testing.T, service services.Service, owner string, scopes ...string) models.APIKeyCreated {
+	t.Helper()
+	created, err := service.CreateAPIKey(context.Background(), models.APIKeyRequest{Name: "test", Owner: owner, Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func doAuthorized(s Server, method, url, token, body string) *http.Response {
+	request := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, request)
+	return w.Result()
+}
+
+func TestServer_authentication(t *testing.T) {
+	s, _, service := newAuthTestServer(t)
+	admin := createTestAPIKey(t, service, "", auth.ScopeAdmin)
+	reader := createTestAPIKey(t, service, "", auth.ScopeRead)
+	revoked := createTestAPIKey(t, service, "", auth.ScopeShorten)
+	if err := service.RevokeAPIKey(context.Background(), revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		body   string
+		code   int
+	}{
+		{name: "anonymous shorten", method: http.MethodPost, url: "/api/v1/shorten", body: `{"url": "https://example.com/anonymous"}`, code: 201},
+		{name: "admin without key", method: http.MethodGet, url: "/api/admin/keys", code: 401},
+		{name: "malformed token", method: http.MethodGet, url: "/api/admin/keys", token: "nope", code: 401},
+		{name: "unknown key", method: http.MethodGet, url: "/api/admin/keys", token: "sk_000000000000_secret", code: 401},
+		{name: "wrong secret", method: http.MethodGet, url: "/api/admin/keys", token: "sk_" + admin.ID + "_secret", code: 401},
+		{name: "revoked key", method: http.MethodPost, url: "/api/v1/shorten", token: revoked.Token, body: `{"url": "https://example.com/revoked"}`, code: 401},
+		{name: "missing scope", method: http.MethodPost, url: "/api/v1/shorten", token: reader.Token, body: `{"url": "https://example.com/reader"}`, code: 403},
+		{name: "admin scope required", method: http.MethodGet, url: "/api/admin/keys", token: reader.Token, code: 403},
+		{name: "admin implies shorten", method: http.MethodPost, url: "/api/v1/shorten", token: admin.Token, body: `{"url": "https://example.com/admin"}`, code: 201},
+		{name: "admin list", method: http.MethodGet, url: "/api/admin/keys", token: admin.Token, code: 200},
+		{name: "admin create unknown scope", method: http.MethodPost, url: "/api/admin/keys", token: admin.Token, body: `{"name": "bad", "scopes": ["root"]}`, code: 400},
+		{name: "admin revoke unknown", method: http.MethodDelete, url: "/api/admin/keys/missing", token: admin.Token, code: 404},
+		{name: "admin revoke", method: http.MethodDelete, url: "/api/admin/keys/" + reader.ID, token: admin.Token, code: 204},
+		{name: "revoked after admin revoke", method: http.MethodGet, url: "/api/admin/keys", token: reader.Token, code: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, tt.method, tt.url, tt.token, tt.body)
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestServer_apiKeyOwner(t *testing.T) {
+	s, storageTest, service := newAuthTestServer(t)
+	admin := createTestAPIKey(t, service, "", auth.ScopeAdmin)
+
+	res := doAuthorized(s, http.MethodPost, "/api/admin/keys", admin.Token, `{"name": "ci", "owner": "team", "scopes": ["shorten"]}`)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", res.StatusCode)
+	}
+	var created models.APIKeyCreated
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.Owner != "team" {
+		t.Fatalf("Unexpected created key %+v", created)
+	}
+
+	shorten := doAuthorized(s, http.MethodPost, "/api/v1/shorten", created.Token, `{"url": "https://example.com/team"}`)
+	defer shorten.Body.Close()
+	if shorten.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", shorten.StatusCode)
+	}
+	var owner string
+	storageTest.Iterate(context.Background(), func(link models.Link) error {
+		if link.OriginalURL == "https://example.com/team" {
+			owner = link.UserID
+		}
+		return nil
+	})
+	if owner != "team" {
+		t.Errorf("Expected link owned by team, got %q", owner)
+	}
+
+	list := doAuthorized(s, http.MethodGet, "/api/admin/keys", admin.Token, "")
+	defer list.Body.Close()
+	var keys []map[string]interface{}
+	if err := json.NewDecoder(list.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, ok := key["hash"]; ok {
+			t.Errorf("Expected key hash to be hidden, got %v", key)
+		}
+	}
+}
+
+func signTestJWT(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"test"}`))
+	payload, _ := json.Marshal(claims)
+	input := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestServer_jwtAuthentication(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC", "kid": "test", "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(filename, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var configTest = config.Config{
+		RunAddr:     "127.0.0.1:8080",
+		ShortAddr:   "http://127.0.0.1:8080",
+		JWKS:        filename,
+		JWKSRefresh: time.Hour,
+		JWTIssuer:   "https://sso.example.com",
+	}
+	storageTest := storage.NewInmemoryStorage(&configTest)
+	service := services.NewService(storageTest)
+	s := NewServer(service, configTest)
+	apiKey := createTestAPIKey(t, service, "", auth.ScopeShorten)
+
+	token := func(scope string, exp time.Duration) string {
+		return signTestJWT(t, key, map[string]interface{}{
+			"sub": "alice", "iss": "https://sso.example.com", "scope": scope, "exp": time.Now().Add(exp).Unix(),
+		})
+	}
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		body   string
+		code   int
+	}{
+		{name: "shorten", method: http.MethodPost, url: "/api/v1/shorten", token: token("shorten", time.Hour), body: `{"url": "https://example.com/alice"}`, code: 201},
+		{name: "missing scope", method: http.MethodPost, url: "/api/v1/shorten", token: token("read", time.Hour), body: `{"url": "https://example.com/read"}`, code: 403},
+		{name: "expired", method: http.MethodPost, url: "/api/v1/shorten", token: token("shorten", -time.Hour), body: `{"url": "https://example.com/expired"}`, code: 401},
+		{name: "admin role", method: http.MethodGet, url: "/api/admin/keys", token: token("admin", time.Hour), code: 200},
+		{name: "admin without role", method: http.MethodGet, url: "/api/admin/keys", token: token("shorten read", time.Hour), code: 403},
+		{name: "api key still accepted", method: http.MethodPost, url: "/api/v1/shorten", token: apiKey.Token, body: `{"url": "https://example.com/key"}`, code: 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, tt.method, tt.url, tt.token, tt.body)
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+
+	var owner string
+	storageTest.Iterate(context.Background(), func(link models.Link) error {
+		if link.OriginalURL == "https://example.com/alice" {
+			owner = link.UserID
+		}
+		return nil
+	})
+	if owner != "alice" {
+		t.Errorf("Expected link owned by alice, got %q", owner)
+	}
+}
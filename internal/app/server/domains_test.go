@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+func TestServer_domains(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "domains.json")
+	data := `[{"host": "go.brand.example", "owners": ["marketing"]}, {"host": "Open.Example.", "base_url": "http://open.example:8080/"}]`
+	if err := os.WriteFile(filename, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configTest := config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+		Domains:   filename,
+	}
+	service := services.NewService(storage.NewInmemoryStorage(&configTest))
+	s := NewServer(service, configTest)
+	owner := createTestAPIKey(t, service, "marketing", auth.ScopeShorten, auth.ScopeRead)
+	other := createTestAPIKey(t, service, "sales", auth.ScopeShorten, auth.ScopeRead)
+	admin := createTestAPIKey(t, service, "ops", auth.ScopeAdmin)
+
+	shorten := func(token string, body string) (int, string) {
+		t.Helper()
+		res := doAuthorized(s, http.MethodPost, "/api/v1/shorten", token, body)
+		defer res.Body.Close()
+		var result models.ResultString
+		json.NewDecoder(res.Body).Decode(&result)
+		return res.StatusCode, result.Result
+	}
+	_, defaultURL := shorten(owner.Token, `{"url": "https://example.com/launch"}`)
+	code, brandURL := shorten(owner.Token, `{"url": "https://example.com/launch", "domain": "go.brand.example"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", code)
+	}
+	key := defaultURL[len("http://127.0.0.1:8080/"):]
+	if brandURL != "https://go.brand.example/"+key {
+		t.Errorf("Expected the same key on the brand domain, got %s", brandURL)
+	}
+	if _, openURL := shorten(other.Token, `{"url": "https://example.com/open", "domain": "open.example"}`); !strings.HasPrefix(openURL, "http://open.example:8080/") {
+		t.Errorf("Expected a short URL of the open domain, got %s", openURL)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		code  int
+	}{
+		{name: "not an owner", token: other.Token, body: `{"url": "https://example.com/a", "domain": "go.brand.example"}`, code: 403},
+		{name: "anonymous", body: `{"url": "https://example.com/a", "domain": "open.example"}`, code: 403},
+		{name: "unknown domain", token: owner.Token, body: `{"url": "https://example.com/a", "domain": "unknown.example"}`, code: 422},
+		{name: "admin", token: admin.Token, body: `{"url": "https://example.com/a", "domain": "go.brand.example"}`, code: 201},
+		{name: "default domain by name", token: other.Token, body: `{"url": "https://example.com/b", "domain": "127.0.0.1:8080"}`, code: 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := shorten(tt.token, tt.body); code != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, code)
+			}
+		})
+	}
+
+	res := doAuthorized(s, http.MethodPatch, "/api/urls/"+key+"?domain=go.brand.example", owner.Token, `{"url": "https://example.com/brand"}`)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", res.StatusCode)
+	}
+	links := []struct {
+		method string
+		url    string
+		token  string
+		code   int
+		body   string
+	}{
+		{method: http.MethodGet, url: "/api/urls/" + key + "/history?domain=GO.brand.example", token: owner.Token, code: 200, body: "https://example.com/brand"},
+		{method: http.MethodGet, url: "/api/urls/" + key + "/history", token: owner.Token, code: 200, body: `[{"version":1,"url":"https://example.com/launch"}]`},
+		{method: http.MethodGet, url: "/api/admin/links/" + key + "?domain=go.brand.example", token: admin.Token, code: 200, body: "https://example.com/brand"},
+		{method: http.MethodGet, url: "/api/admin/links/" + key + "@go.brand.example", token: admin.Token, code: 404},
+		{method: http.MethodGet, url: "/api/admin/links/" + key + "?domain=unknown.example", token: admin.Token, code: 422},
+	}
+	for _, tt := range links {
+		res := doAuthorized(s, tt.method, tt.url, tt.token, "")
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.code || !strings.Contains(string(body), tt.body) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", tt.method, tt.url, tt.code, tt.body, res.StatusCode, body)
+		}
+	}
+	redirects := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{url: "/" + key, code: 307, location: "https://example.com/launch"},
+		{url: "http://go.brand.example/" + key, code: 307, location: "https://example.com/brand"},
+		{url: "http://GO.brand.example:443/" + key, code: 307, location: "https://example.com/brand"},
+		{url: "/" + key + "@go.brand.example", code: 404},
+		{url: "http://open.example/" + key, code: 404},
+	}
+	for _, tt := range redirects {
+		res := doAuthorized(s, http.MethodGet, tt.url, "", "")
+		res.Body.Close()
+		if res.StatusCode != tt.code || res.Header.Get("Location") != tt.location {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.url, tt.code, tt.location, res.StatusCode, res.Header.Get("Location"))
+		}
+	}
+
+	res = doAuthorized(s, http.MethodPost, "/api/v1/shorten/batch", owner.Token, `[
+		{"correlation_id": "1", "original_url": "https://example.com/batch", "domain": "go.brand.example"},
+		{"correlation_id": "2", "original_url": "https://example.com/batch"},
+		{"correlation_id": "3", "original_url": "https://example.com/batch-2", "domain": "go.brand.example"}
+	]`)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status code 201, got %d", res.StatusCode)
+	}
+	var rows []models.URLRowShort
+	if err := json.NewDecoder(res.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(rows))
+	for _, row := range rows {
+		got = append(got, row.CorrelationID+":"+row.ShortURL[:strings.LastIndex(row.ShortURL, "/")])
+	}
+	if fmt.Sprint(got) != "[1:https://go.brand.example 2:http://127.0.0.1:8080 3:https://go.brand.example]" {
+		t.Errorf("Unexpected batch result %v", got)
+	}
+}
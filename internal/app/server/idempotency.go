@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyLockStripes    = 64
+)
+
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *capturingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response of a request repeated with the same
+// Idempotency-Key and rejects the key when it is reused for a different request.
+// Requests with the same key are serialized so a retry racing the original waits
+// for its response instead of creating links twice.
+func (s *Server) idempotent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.config.IdempotencyTTL <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		// Keys are chosen by clients, so each owner gets its own key space.
+		if owner := auth.UserID(r.Context()); owner != "" {
+			key = owner + ":" + key
+		}
+		lock := s.idempotencyLock(key)
+		lock.Lock()
+		defer lock.Unlock()
+
+		record, err := s.service.Idempotency(r.Context(), key)
+		switch {
+		case err == nil && record.Fingerprint != fingerprint:
+			writeError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+			return
+		case err == nil:
+			if record.ContentType != "" {
+				w.Header().Set("content-type", record.ContentType)
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		case !errors.Is(err, appErrors.ErrNotFound):
+			s.problem(w, r, err)
+			return
+		}
+
+		cw := &capturingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, r)
+		if cw.status == 0 || cw.status >= http.StatusInternalServerError {
+			return
+		}
+		record = models.IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      cw.status,
+			ContentType: w.Header().Get("content-type"),
+			Body:        cw.body.Bytes(),
+			ExpiresAt:   time.Now().Add(s.config.IdempotencyTTL).UTC(),
+		}
+		if err := s.service.SaveIdempotency(context.WithoutCancel(r.Context()), record); err != nil {
+			Sugar.Warnln("save idempotency record", key, err)
+		}
+	})
+}
+
+func (s *Server) idempotencyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.idempotencyLocks[h.Sum32()%idempotencyLockStripes]
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	h := sha256.New()
+	for _, part := range []string{r.Method, r.URL.Path, mediaType} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+type countingStorage struct {
+	*storage.InmemoryStorage
+	calls atomic.Int32
+}
+
+func (c *countingStorage) Add(ctx context.Context, url string) (string, error) {
+	c.calls.Add(1)
+	return c.InmemoryStorage.Add(ctx, url)
+}
+
+func (c *countingStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	c.calls.Add(1)
+	return c.InmemoryStorage.AddByBatch(ctx, requestURLs)
+}
+
+func newIdempotencyTestServer() (Server, *countingStorage) {
+	var configTest = config.Config{
+		RunAddr:        "127.0.0.1:8080",
+		ShortAddr:      "http://127.0.0.1:8080",
+		IdempotencyTTL: time.Hour,
+	}
+	storageTest := &countingStorage{InmemoryStorage: storage.NewInmemoryStorage(&configTest)}
+	return NewServer(services.NewService(storageTest), configTest), storageTest
+}
+
+func doIdempotent(s Server, url, contentType, key, body string) *http.Response {
+	request := httptest.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", contentType)
+	if key != "" {
+		request.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, request)
+	return w.Result()
+}
+
+func TestServer_idempotency(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		code        int
+	}{
+		{
+			name:        "batch",
+			url:         "/api/v1/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id": "1", "original_url": "https://example.com/batch"}]`,
+			code:        201,
+		},
+		{
+			name:        "shorten",
+			url:         "/api/v1/shorten",
+			contentType: "application/json",
+			body:        `{"url": "https://example.com/shorten"}`,
+			code:        201,
+		},
+		{
+			name:        "plain text",
+			url:         "/",
+			contentType: "text/plain; charset=utf-8",
+			body:        "https://example.com/text",
+			code:        201,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, storageTest := newIdempotencyTestServer()
+
+			first := doIdempotent(s, tt.url, tt.contentType, "key-1", tt.body)
+			defer first.Body.Close()
+			firstBody, _ := io.ReadAll(first.Body)
+			if first.StatusCode != tt.code || first.Header.Get("Idempotent-Replayed") != "" {
+				t.Fatalf("Expected fresh status code %d, got %d", tt.code, first.StatusCode)
+			}
+
+			retry := doIdempotent(s, tt.url, tt.contentType, "key-1", tt.body)
+			defer retry.Body.Close()
+			retryBody, _ := io.ReadAll(retry.Body)
+			if retry.StatusCode != tt.code || retry.Header.Get("Idempotent-Replayed") != "true" {
+				t.Errorf("Expected replayed status code %d, got %d", tt.code, retry.StatusCode)
+			}
+			if !bytes.Equal(firstBody, retryBody) || retry.Header.Get("Content-Type") != first.Header.Get("Content-Type") {
+				t.Errorf("Expected replayed response %s, got %s", firstBody, retryBody)
+			}
+			if calls := storageTest.calls.Load(); calls != 1 {
+				t.Errorf("Expected 1 storage call, got %d", calls)
+			}
+
+			mismatch := doIdempotent(s, tt.url, tt.contentType, "key-1", strings.Replace(tt.body, "example.com", "example.org", 1))
+			defer mismatch.Body.Close()
+			if mismatch.StatusCode != http.StatusUnprocessableEntity {
+				t.Errorf("Expected status code 422, got %d", mismatch.StatusCode)
+			}
+
+			other := doIdempotent(s, tt.url, tt.contentType, "", tt.body)
+			defer other.Body.Close()
+			if other.Header.Get("Idempotent-Replayed") != "" || storageTest.calls.Load() != 2 {
+				t.Errorf("Expected request without key to reach storage")
+			}
+		})
+	}
+}
+
+func TestServer_idempotencyConcurrent(t *testing.T) {
+	s, storageTest := newIdempotencyTestServer()
+	body := `[{"correlation_id": "1", "original_url": "https://example.com/concurrent"}]`
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := doIdempotent(s, "/api/v1/shorten/batch", "application/json", "concurrent", body)
+			defer res.Body.Close()
+			codes[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("Expected status code 201, got %d", code)
+		}
+	}
+	if calls := storageTest.calls.Load(); calls != 1 {
+		t.Errorf("Expected 1 storage call, got %d", calls)
+	}
+}
+
+func TestServer_idempotencyKeyTooLong(t *testing.T) {
+	s, _ := newIdempotencyTestServer()
+	res := doIdempotent(s, "/api/v1/shorten", "application/json", strings.Repeat("k", maxIdempotencyKeyLength+1), `{"url": "https://example.com"}`)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code 400, got %d", res.StatusCode)
+	}
+}
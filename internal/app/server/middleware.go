@@ -2,12 +2,28 @@ package server
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/services"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var (
+	unversionedAPIDeprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	unversionedAPISunset      = time.Date(2027, time.April, 19, 0, 0, 0, 0, time.UTC)
 )
 
+type requestIDKey struct{}
+
 type (
 	responseData struct {
 		status int
@@ -54,6 +70,7 @@ func withLogging(h http.Handler) http.Handler {
 		duration := time.Since(start)
 
 		Sugar.Infoln(
+			"request_id", requestID(r),
 			"uri", r.RequestURI,
 			"method", r.Method,
 			"status", responseData.status,
@@ -95,10 +112,55 @@ func ungzipHandle(h http.Handler) http.Handler {
 		}
 		gz, err := gzip.NewReader(r.Body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, http.StatusBadRequest, err.Error())
 			return
 		}
 		r.Body = gz
 		h.ServeHTTP(w, r)
 	})
 }
+
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = services.WithRequestInfo(ctx, services.RequestInfo{IP: ip, RequestID: id})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// deprecated marks unversioned API aliases with Deprecation (RFC 9745), Sunset
+// (RFC 8594) and a link to the versioned successor route.
+func deprecated(deprecation, sunset time.Time, successor string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecation.Unix()))
+			w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+			w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successor, strings.TrimPrefix(r.URL.Path, "/api")))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
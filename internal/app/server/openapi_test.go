@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestServer() Server {
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	return NewServer(services.NewService(storage.NewInmemoryStorage(&configTest)), configTest)
+}
+
+func TestServer_openAPIRoutes(t *testing.T) {
+	s := newTestServer()
+	doc, err := loadOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := make([]string, 0)
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			spec = append(spec, method+" "+path)
+		}
+	}
+	routes := make([]string, 0)
+	err = chi.Walk(s.srv.Handler.(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routes = append(routes, method+" "+route)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(spec)
+	sort.Strings(routes)
+	if strings.Join(spec, "\n") != strings.Join(routes, "\n") {
+		t.Errorf("Router and OpenAPI document differ\nrouter:\n%s\nspec:\n%s", strings.Join(routes, "\n"), strings.Join(spec, "\n"))
+	}
+}
+
+func TestServer_openAPIDocument(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+	}{
+		{
+			name:        "document",
+			url:         "/api/openapi.json",
+			contentType: "application/json",
+		},
+		{
+			name:        "swagger ui",
+			url:         "/api/docs",
+			contentType: "text/html; charset=utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected status code 200, got %d", res.StatusCode)
+			}
+			if contentType := res.Header.Get("Content-Type"); contentType != tt.contentType {
+				t.Errorf("Expected content type %s, got %s", tt.contentType, contentType)
+			}
+		})
+	}
+}
+
+func TestServer_validation(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		code        int
+	}{
+		{
+			name:        "valid json",
+			url:         "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url": "https://example.com/json"}`,
+			code:        201,
+		},
+		{
+			name:        "url of wrong type",
+			url:         "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url": 1}`,
+			code:        400,
+		},
+		{
+			name:        "empty url",
+			url:         "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url": ""}`,
+			code:        400,
+		},
+		{
+			name:        "batch without original url",
+			url:         "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id": "1"}]`,
+			code:        400,
+		},
+		{
+			name:        "batch of wrong type",
+			url:         "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `{"original_url": "https://example.com"}`,
+			code:        400,
+		},
+		{
+			name:        "valid batch",
+			url:         "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id": "1", "original_url": "https://example.com/batch"}]`,
+			code:        201,
+		},
+		{
+			name:        "valid plain text",
+			url:         "/",
+			contentType: "text/plain; charset=utf-8",
+			body:        "https://example.com/text",
+			code:        201,
+		},
+		{
+			name:        "valid gzip",
+			url:         "/",
+			contentType: "application/x-gzip",
+			body:        "https://example.com/gzip",
+			code:        201,
+		},
+		{
+			name:        "unsupported content type",
+			url:         "/api/shorten",
+			contentType: "application/xml",
+			body:        "<url/>",
+			code:        415,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.url, bytes.NewBufferString(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if tt.code < 400 {
+				return
+			}
+			var problem models.Problem
+			if err := json.NewDecoder(res.Body).Decode(&problem); err != nil || problem.Status != tt.code {
+				t.Errorf("Expected problem with status %d, got %+v, %v", tt.code, problem, err)
+			}
+		})
+	}
+}
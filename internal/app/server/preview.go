@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const previewTemplate = "preview.html"
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// previewPage is the data of the preview template.
+type previewPage struct {
+	Key       string
+	ShortURL  string
+	URL       string
+	Title     string
+	Metadata  *models.LinkMetadata
+	CreatedAt time.Time
+	Clicks    int64
+}
+
+// loadTemplates parses the built-in templates, then the *.html files of dir.
+// A file of dir replaces the built-in template of the same name and may define
+// templates the others use.
+func loadTemplates(dir string) (*template.Template, error) {
+	templates, err := template.ParseFS(builtinTemplates, "templates/*.html")
+	if err != nil || dir == "" {
+		return templates, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil || len(files) == 0 {
+		return templates, err
+	}
+	return templates.ParseFiles(files...)
+}
+
+// preview renders the page of key instead of redirecting, it is not counted
+// as a click.
+func (s *Server) preview(w http.ResponseWriter, r *http.Request, key string) {
+	preview, err := s.service.LinkPreview(r.Context(), key)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	page := previewPage{
+		Key:       preview.Key,
+		ShortURL:  s.domains.ShortURL(preview.Key),
+		URL:       preview.OriginalURL,
+		Title:     preview.Title,
+		Metadata:  preview.Metadata,
+		CreatedAt: preview.CreatedAt,
+		Clicks:    preview.Clicks,
+	}
+	// Rendered to a buffer first, a failing template still gets an error
+	// response.
+	var body bytes.Buffer
+	if err := s.templates.ExecuteTemplate(&body, previewTemplate, page); err != nil {
+		Sugar.Errorln("render preview of", key, err)
+		s.error(w, r, http.StatusInternalServerError, "render preview")
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
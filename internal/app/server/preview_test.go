@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+func TestServer_preview(t *testing.T) {
+	s, storageTest, _ := newAuthTestServer(t)
+	ctx := context.Background()
+	key, _ := storageTest.Add(ctx, "https://example.com/article?a=1&b=2")
+	storageTest.SetMetadata(ctx, key, "https://example.com/article?a=1&b=2", models.LinkMetadata{
+		Title:       "Fish <script>alert(1)</script> & Chips",
+		Description: "Crispy food",
+		Image:       "https://example.com/cover.png",
+		FetchedAt:   time.Now().UTC(),
+	})
+	deleted, _ := storageTest.Add(ctx, "https://example.com/deleted")
+	link, _ := storageTest.GetLink(ctx, deleted)
+	link.Deleted = true
+	storageTest.UpdateLink(ctx, link)
+
+	for i := 0; i < 2; i++ {
+		res := doAuthorized(s, http.MethodGet, "/"+key, "", "")
+		res.Body.Close()
+		if res.StatusCode != http.StatusTemporaryRedirect {
+			t.Fatalf("Expected status code 307, got %d", res.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		code     int
+		contains []string
+	}{
+		{name: "plus suffix", url: "/" + key + "+", code: 200, contains: []string{
+			"https://example.com/article?a=1&amp;b=2",
+			"Fish &lt;script&gt;alert(1)&lt;/script&gt; &amp; Chips",
+			"Crispy food",
+			`src="https://example.com/cover.png"`,
+			"http://127.0.0.1:8080/" + key,
+			"2 clicks",
+		}},
+		{name: "query parameter", url: "/" + key + "?preview=1", code: 200, contains: []string{"2 clicks"}},
+		{name: "disabled query parameter", url: "/" + key + "?preview=false", code: 307},
+		{name: "invalid query parameter", url: "/" + key + "?preview=maybe", code: 400},
+		{name: "missing", url: "/missing+", code: 404},
+		{name: "deleted", url: "/" + deleted + "+", code: 410},
+		{name: "other domain", url: "/" + key + "@go.brand.example+", code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, http.MethodGet, tt.url, "", "")
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Fatalf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			body, _ := io.ReadAll(res.Body)
+			for _, text := range tt.contains {
+				if !strings.Contains(string(body), text) {
+					t.Errorf("Expected the page to contain %q, got %s", text, body)
+				}
+			}
+		})
+	}
+
+	// Previews are not clicks, the redirect with preview=false is.
+	if clicks, _ := storageTest.LinkClicks(ctx, key); clicks != 3 {
+		t.Errorf("Expected 3 clicks, got %d", clicks)
+	}
+}
+
+func TestServer_previewTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"preview.html": `{{template "header" .}}{{.URL}} was clicked {{.Clicks}} times`,
+		"header.html":  `{{define "header"}}<h1>{{.ShortURL}}</h1>{{end}}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configTest := config.Config{
+		RunAddr:      "127.0.0.1:8080",
+		ShortAddr:    "http://127.0.0.1:8080",
+		TemplatesDir: dir,
+	}
+	storageTest := storage.NewInmemoryStorage(&configTest)
+	s := NewServer(services.NewService(storageTest), configTest)
+	key, _ := storageTest.Add(context.Background(), "https://example.com/custom")
+
+	res := doAuthorized(s, http.MethodGet, "/"+key+"+", "", "")
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	want := "<h1>http://127.0.0.1:8080/" + key + "</h1>https://example.com/custom was clicked 0 times"
+	if res.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("Expected %d %s, got %d %s", http.StatusOK, want, res.StatusCode, body)
+	}
+
+	if _, err := loadTemplates(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected a missing templates directory to fail")
+	}
+	if _, err := loadTemplates(t.TempDir()); err != nil {
+		t.Errorf("Expected the built-in templates without overrides, got %v", err)
+	}
+}
@@ -3,13 +3,18 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"html/template"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/TPizik/url-shortener/internal/app/auth"
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
 	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 	"github.com/TPizik/url-shortener/internal/app/services"
@@ -18,10 +23,14 @@ import (
 )
 
 type Server struct {
-	service     services.Service
-	srv         *http.Server
-	config      config.Config
-	pingTimeout time.Duration
+	service          services.Service
+	srv              *http.Server
+	config           config.Config
+	pingTimeout      time.Duration
+	idempotencyLocks []sync.Mutex
+	jwt              *auth.JWTVerifier
+	domains          *domains.Registry
+	templates        *template.Template
 }
 
 var Sugar zap.SugaredLogger
@@ -34,17 +43,56 @@ func NewServer(service services.Service, config config.Config) Server {
 	defer logger.Sync()
 
 	Sugar = *logger.Sugar()
-	newServer := Server{service: service, srv: nil, config: config, pingTimeout: 1 * time.Second}
+	newServer := Server{
+		service:          service,
+		srv:              nil,
+		config:           config,
+		pingTimeout:      1 * time.Second,
+		idempotencyLocks: make([]sync.Mutex, idempotencyLockStripes),
+	}
+	if config.JWKS != "" {
+		newServer.jwt = auth.NewJWTVerifier(auth.NewJWKS(config.JWKS, config.JWKSRefresh), config.JWTIssuer, config.JWTAudience)
+	}
+	newServer.domains, err = domains.Load(config.ShortAddr, config.Domains)
+	if err != nil {
+		panic(err)
+	}
+	newServer.templates, err = loadTemplates(config.TemplatesDir)
+	if err != nil {
+		panic(err)
+	}
+	doc, err := loadOpenAPI()
+	if err != nil {
+		panic(err)
+	}
+	validate, err := withValidation(doc)
+	if err != nil {
+		panic(err)
+	}
 
 	r := chi.NewRouter()
+	r.Use(withRequestID)
 	r.Use(withLogging)
 	r.Use(ungzipHandle)
 	r.Use(gzipHandle)
-	r.Post("/", newServer.createRedirect)
-	r.Post("/api/shorten", newServer.createRedirectJSON)
-	r.Post("/api/shorten/batch", newServer.createRedirectByBatch)
-	r.Get("/{keyID}", newServer.redirect)
+	r.Use(newServer.authenticate)
+	r.Use(validate)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, "")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+	})
+	r.With(newServer.withScope(auth.ScopeShorten), newServer.idempotent).Post("/", newServer.createRedirect)
+	r.With(newServer.withScope(auth.ScopeRead)).Get("/{keyID}", newServer.redirect)
 	r.Get("/ping", newServer.pingStorage)
+	r.Get("/api/openapi.json", newServer.openAPI)
+	r.Get("/api/docs", newServer.swaggerUI)
+	r.Route("/api/v1", newServer.routesV1)
+	r.Route("/api/admin", newServer.routesAdmin)
+	r.Route("/api", func(r chi.Router) {
+		newServer.routesV1(r.With(deprecated(unversionedAPIDeprecation, unversionedAPISunset, "/api/v1")))
+	})
 
 	srv := http.Server{
 		Addr:    config.RunAddr,
@@ -55,6 +103,36 @@ func NewServer(service services.Service, config config.Config) Server {
 	return newServer
 }
 
+// routesV1 registers version 1 of the JSON API. Newer versions get their own
+// routes and handlers so the v1 response shapes never change.
+func (s *Server) routesV1(r chi.Router) {
+	shorten := r.With(s.withScope(auth.ScopeShorten), s.idempotent)
+	shorten.Post("/shorten", s.createRedirectJSON)
+	shorten.Post("/shorten/batch", s.createRedirectByBatch)
+	s.routesURLs(r)
+}
+
+// routesURLs lets owners list, organize and change the destination of their
+// links.
+func (s *Server) routesURLs(r chi.Router) {
+	r.With(s.requireScope(auth.ScopeRead)).Get("/user/urls", s.userLinks)
+	r.With(s.requireScope(auth.ScopeShorten)).Patch("/urls/{keyID}", s.editLink)
+	r.With(s.requireScope(auth.ScopeRead)).Get("/urls/{keyID}/history", s.linkHistory)
+	r.With(s.requireScope(auth.ScopeShorten)).Post("/urls/{keyID}/rollback", s.rollbackURL)
+}
+
+func (s *Server) routesAdmin(r chi.Router) {
+	r.Use(s.requireScope(auth.ScopeAdmin))
+	r.Post("/keys", s.createAPIKey)
+	r.Get("/keys", s.listAPIKeys)
+	r.Delete("/keys/{apiKeyID}", s.revokeAPIKey)
+	r.Get("/links", s.searchLinks)
+	r.Get("/links/{keyID}", s.getLink)
+	r.Patch("/links/{keyID}", s.updateLink)
+	r.Delete("/links/{keyID}", s.deleteLink)
+	r.Get("/audit", s.searchAudit)
+}
+
 func (s *Server) ListenAndServe() {
 	s.srv.ListenAndServe()
 }
@@ -66,61 +144,86 @@ func (s *Server) Shutdown(ctx context.Context) error {
 func (s *Server) createRedirect(w http.ResponseWriter, r *http.Request) {
 	headerContentType := r.Header.Get("Content-Type")
 	w.Header().Set("content-type", "text/plain")
-	var url string
+	var url, domain string
 	switch headerContentType {
 	case "application/x-www-form-urlencoded":
 		r.ParseForm()
 		url = r.FormValue("url")
+		domain = r.FormValue("domain")
 	case "text/plain; charset=utf-8":
 		urlBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			s.error(w, http.StatusInternalServerError, "invalid parse body")
+			s.error(w, r, http.StatusInternalServerError, "invalid parse body")
 			return
 		}
 		url = strings.TrimSuffix(string(urlBytes), "\n")
 	case "application/x-gzip":
 		urlBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			s.error(w, http.StatusInternalServerError, "invalid body")
+			s.error(w, r, http.StatusInternalServerError, "invalid body")
 			return
 		}
 		url = strings.TrimSuffix(string(urlBytes), "\n")
 	default:
-		s.error(w, http.StatusUnsupportedMediaType, "invalid ContentType")
+		s.error(w, r, http.StatusUnsupportedMediaType, "invalid ContentType")
 		return
 	}
 
 	if url == "" {
-		s.error(w, http.StatusBadRequest, "invalid url")
+		s.error(w, r, http.StatusBadRequest, "invalid url")
 		return
 	}
 
-	key, err := s.service.CreateRedirect(context.Background(), url)
-	if err == appErrors.ErrConflict {
+	ctx, err := s.withDomain(r.Context(), domain)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	key, err := s.service.CreateRedirect(ctx, url)
+	if errors.Is(err, appErrors.ErrConflict) {
 		Sugar.Infoln("Add url", url)
-		resultURL := fmt.Sprintf("%s/%s", s.config.ShortAddr, key)
+		resultURL := s.domains.ShortURL(key)
 		w.WriteHeader(http.StatusConflict)
 		w.Write([]byte(resultURL))
 		return
 	}
 	if err != nil {
-		s.error(w, http.StatusBadRequest, "invalid key")
+		s.problem(w, r, err)
 		return
 	}
 	Sugar.Infoln("Add url", url)
-	resultURL := fmt.Sprintf("%s/%s", s.config.ShortAddr, key)
+	resultURL := s.domains.ShortURL(key)
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(resultURL))
 }
 
+// redirect shows the preview page instead when the key ends with "+" or the
+// preview query parameter is set.
 func (s *Server) redirect(w http.ResponseWriter, r *http.Request) {
-	key := r.PathValue("keyID")
-	Sugar.Infoln("Call redirect for", key)
-	url, err := s.service.GetURLByKey(context.Background(), key)
+	key, preview := strings.CutSuffix(r.PathValue("keyID"), "+")
+	if value, err := strconv.ParseBool(r.URL.Query().Get("preview")); err == nil && value {
+		preview = true
+	}
+	Sugar.Infoln("Call redirect for", key, "on", r.Host, "preview", preview)
+	// Links of other domains are only reachable through their own host.
+	if strings.Contains(key, "@") {
+		s.problem(w, r, appErrors.ErrKey)
+		return
+	}
+	key = domains.Key(s.domains.Resolve(r.Host), key)
+	if preview {
+		s.preview(w, r, key)
+		return
+	}
+	url, err := s.service.GetURLByKey(r.Context(), key)
 	if err != nil {
-		s.error(w, http.StatusBadRequest, "invalid key")
+		s.problem(w, r, err)
 		return
 	}
+	// A click that fails to be counted still redirects.
+	if err := s.service.CountClick(r.Context(), key); err != nil {
+		Sugar.Warnln("count click of", key, err)
+	}
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
@@ -132,23 +235,28 @@ func (s *Server) createRedirectJSON(w http.ResponseWriter, r *http.Request) {
 	case "application/json":
 		dataBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			s.error(w, http.StatusInternalServerError, "invalid parse body")
+			s.error(w, r, http.StatusInternalServerError, "invalid parse body")
 			return
 		}
 		err = json.Unmarshal(dataBytes, &redirect)
 		if err != nil || redirect.URL == "" {
-			s.error(w, http.StatusBadRequest, "invalid parse body")
+			s.error(w, r, http.StatusBadRequest, "invalid parse body")
 			return
 		}
 	default:
-		s.error(w, http.StatusUnsupportedMediaType, "invalid ContentType")
+		s.error(w, r, http.StatusUnsupportedMediaType, "invalid ContentType")
 		return
 	}
 	Sugar.Infoln("Create redirect for", redirect.URL)
-	key, err := s.service.CreateRedirect(context.Background(), redirect.URL)
-	if err == appErrors.ErrConflict {
+	ctx, err := s.withDomain(r.Context(), redirect.Domain)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	key, err := s.service.CreateLink(ctx, redirect.URL, redirect.LinkDetails)
+	if errors.Is(err, appErrors.ErrConflict) {
 		result := models.ResultString{
-			Result: fmt.Sprintf("%s/%s", s.config.ShortAddr, key),
+			Result: s.domains.ShortURL(key),
 		}
 		response, _ := json.Marshal(result)
 		w.Header().Set("content-type", "application/json")
@@ -157,11 +265,11 @@ func (s *Server) createRedirectJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		s.error(w, http.StatusBadRequest, "invalid key")
+		s.problem(w, r, err)
 		return
 	}
 	result := models.ResultString{
-		Result: fmt.Sprintf("%s/%s", s.config.ShortAddr, key),
+		Result: s.domains.ShortURL(key),
 	}
 
 	response, _ := json.Marshal(result)
@@ -173,29 +281,38 @@ func (s *Server) createRedirectJSON(w http.ResponseWriter, r *http.Request) {
 func (s *Server) createRedirectByBatch(w http.ResponseWriter, r *http.Request) {
 	headerContentType := r.Header.Get("Content-Type")
 	if headerContentType != "application/json" {
-		s.error(w, http.StatusUnsupportedMediaType, "invalid ContentType")
+		s.error(w, r, http.StatusUnsupportedMediaType, "invalid ContentType")
 		return
 	}
 	dataBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.error(w, http.StatusInternalServerError, err.Error())
+		s.error(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	requestURLs := make([]models.URLRowOriginal, 0)
 	err = json.Unmarshal(dataBytes, &requestURLs)
 	if err != nil {
-		s.error(w, http.StatusBadRequest, "invalid parse body")
+		s.error(w, r, http.StatusBadRequest, "invalid parse body")
 		return
 	}
 
-	responseURLs, err := s.service.CreateRedirectByBatch(context.Background(), requestURLs)
+	for i := range requestURLs {
+		if requestURLs[i].Domain, err = s.domains.Use(r.Context(), requestURLs[i].Domain); err != nil {
+			s.problem(w, r, err)
+			return
+		}
+	}
+	responseURLs, err := s.service.CreateRedirectByBatch(r.Context(), requestURLs)
 	if err != nil {
-		s.error(w, http.StatusInternalServerError, err.Error())
+		s.problem(w, r, err)
 		return
 	}
+	for i, shortURL := range responseURLs {
+		responseURLs[i].ShortURL = s.domains.ShortURL(shortURL.ShortURL[strings.LastIndex(shortURL.ShortURL, "/")+1:])
+	}
 	response, err := json.Marshal(responseURLs)
 	if err != nil {
-		s.error(w, http.StatusInternalServerError, err.Error())
+		s.error(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	status := http.StatusCreated
@@ -207,12 +324,45 @@ func (s *Server) createRedirectByBatch(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(response))
 }
 
+// withDomain attaches the requested domain to ctx if the caller may create
+// links on it, an empty name is the default domain.
+func (s *Server) withDomain(ctx context.Context, name string) (context.Context, error) {
+	domain, err := s.domains.Use(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return domains.WithDomain(ctx, domain), nil
+}
+
+// linkKey is the stored key of the link named by the keyID path value on the
+// domain query parameter, the default domain when it is absent.
+func (s *Server) linkKey(r *http.Request) (string, error) {
+	key := r.PathValue("keyID")
+	if strings.Contains(key, "@") {
+		return "", appErrors.ErrKey
+	}
+	domain, err := s.domains.Lookup(r.URL.Query().Get("domain"))
+	if err != nil {
+		return "", err
+	}
+	return domains.Key(domain, key), nil
+}
+
 func (s *Server) pingStorage(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.pingTimeout))
 	defer cancel()
 	err := s.service.Ping(ctx)
+	health := s.service.Health()
+	if errors.Is(err, appErrors.ErrUnavailable) {
+		s.health(w, r, http.StatusServiceUnavailable, health)
+		return
+	}
 	if err != nil {
-		s.error(w, http.StatusInternalServerError, err.Error())
+		s.problem(w, r, err)
+		return
+	}
+	if health.Status != models.HealthOK {
+		s.health(w, r, http.StatusOK, health)
 		return
 	}
 	w.Header().Set("content-type", "text/plain")
@@ -220,9 +370,92 @@ func (s *Server) pingStorage(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func (s *Server) error(w http.ResponseWriter, code int, msg string) {
+func (s *Server) health(w http.ResponseWriter, r *http.Request, code int, health models.Health) {
+	response, err := json.Marshal(health)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/json")
 	w.WriteHeader(code)
-	w.Header().Set("content-type", "plain/text")
+	w.Write(response)
+}
+
+func errorStatus(err error) int {
+	switch appErrors.Kind(err) {
+	case appErrors.ErrNotFound:
+		return http.StatusNotFound
+	case appErrors.ErrGone:
+		return http.StatusGone
+	case appErrors.ErrConflict:
+		return http.StatusConflict
+	case appErrors.ErrValidation:
+		return http.StatusUnprocessableEntity
+	case appErrors.ErrUnavailable:
+		return http.StatusServiceUnavailable
+	case appErrors.ErrUnauthorized:
+		return http.StatusUnauthorized
+	case appErrors.ErrForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) problem(w http.ResponseWriter, r *http.Request, err error) {
+	code := errorStatus(err)
+	detail := err.Error()
+	if code == http.StatusInternalServerError {
+		Sugar.Errorln(err)
+		detail = ""
+	}
+	writeError(w, r, code, detail)
+}
+
+func (s *Server) error(w http.ResponseWriter, r *http.Request, code int, msg string) {
 	Sugar.Infoln(msg)
-	w.Write([]byte(msg))
+	writeError(w, r, code, msg)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	if !acceptsProblem(r) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.Header().Set("x-content-type-options", "nosniff")
+		w.WriteHeader(code)
+		if detail == "" {
+			detail = http.StatusText(code)
+		}
+		w.Write([]byte(detail))
+		return
+	}
+	response, _ := json.Marshal(models.Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(code),
+		Status:    code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r),
+	})
+	w.Header().Set("content-type", "application/problem+json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// acceptsProblem reports whether the client should get application/problem+json.
+// An explicit Accept header wins, otherwise the JSON API always gets problems and
+// clients that sent a plain text or form body to POST / keep getting plain text.
+func acceptsProblem(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/problem+json"), strings.Contains(accept, "application/json"):
+		return true
+	case strings.Contains(accept, "text/plain"):
+		return false
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		return true
+	}
+	switch strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]) {
+	case "text/plain", "application/x-www-form-urlencoded", "application/x-gzip":
+		return false
+	}
+	return true
 }
@@ -3,14 +3,18 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"testing"
 
 	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
 	"github.com/TPizik/url-shortener/internal/app/services"
 	"github.com/TPizik/url-shortener/internal/app/storage"
 	"github.com/go-chi/chi/v5"
@@ -22,7 +26,7 @@ func TestServer_createRedirect(t *testing.T) {
 	var configTest = config.Config{
 		RunAddr:         "127.0.0.1:8080",
 		ShortAddr:       "http://127.0.0.1:8080",
-		FileStoragePath: "storage.txt",
+		FileStoragePath: filepath.Join(t.TempDir(), "storage.txt"),
 	}
 	// db, _ := sqlx.Open("sqlite3", ":memory:")
 	// persistentStorage, _ := storage.NewFileStorage(configTest.FileStoragePath)
@@ -102,7 +106,7 @@ func TestServer_redirect(t *testing.T) {
 	var configTest = config.Config{
 		RunAddr:         "127.0.0.1:8080",
 		ShortAddr:       "http://127.0.0.1:8080",
-		FileStoragePath: "storage.txt",
+		FileStoragePath: filepath.Join(t.TempDir(), "storage.txt"),
 	}
 	// persistentStorage, _ := storage.NewFileStorage(configTest.FileStoragePath)
 	// db, _ := sqlx.Open("sqlite3", ":memory:")
@@ -131,7 +135,7 @@ func TestServer_redirect(t *testing.T) {
 		{
 			name:     "negative test2",
 			method:   http.MethodGet,
-			code:     400,
+			code:     404,
 			url:      "/invalid",
 			location: "",
 		},
@@ -169,7 +173,7 @@ func TestServer_createRedirectJSON(t *testing.T) {
 	var configTest = config.Config{
 		RunAddr:         "127.0.0.1:8080",
 		ShortAddr:       "http://127.0.0.1:8080",
-		FileStoragePath: "storage.txt",
+		FileStoragePath: filepath.Join(t.TempDir(), "storage.txt"),
 	}
 	storageTest, _ := storage.NewStorage(&configTest)
 	var serviceTest = services.NewService(storageTest)
@@ -265,3 +269,394 @@ func TestServer_pingStorage(t *testing.T) {
 		})
 	}
 }
+
+type unavailableStorage struct {
+	*storage.InmemoryStorage
+	health models.Health
+}
+
+func (c *unavailableStorage) Ping(ctx context.Context) error {
+	if c.health.Status == models.HealthUnavailable {
+		return appErrors.ErrUnavailable
+	}
+	return nil
+}
+
+func (c *unavailableStorage) Health() models.Health {
+	return c.health
+}
+
+func TestServer_pingStorageHealth(t *testing.T) {
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	tests := []struct {
+		name   string
+		health models.Health
+		code   int
+	}{
+		{
+			name:   "degraded",
+			health: models.Health{Status: models.HealthDegraded, Breaker: "half-open", LastError: "connection refused"},
+			code:   200,
+		},
+		{
+			name:   "unavailable",
+			health: models.Health{Status: models.HealthUnavailable, Breaker: "open", LastError: "connection refused"},
+			code:   503,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageTest := &unavailableStorage{InmemoryStorage: storage.NewInmemoryStorage(&configTest), health: tt.health}
+			s := NewServer(services.NewService(storageTest), configTest)
+			request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			w := httptest.NewRecorder()
+			http.HandlerFunc(s.pingStorage).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			var health models.Health
+			if err := json.NewDecoder(res.Body).Decode(&health); err != nil || health != tt.health {
+				t.Errorf("Expected health %+v, got %+v, %v", tt.health, health, err)
+			}
+		})
+	}
+}
+
+type failingStorage struct {
+	*storage.InmemoryStorage
+	err error
+}
+
+func (c *failingStorage) Get(ctx context.Context, key string) (string, error) {
+	return "", c.err
+}
+
+func TestServer_redirectErrors(t *testing.T) {
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{
+			name: "not found",
+			err:  appErrors.ErrKey,
+			code: 404,
+		},
+		{
+			name: "deleted",
+			err:  appErrors.ErrDeleted,
+			code: 410,
+		},
+		{
+			name: "validation",
+			err:  appErrors.ErrURLTooLong,
+			code: 422,
+		},
+		{
+			name: "unavailable",
+			err:  appErrors.Wrap(appErrors.ErrUnavailable, "database", io.ErrUnexpectedEOF),
+			code: 503,
+		},
+		{
+			name: "unknown",
+			err:  io.ErrUnexpectedEOF,
+			code: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageTest := &failingStorage{InmemoryStorage: storage.NewInmemoryStorage(&configTest), err: tt.err}
+			s := NewServer(services.NewService(storageTest), configTest)
+			request := httptest.NewRequest(http.MethodGet, "/abc", nil)
+			w := httptest.NewRecorder()
+			http.HandlerFunc(s.redirect).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if contentType := res.Header.Get("content-type"); contentType != "application/problem+json" {
+				t.Errorf("Expected content type application/problem+json, got %s", contentType)
+			}
+			var problem models.Problem
+			if err := json.NewDecoder(res.Body).Decode(&problem); err != nil || problem.Status != tt.code {
+				t.Errorf("Expected problem with status %d, got %+v, %v", tt.code, problem, err)
+			}
+		})
+	}
+}
+
+func TestServer_errorHeaders(t *testing.T) {
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	storageTest := &failingStorage{InmemoryStorage: storage.NewInmemoryStorage(&configTest), err: appErrors.ErrKey}
+	s := NewServer(services.NewService(storageTest), configTest)
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		accept      string
+		body        string
+		code        int
+		problem     bool
+	}{
+		{
+			name:        "plain text empty url",
+			method:      http.MethodPost,
+			url:         "/",
+			contentType: "text/plain; charset=utf-8",
+			code:        400,
+		},
+		{
+			name:        "form empty url",
+			method:      http.MethodPost,
+			url:         "/",
+			contentType: "application/x-www-form-urlencoded",
+			code:        400,
+		},
+		{
+			name:        "form empty url with problem accept",
+			method:      http.MethodPost,
+			url:         "/",
+			contentType: "application/x-www-form-urlencoded",
+			accept:      "application/problem+json",
+			code:        400,
+			problem:     true,
+		},
+		{
+			name:        "plain text unsupported content type",
+			method:      http.MethodPost,
+			url:         "/",
+			contentType: "application/xml",
+			accept:      "text/plain",
+			code:        415,
+		},
+		{
+			name:        "json unsupported content type",
+			method:      http.MethodPost,
+			url:         "/",
+			contentType: "application/json",
+			code:        415,
+			problem:     true,
+		},
+		{
+			name:        "shorten invalid body",
+			method:      http.MethodPost,
+			url:         "/api/shorten",
+			contentType: "application/json",
+			body:        "{",
+			code:        400,
+			problem:     true,
+		},
+		{
+			name:        "shorten unsupported content type",
+			method:      http.MethodPost,
+			url:         "/api/shorten",
+			contentType: "text/plain",
+			code:        415,
+			problem:     true,
+		},
+		{
+			name:        "batch invalid body",
+			method:      http.MethodPost,
+			url:         "/api/shorten/batch",
+			contentType: "application/json",
+			body:        "{",
+			code:        400,
+			problem:     true,
+		},
+		{
+			name:        "batch unsupported content type",
+			method:      http.MethodPost,
+			url:         "/api/shorten/batch",
+			contentType: "text/plain",
+			code:        415,
+			problem:     true,
+		},
+		{
+			name:    "redirect not found",
+			method:  http.MethodGet,
+			url:     "/missing",
+			code:    404,
+			problem: true,
+		},
+		{
+			name:    "unknown route",
+			method:  http.MethodGet,
+			url:     "/api/unknown",
+			code:    404,
+			problem: true,
+		},
+		{
+			name:    "method not allowed",
+			method:  http.MethodDelete,
+			url:     "/ping",
+			code:    405,
+			problem: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+			request.Header.Set("X-Request-ID", "test-request")
+			w := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if id := res.Header.Get("X-Request-ID"); id != "test-request" {
+				t.Errorf("Expected request id test-request, got %s", id)
+			}
+			contentType := res.Header.Get("Content-Type")
+			if !tt.problem {
+				if contentType != "text/plain; charset=utf-8" {
+					t.Errorf("Expected content type text/plain; charset=utf-8, got %s", contentType)
+				}
+				return
+			}
+			if contentType != "application/problem+json" {
+				t.Errorf("Expected content type application/problem+json, got %s", contentType)
+			}
+			var problem models.Problem
+			if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tt.code || problem.Title != http.StatusText(tt.code) ||
+				problem.RequestID != "test-request" || problem.Instance != tt.url {
+				t.Errorf("Unexpected problem %+v", problem)
+			}
+		})
+	}
+}
+
+func TestServer_apiVersions(t *testing.T) {
+	var configTest = config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	s := NewServer(services.NewService(storage.NewInmemoryStorage(&configTest)), configTest)
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		code       int
+		deprecated bool
+		successor  string
+	}{
+		{
+			name:   "v1 shorten",
+			method: http.MethodPost,
+			url:    "/api/v1/shorten",
+			body:   `{"url": "https://example.com/v1"}`,
+			code:   201,
+		},
+		{
+			name:   "v1 batch",
+			method: http.MethodPost,
+			url:    "/api/v1/shorten/batch",
+			body:   `[{"correlation_id": "1", "original_url": "https://example.com/v1/batch"}]`,
+			code:   201,
+		},
+		{
+			name:       "deprecated shorten",
+			method:     http.MethodPost,
+			url:        "/api/shorten",
+			body:       `{"url": "https://example.com/v0"}`,
+			code:       201,
+			deprecated: true,
+			successor:  `</api/v1/shorten>; rel="successor-version"`,
+		},
+		{
+			name:       "deprecated batch",
+			method:     http.MethodPost,
+			url:        "/api/shorten/batch",
+			body:       `[{"correlation_id": "1", "original_url": "https://example.com/v0/batch"}]`,
+			code:       201,
+			deprecated: true,
+			successor:  `</api/v1/shorten/batch>; rel="successor-version"`,
+		},
+		{
+			name:   "v1 link edit",
+			method: http.MethodPatch,
+			url:    "/api/v1/urls/missing",
+			body:   `{"url": "https://example.com/v1"}`,
+			code:   401,
+		},
+		{
+			name:       "deprecated link edit",
+			method:     http.MethodPatch,
+			url:        "/api/urls/missing",
+			body:       `{"url": "https://example.com/v0"}`,
+			code:       401,
+			deprecated: true,
+			successor:  `</api/v1/urls/missing>; rel="successor-version"`,
+		},
+		{
+			name:       "deprecated user links",
+			method:     http.MethodGet,
+			url:        "/api/user/urls",
+			code:       401,
+			deprecated: true,
+			successor:  `</api/v1/user/urls>; rel="successor-version"`,
+		},
+		{
+			name:   "unknown version",
+			method: http.MethodPost,
+			url:    "/api/v9/shorten",
+			body:   `{"url": "https://example.com/v9"}`,
+			code:   404,
+		},
+		{
+			name:   "v1 method not allowed",
+			method: http.MethodGet,
+			url:    "/api/v1/shorten",
+			code:   405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if deprecation := res.Header.Get("Deprecation"); (deprecation != "") != tt.deprecated {
+				t.Errorf("Expected deprecated %t, got Deprecation %q", tt.deprecated, deprecation)
+			}
+			if !tt.deprecated {
+				return
+			}
+			if sunset, err := http.ParseTime(res.Header.Get("Sunset")); err != nil || !sunset.Equal(unversionedAPISunset) {
+				t.Errorf("Expected Sunset %s, got %s, %v", unversionedAPISunset, sunset, err)
+			}
+			if link := res.Header.Get("Link"); link != tt.successor {
+				t.Errorf("Expected Link %s, got %s", tt.successor, link)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func (s *Server) userLinks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.UserLinkFilter{
+		Tag:    query.Get("tag"),
+		Query:  query.Get("q"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			s.error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	page, err := s.service.UserLinks(r.Context(), filter)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, page)
+}
+
+func (s *Server) editLink(w http.ResponseWriter, r *http.Request) {
+	dataBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, "invalid parse body")
+		return
+	}
+	var edit models.LinkEdit
+	err = json.Unmarshal(dataBytes, &edit)
+	if err != nil || (edit.URL != nil && *edit.URL == "") || edit == (models.LinkEdit{}) {
+		s.error(w, r, http.StatusBadRequest, "invalid parse body")
+		return
+	}
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	link, err := s.service.EditLink(r.Context(), key, edit)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Edit link", key, "by", auth.UserID(r.Context()))
+	s.json(w, r, http.StatusOK, link)
+}
+
+func (s *Server) linkHistory(w http.ResponseWriter, r *http.Request) {
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	versions, err := s.service.LinkHistory(r.Context(), key)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	s.json(w, r, http.StatusOK, versions)
+}
+
+func (s *Server) rollbackURL(w http.ResponseWriter, r *http.Request) {
+	dataBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.error(w, r, http.StatusInternalServerError, "invalid parse body")
+		return
+	}
+	var rollback models.Rollback
+	if err := json.Unmarshal(dataBytes, &rollback); err != nil {
+		s.error(w, r, http.StatusBadRequest, "invalid parse body")
+		return
+	}
+	key, err := s.linkKey(r)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	link, err := s.service.RollbackURL(r.Context(), key, rollback.Version)
+	if err != nil {
+		s.problem(w, r, err)
+		return
+	}
+	Sugar.Infoln("Rollback url", key, "to version", rollback.Version, "by", auth.UserID(r.Context()))
+	s.json(w, r, http.StatusOK, link)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/services"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+)
+
+func TestServer_editURL(t *testing.T) {
+	s, storageTest, service := newAuthTestServer(t)
+	owner := createTestAPIKey(t, service, "marketing", auth.ScopeShorten, auth.ScopeRead)
+	other := createTestAPIKey(t, service, "sales", auth.ScopeShorten, auth.ScopeRead)
+	admin := createTestAPIKey(t, service, "ops", auth.ScopeAdmin)
+	reader := createTestAPIKey(t, service, "marketing", auth.ScopeRead)
+	shorten := func(token string, url string) string {
+		t.Helper()
+		res := doAuthorized(s, http.MethodPost, "/api/v1/shorten", token, fmt.Sprintf(`{"url": %q}`, url))
+		defer res.Body.Close()
+		var result models.ResultString
+		json.NewDecoder(res.Body).Decode(&result)
+		return result.Result[len("http://127.0.0.1:8080/"):]
+	}
+	key := shorten(owner.Token, "https://example.com/flyer")
+	anonymous := shorten("", "https://example.com/anonymous")
+	shorten(other.Token, "https://example.com/taken")
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		token    string
+		body     string
+		code     int
+		location string
+	}{
+		{name: "anonymous", method: http.MethodPatch, url: "/api/v1/urls/" + key, body: `{"url": "https://example.com/v2"}`, code: 401},
+		{name: "not owner", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: other.Token, body: `{"url": "https://example.com/v2"}`, code: 403},
+		{name: "missing scope", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: reader.Token, body: `{"url": "https://example.com/v2"}`, code: 403},
+		{name: "empty url", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: owner.Token, body: `{"url": ""}`, code: 400},
+		{name: "missing", method: http.MethodPatch, url: "/api/v1/urls/missing", token: owner.Token, body: `{"url": "https://example.com/v2"}`, code: 404},
+		{name: "anonymous link", method: http.MethodPatch, url: "/api/v1/urls/" + anonymous, token: owner.Token, body: `{"url": "https://example.com/v2"}`, code: 403},
+		{name: "url of another link", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: owner.Token, body: `{"url": "https://example.com/taken"}`, code: 409},
+		{name: "edit", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: owner.Token, body: `{"url": "https://example.com/v2"}`, code: 200},
+		{name: "edited redirect", method: http.MethodGet, url: "/" + key, code: 307, location: "https://example.com/v2"},
+		{name: "admin edit", method: http.MethodPatch, url: "/api/v1/urls/" + key, token: admin.Token, body: `{"url": "https://example.com/v3"}`, code: 200},
+		{name: "history of another user", method: http.MethodGet, url: "/api/v1/urls/" + key + "/history", token: other.Token, code: 403},
+		{name: "unknown version", method: http.MethodPost, url: "/api/v1/urls/" + key + "/rollback", token: owner.Token, body: `{"version": 9}`, code: 422},
+		{name: "rollback", method: http.MethodPost, url: "/api/v1/urls/" + key + "/rollback", token: owner.Token, body: `{"version": 1}`, code: 200},
+		{name: "rolled back redirect", method: http.MethodGet, url: "/" + key, code: 307, location: "https://example.com/flyer"},
+		{name: "previous url gets a new key", method: http.MethodPost, url: "/api/v1/shorten", token: owner.Token, body: `{"url": "https://example.com/v2"}`, code: 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, tt.method, tt.url, tt.token, tt.body)
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if tt.location != "" && res.Header.Get("Location") != tt.location {
+				t.Errorf("Expected location %s, got %s", tt.location, res.Header.Get("Location"))
+			}
+		})
+	}
+
+	res := doAuthorized(s, http.MethodGet, "/api/v1/urls/"+key+"/history", owner.Token, "")
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", res.StatusCode)
+	}
+	var versions []models.LinkVersion
+	if err := json.NewDecoder(res.Body).Decode(&versions); err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]string, 0, len(versions))
+	for i, version := range versions {
+		urls = append(urls, version.URL)
+		if version.Version != i+1 || (version.ReplacedAt == nil) != (i == len(versions)-1) {
+			t.Errorf("Unexpected version %d %+v", i, version)
+		}
+	}
+	if fmt.Sprint(urls) != "[https://example.com/flyer https://example.com/v2 https://example.com/v3 https://example.com/flyer]" {
+		t.Errorf("Unexpected history %v", urls)
+	}
+
+	actions := make([]string, 0)
+	storageTest.IterateAudit(context.Background(), func(event models.AuditEvent) error {
+		if event.Key == key && event.Action != "create" {
+			actions = append(actions, event.Actor+":"+event.Action)
+		}
+		return nil
+	})
+	if fmt.Sprint(actions) != "[marketing:update ops:update marketing:rollback]" {
+		t.Errorf("Unexpected audit actions %v", actions)
+	}
+}
+
+func TestServer_userLinks(t *testing.T) {
+	s, storageTest, service := newAuthTestServer(t)
+	owner := createTestAPIKey(t, service, "marketing", auth.ScopeShorten, auth.ScopeRead)
+	other := createTestAPIKey(t, service, "sales", auth.ScopeShorten, auth.ScopeRead)
+	shorten := func(token string, body string) string {
+		t.Helper()
+		res := doAuthorized(s, http.MethodPost, "/api/v1/shorten", token, body)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status code 201, got %d", res.StatusCode)
+		}
+		var result models.ResultString
+		json.NewDecoder(res.Body).Decode(&result)
+		return result.Result[len("http://127.0.0.1:8080/"):]
+	}
+	launch := shorten(owner.Token, `{"url": "https://example.com/launch", "title": "Spring launch", "tags": ["Campaign", "campaign", "Q2"]}`)
+	flyer := shorten(owner.Token, `{"url": "https://example.com/flyer", "notes": "Handed out at the launch event"}`)
+	plain := shorten(owner.Token, `{"url": "https://example.com/plain"}`)
+	shorten(other.Token, `{"url": "https://example.com/other", "tags": ["campaign"]}`)
+
+	edits := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "tag with space", body: `{"tags": ["two words"]}`, code: 422},
+		{name: "too long title", body: fmt.Sprintf(`{"title": %q}`, strings.Repeat("a", 201)), code: 400},
+		{name: "nothing to change", body: `{}`, code: 400},
+		{name: "details", body: `{"tags": ["print", "campaign"], "title": "Flyer"}`, code: 200},
+	}
+	for _, tt := range edits {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doAuthorized(s, http.MethodPatch, "/api/urls/"+flyer, owner.Token, tt.body)
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+
+	list := func(token string, query string) (int, models.LinkPage) {
+		t.Helper()
+		res := doAuthorized(s, http.MethodGet, "/api/v1/user/urls"+query, token, "")
+		defer res.Body.Close()
+		var page models.LinkPage
+		json.NewDecoder(res.Body).Decode(&page)
+		return res.StatusCode, page
+	}
+	keys := func(page models.LinkPage) string {
+		keys := make([]string, 0, len(page.Links))
+		for _, link := range page.Links {
+			keys = append(keys, link.Key)
+		}
+		return fmt.Sprint(keys)
+	}
+	tests := []struct {
+		name  string
+		token string
+		query string
+		code  int
+		keys  string
+	}{
+		{name: "anonymous", query: "", code: 401},
+		{name: "newest first", token: owner.Token, code: 200, keys: fmt.Sprint([]string{plain, flyer, launch})},
+		{name: "oldest first", token: owner.Token, query: "?sort=created_at", code: 200, keys: fmt.Sprint([]string{launch, flyer, plain})},
+		{name: "unknown sort", token: owner.Token, query: "?sort=title", code: 400},
+		{name: "tag", token: owner.Token, query: "?tag=campaign", code: 200, keys: fmt.Sprint([]string{flyer, launch})},
+		{name: "search", token: owner.Token, query: "?q=launch", code: 200, keys: fmt.Sprint([]string{flyer, launch})},
+		{name: "search and tag", token: owner.Token, query: "?q=launch&tag=q2", code: 200, keys: fmt.Sprint([]string{launch})},
+		{name: "invalid cursor", token: owner.Token, query: "?cursor=!", code: 422},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, page := list(tt.token, tt.query)
+			if code != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, code)
+			}
+			if tt.keys != "" && keys(page) != tt.keys {
+				t.Errorf("Expected links %s, got %s", tt.keys, keys(page))
+			}
+		})
+	}
+
+	_, first := list(owner.Token, "?limit=2")
+	if len(first.Links) != 2 || first.NextCursor == "" {
+		t.Fatalf("Expected a full first page with a cursor, got %+v", first)
+	}
+	_, second := list(owner.Token, "?limit=2&cursor="+first.NextCursor)
+	if keys(second) != fmt.Sprint([]string{launch}) || second.NextCursor != "" {
+		t.Errorf("Expected the last link on the second page, got %+v", second)
+	}
+	if link := second.Links[0]; link.Title != "Spring launch" || fmt.Sprint(link.Tags) != "[campaign q2]" {
+		t.Errorf("Expected normalized details, got %+v", link)
+	}
+
+	actions := make([]string, 0)
+	storageTest.IterateAudit(context.Background(), func(event models.AuditEvent) error {
+		if event.Key == flyer && event.Action == "details" {
+			actions = append(actions, event.New)
+		}
+		return nil
+	})
+	if fmt.Sprint(actions) != `[{"notes":"Handed out at the launch event"} {"title":"Flyer","tags":["print","campaign"],"notes":"Handed out at the launch event"}]` {
+		t.Errorf("Unexpected audit events %v", actions)
+	}
+}
+
+type recordingEnricher struct {
+	sync.Mutex
+	keys []string
+}
+
+func (e *recordingEnricher) Enqueue(key string) bool {
+	e.Lock()
+	defer e.Unlock()
+	e.keys = append(e.keys, key)
+	return true
+}
+
+func TestServer_enrichment(t *testing.T) {
+	configTest := config.Config{
+		RunAddr:   "127.0.0.1:8080",
+		ShortAddr: "http://127.0.0.1:8080",
+	}
+	storageTest := storage.NewInmemoryStorage(&configTest)
+	service := services.NewService(storageTest)
+	enricher := &recordingEnricher{}
+	service.SetEnricher(enricher)
+	s := NewServer(service, configTest)
+	owner := createTestAPIKey(t, service, "marketing", auth.ScopeShorten, auth.ScopeRead)
+
+	res := doAuthorized(s, http.MethodPost, "/api/v1/shorten", owner.Token, `{"url": "https://example.com/article"}`)
+	var result models.ResultString
+	json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	key := result.Result[len("http://127.0.0.1:8080/"):]
+	res = doAuthorized(s, http.MethodPost, "/api/v1/shorten/batch", owner.Token, `[{"correlation_id": "1", "original_url": "https://example.com/batch"}]`)
+	var rows []models.URLRowShort
+	json.NewDecoder(res.Body).Decode(&rows)
+	res.Body.Close()
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 batch row, got %+v", rows)
+	}
+	batchKey := rows[0].ShortURL[len("http://127.0.0.1:8080/"):]
+
+	link, _ := storageTest.GetLink(context.Background(), key)
+	metadata := models.LinkMetadata{Title: "Article", FetchedAt: time.Now().UTC()}
+	if err := storageTest.SetMetadata(context.Background(), key, link.OriginalURL, metadata); err != nil {
+		t.Fatal(err)
+	}
+	edit := func(body string) models.Link {
+		t.Helper()
+		res := doAuthorized(s, http.MethodPatch, "/api/urls/"+key, owner.Token, body)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status code 200, got %d", res.StatusCode)
+		}
+		var edited models.Link
+		json.NewDecoder(res.Body).Decode(&edited)
+		return edited
+	}
+	if edited := edit(`{"title": "Mine"}`); edited.Metadata == nil || edited.Metadata.Title != "Article" {
+		t.Errorf("Expected metadata to be kept by a details edit, got %+v", edited.Metadata)
+	}
+	if edited := edit(`{"url": "https://example.com/article/v2"}`); edited.Metadata != nil {
+		t.Errorf("Expected metadata of the previous destination to be dropped, got %+v", edited.Metadata)
+	}
+	if fmt.Sprint(enricher.keys) != fmt.Sprint([]string{key, batchKey, key}) {
+		t.Errorf("Unexpected enriched keys %v", enricher.keys)
+	}
+}
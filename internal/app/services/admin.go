@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+// SearchLinks pages through all links including deleted ones, ordered by
+// creation time and key.
+func (s *Service) SearchLinks(ctx context.Context, filter models.LinkFilter) (models.LinkPage, error) {
+	query := models.LinkQuery{
+		KeyPrefix:      filter.Key,
+		URL:            filter.URL,
+		Owner:          filter.Owner,
+		CreatedAfter:   filter.CreatedAfter,
+		CreatedBefore:  filter.CreatedBefore,
+		IncludeDeleted: true,
+	}
+	return s.storage.ListLinks(ctx, query, models.PageRequest{Limit: filter.Limit, Cursor: filter.Cursor})
+}
+
+func (s *Service) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return s.storage.GetLink(ctx, key)
+}
+
+// UpdateLink applies an admin change and records an audit event for every
+// field that actually changed. The change only applies to the version read
+// here, or to the version in update when it has one.
+func (s *Service) UpdateLink(ctx context.Context, key string, update models.LinkUpdate) (models.Link, error) {
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return models.Link{}, err
+	}
+	if update.Version != nil && *update.Version != link.Version {
+		return models.Link{}, appErrors.ErrStaleVersion
+	}
+	changes := make([]models.AuditEvent, 0, 2)
+	if update.Owner != nil && *update.Owner != link.UserID {
+		changes = append(changes, s.event(ctx, AuditOwner, key, link.UserID, *update.Owner))
+		link.UserID = *update.Owner
+	}
+	if update.Disabled != nil && *update.Disabled != link.Disabled {
+		action := AuditEnable
+		if *update.Disabled {
+			action = AuditDisable
+		}
+		changes = append(changes, s.event(ctx, action, key, "", ""))
+		link.Disabled = *update.Disabled
+	}
+	if len(changes) == 0 {
+		return link, nil
+	}
+	if err := s.storage.UpdateLink(audit.WithEvents(ctx, changes...), link); err != nil {
+		return models.Link{}, err
+	}
+	link.Version++
+	return link, nil
+}
+
+// DeleteLink removes the link for good, unlike the soft deletion users do.
+func (s *Service) DeleteLink(ctx context.Context, key string) error {
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return err
+	}
+	return s.storage.DeleteLink(audit.WithEvents(ctx, s.event(ctx, AuditDelete, key, link.OriginalURL, "")), key)
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	AuditCreate       = "create"
+	AuditDisable      = "disable"
+	AuditEnable       = "enable"
+	AuditOwner        = "reassign"
+	AuditDelete       = "delete"
+	AuditUpdate       = "update"
+	AuditRollback     = "rollback"
+	AuditDetails      = "details"
+	AuditCreateAPIKey = "create_api_key"
+	AuditRevokeAPIKey = "revoke_api_key"
+)
+
+type RequestInfo struct {
+	IP        string
+	RequestID string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo attaches the client of the request to ctx, it ends up in the
+// audit events of the mutations made within ctx.
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfo(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info
+}
+
+// SearchAudit returns events in the order they were recorded, the cursor is the
+// position of the last returned event in the log.
+func (s *Service) SearchAudit(ctx context.Context, filter models.AuditFilter) (models.AuditPage, error) {
+	query := models.AuditQuery{
+		Actor:  filter.Actor,
+		Action: filter.Action,
+		Key:    filter.Key,
+		Since:  filter.Since,
+		Until:  filter.Until,
+	}
+	return s.storage.ListAudit(ctx, query, models.PageRequest{Limit: filter.Limit, Cursor: filter.Cursor})
+}
+
+// event describes a change made within ctx. The storage records the events
+// of a link change in the same transaction as the change, an event without a
+// key is recorded for every link the change creates.
+func (s *Service) event(ctx context.Context, action string, key string, oldValue string, newValue string) models.AuditEvent {
+	info := requestInfo(ctx)
+	return models.AuditEvent{
+		ID:        audit.NewID(),
+		Time:      time.Now().UTC(),
+		Actor:     auth.UserID(ctx),
+		Action:    action,
+		Key:       key,
+		Old:       oldValue,
+		New:       newValue,
+		IP:        info.IP,
+		RequestID: info.RequestID,
+	}
+}
+
+// audit records an event apart from any link change, API keys are not links.
+func (s *Service) audit(ctx context.Context, action string, key string, oldValue string, newValue string) error {
+	return s.storage.AppendAudit(ctx, s.event(ctx, action, key, oldValue, newValue))
+}
@@ -2,7 +2,14 @@ package services
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/domains"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 )
 
@@ -10,11 +17,38 @@ type IStorage interface {
 	Get(ctx context.Context, key string) (string, error)
 	Add(ctx context.Context, url string) (string, error)
 	AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error)
+	Iterate(ctx context.Context, fn func(models.Link) error) error
+	GetLink(ctx context.Context, key string) (models.Link, error)
+	UpdateLink(ctx context.Context, link models.Link) error
+	DeleteLink(ctx context.Context, key string) error
+	LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error)
+	ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error)
+	CountClick(ctx context.Context, key string) error
+	LinkClicks(ctx context.Context, key string) (int64, error)
+	AppendAudit(ctx context.Context, event models.AuditEvent) error
+	ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error)
+	GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error)
+	SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error
+	CreateAPIKey(ctx context.Context, key models.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
 	Ping(ctx context.Context) error
 }
 
+type HealthReporter interface {
+	Health() models.Health
+}
+
+// Enricher fetches the metadata of the destination of a link in the
+// background.
+type Enricher interface {
+	Enqueue(key string) bool
+}
+
 type Service struct {
-	storage IStorage
+	storage  IStorage
+	enricher Enricher
 }
 
 func NewService(storage IStorage) Service {
@@ -23,18 +57,142 @@ func NewService(storage IStorage) Service {
 	}
 }
 
+// SetEnricher makes new links and changed destinations queue a metadata fetch.
+func (s *Service) SetEnricher(enricher Enricher) {
+	s.enricher = enricher
+}
+
+func (s *Service) enrich(key string) {
+	if s.enricher != nil {
+		s.enricher.Enqueue(key)
+	}
+}
+
 func (s *Service) Ping(ctx context.Context) error {
 	return s.storage.Ping(ctx)
 }
 
-func (s *Service) CreateRedirect(ctx context.Context, key string) (string, error) {
-	return s.storage.Add(ctx, key)
+func (s *Service) Health() models.Health {
+	if reporter, ok := s.storage.(HealthReporter); ok {
+		return reporter.Health()
+	}
+	return models.Health{Status: models.HealthOK}
+}
+
+func (s *Service) CreateRedirect(ctx context.Context, url string) (string, error) {
+	key, err := s.storage.Add(audit.WithEvents(ctx, s.event(ctx, AuditCreate, "", "", "")), url)
+	if err != nil {
+		return key, err
+	}
+	s.enrich(key)
+	return key, nil
 }
 
 func (s *Service) GetURLByKey(ctx context.Context, key string) (string, error) {
 	return s.storage.Get(ctx, key)
 }
 
+func (s *Service) CountClick(ctx context.Context, key string) error {
+	return s.storage.CountClick(ctx, key)
+}
+
+// LinkPreview fails for the links whose redirect fails, so a preview never
+// shows the destination of a deleted or disabled link.
+func (s *Service) LinkPreview(ctx context.Context, key string) (models.LinkPreview, error) {
+	if _, err := s.storage.Get(ctx, key); err != nil {
+		return models.LinkPreview{}, err
+	}
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return models.LinkPreview{}, err
+	}
+	clicks, err := s.storage.LinkClicks(ctx, key)
+	if err != nil {
+		return models.LinkPreview{}, err
+	}
+	return models.LinkPreview{Link: link, Clicks: clicks}, nil
+}
+
+// CreateRedirectByBatch records a create event for every link the batch
+// creates, URLs already shortened get their existing key. URLs are stored in
+// one batch per domain and returned in the order they were requested.
 func (s *Service) CreateRedirectByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
-	return s.storage.AddByBatch(ctx, requestURLs)
+	groups := make(map[string][]int)
+	order := make([]string, 0, 1)
+	for i, url := range requestURLs {
+		if _, ok := groups[url.Domain]; !ok {
+			order = append(order, url.Domain)
+		}
+		groups[url.Domain] = append(groups[url.Domain], i)
+	}
+	shortURLs := make([]models.URLRowShort, len(requestURLs))
+	for _, domain := range order {
+		batch := make([]models.URLRowOriginal, 0, len(groups[domain]))
+		for _, i := range groups[domain] {
+			batch = append(batch, requestURLs[i])
+		}
+		domainCtx := audit.WithEvents(domains.WithDomain(ctx, domain), s.event(ctx, AuditCreate, "", "", ""))
+		added, err := s.storage.AddByBatch(domainCtx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, shortURL := range added {
+			shortURLs[groups[domain][j]] = shortURL
+			if shortURL.Created {
+				s.enrich(shortURL.ShortURL[strings.LastIndex(shortURL.ShortURL, "/")+1:])
+			}
+		}
+	}
+	return shortURLs, nil
+}
+
+func (s *Service) Idempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	return s.storage.GetIdempotency(ctx, key)
+}
+
+func (s *Service) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	return s.storage.SaveIdempotency(ctx, record)
+}
+
+func (s *Service) CreateAPIKey(ctx context.Context, request models.APIKeyRequest) (models.APIKeyCreated, error) {
+	key, token, err := auth.NewAPIKey(request.Name, request.Owner, request.Scopes)
+	if err != nil {
+		return models.APIKeyCreated{}, err
+	}
+	if err := s.storage.CreateAPIKey(ctx, key); err != nil {
+		return models.APIKeyCreated{}, err
+	}
+	if err := s.audit(ctx, AuditCreateAPIKey, key.ID, "", strings.Join(key.Scopes, ",")); err != nil {
+		return models.APIKeyCreated{}, err
+	}
+	return models.APIKeyCreated{APIKey: key, Token: token}, nil
+}
+
+func (s *Service) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	return s.storage.ListAPIKeys(ctx)
+}
+
+func (s *Service) RevokeAPIKey(ctx context.Context, id string) error {
+	if err := s.storage.RevokeAPIKey(ctx, id, time.Now().UTC()); err != nil {
+		return err
+	}
+	return s.audit(ctx, AuditRevokeAPIKey, id, "", "")
+}
+
+func (s *Service) Authenticate(ctx context.Context, token string) (auth.Principal, error) {
+	id, secret, err := auth.ParseToken(token)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	key, err := s.storage.GetAPIKey(ctx, id)
+	if errors.Is(err, appErrors.ErrNotFound) {
+		return auth.Principal{}, appErrors.ErrInvalidToken
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	if !auth.Verify(key, secret) {
+		return auth.Principal{}, appErrors.ErrInvalidToken
+	}
+	return auth.Principal{KeyID: key.ID, Owner: key.Owner, Scopes: key.Scopes}, nil
 }
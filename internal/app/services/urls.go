@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	SortCreated     = "created_at"
+	SortCreatedDesc = "-created_at"
+
+	maxTitleLength = 200
+	maxNotesLength = 2000
+	maxTags        = 20
+	maxTagLength   = 50
+)
+
+// CreateLink shortens url like CreateRedirect and stores details on the new
+// link, an already shortened url keeps its details. The details are recorded
+// in the audit log like an edit of them.
+func (s *Service) CreateLink(ctx context.Context, url string, details models.LinkDetails) (string, error) {
+	details, err := normalizeDetails(details)
+	if err != nil {
+		return "", err
+	}
+	key, err := s.CreateRedirect(ctx, url)
+	if err != nil || sameDetails(details, models.LinkDetails{}) {
+		return key, err
+	}
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	old, _ := json.Marshal(link.LinkDetails)
+	link.LinkDetails = details
+	updated, _ := json.Marshal(link.LinkDetails)
+	event := s.event(ctx, AuditDetails, key, string(old), string(updated))
+	return key, s.storage.UpdateLink(audit.WithEvents(ctx, event), link)
+}
+
+// EditLink applies the fields set in edit. A new destination keeps the key and
+// the previous one goes to the link history.
+func (s *Service) EditLink(ctx context.Context, key string, edit models.LinkEdit) (models.Link, error) {
+	link, err := s.ownedLink(ctx, key)
+	if err != nil {
+		return models.Link{}, err
+	}
+	details := link.LinkDetails
+	if edit.Title != nil {
+		details.Title = *edit.Title
+	}
+	if edit.Tags != nil {
+		details.Tags = *edit.Tags
+	}
+	if edit.Notes != nil {
+		details.Notes = *edit.Notes
+	}
+	if details, err = normalizeDetails(details); err != nil {
+		return models.Link{}, err
+	}
+	stored := link
+	if edit.URL != nil {
+		link.OriginalURL = *edit.URL
+	}
+	link.LinkDetails = details
+	urlChanged := link.OriginalURL != stored.OriginalURL
+	detailsChanged := !sameDetails(link.LinkDetails, stored.LinkDetails)
+	if !urlChanged && !detailsChanged {
+		return link, nil
+	}
+	events := make([]models.AuditEvent, 0, 2)
+	if urlChanged {
+		link.Metadata = nil
+		events = append(events, s.event(ctx, AuditUpdate, key, stored.OriginalURL, link.OriginalURL))
+	}
+	if detailsChanged {
+		old, _ := json.Marshal(stored.LinkDetails)
+		updated, _ := json.Marshal(link.LinkDetails)
+		events = append(events, s.event(ctx, AuditDetails, key, string(old), string(updated)))
+	}
+	if err := s.storage.UpdateLink(audit.WithEvents(ctx, events...), link); err != nil {
+		return models.Link{}, err
+	}
+	link.Version++
+	if urlChanged {
+		s.enrich(key)
+	}
+	return link, nil
+}
+
+// UserLinks lists the links of the caller, newest first unless sorted by
+// created_at.
+func (s *Service) UserLinks(ctx context.Context, filter models.UserLinkFilter) (models.LinkPage, error) {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return models.LinkPage{}, appErrors.New(appErrors.ErrUnauthorized, "authentication is required")
+	}
+	if principal.Owner == "" {
+		return models.LinkPage{}, appErrors.New(appErrors.ErrForbidden, "credentials have no owner")
+	}
+	page := models.PageRequest{Limit: filter.Limit, Cursor: filter.Cursor}
+	switch filter.Sort {
+	case "", SortCreatedDesc:
+		page.Descending = true
+	case SortCreated:
+	default:
+		return models.LinkPage{}, appErrors.New(appErrors.ErrValidation, "unknown sort")
+	}
+	query := models.LinkQuery{
+		Owner:  principal.Owner,
+		Tag:    strings.ToLower(strings.TrimSpace(filter.Tag)),
+		Search: filter.Query,
+	}
+	return s.storage.ListLinks(ctx, query, page)
+}
+
+// LinkHistory returns every destination of the link oldest first, the last
+// version is the current one.
+func (s *Service) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	link, err := s.ownedLink(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.storage.LinkHistory(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	versions = append(versions, models.LinkVersion{URL: link.OriginalURL})
+	for i := range versions {
+		versions[i].Version = i + 1
+	}
+	return versions, nil
+}
+
+// RollbackURL points the link back to the destination of an earlier version,
+// the rollback itself becomes a new version.
+func (s *Service) RollbackURL(ctx context.Context, key string, version int) (models.Link, error) {
+	versions, err := s.LinkHistory(ctx, key)
+	if err != nil {
+		return models.Link{}, err
+	}
+	if version < 1 || version > len(versions) {
+		return models.Link{}, appErrors.New(appErrors.ErrValidation, "unknown version")
+	}
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return models.Link{}, err
+	}
+	return s.changeURL(ctx, link, versions[version-1].URL, AuditRollback)
+}
+
+func (s *Service) changeURL(ctx context.Context, link models.Link, url string, action string) (models.Link, error) {
+	if link.OriginalURL == url {
+		return link, nil
+	}
+	event := s.event(ctx, action, link.Key, link.OriginalURL, url)
+	link.OriginalURL = url
+	link.Metadata = nil
+	if err := s.storage.UpdateLink(audit.WithEvents(ctx, event), link); err != nil {
+		return models.Link{}, err
+	}
+	link.Version++
+	s.enrich(link.Key)
+	return link, nil
+}
+
+// normalizeDetails trims the details and lower cases tags, tags are single
+// words so they can be stored and matched as such.
+func normalizeDetails(details models.LinkDetails) (models.LinkDetails, error) {
+	details.Title = strings.TrimSpace(details.Title)
+	details.Notes = strings.TrimSpace(details.Notes)
+	if utf8.RuneCountInString(details.Title) > maxTitleLength {
+		return models.LinkDetails{}, appErrors.New(appErrors.ErrValidation, fmt.Sprintf("title is longer than %d characters", maxTitleLength))
+	}
+	if utf8.RuneCountInString(details.Notes) > maxNotesLength {
+		return models.LinkDetails{}, appErrors.New(appErrors.ErrValidation, fmt.Sprintf("notes are longer than %d characters", maxNotesLength))
+	}
+	tags := make([]string, 0, len(details.Tags))
+	for _, tag := range details.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "", utf8.RuneCountInString(tag) > maxTagLength, strings.ContainsFunc(tag, invalidTagRune):
+			return models.LinkDetails{}, appErrors.New(appErrors.ErrValidation, fmt.Sprintf("invalid tag %q", tag))
+		case !slices.Contains(tags, tag):
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return models.LinkDetails{}, appErrors.New(appErrors.ErrValidation, fmt.Sprintf("more than %d tags", maxTags))
+	}
+	details.Tags = nil
+	if len(tags) > 0 {
+		details.Tags = tags
+	}
+	return details, nil
+}
+
+func invalidTagRune(r rune) bool {
+	return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func sameDetails(a models.LinkDetails, b models.LinkDetails) bool {
+	return a.Title == b.Title && a.Notes == b.Notes && slices.Equal(a.Tags, b.Tags)
+}
+
+// ownedLink returns the link if the caller may change it, that is its owner
+// or an admin. Anonymous links can only be changed by admins.
+func (s *Service) ownedLink(ctx context.Context, key string) (models.Link, error) {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return models.Link{}, appErrors.New(appErrors.ErrUnauthorized, "authentication is required")
+	}
+	link, err := s.storage.GetLink(ctx, key)
+	if err != nil {
+		return models.Link{}, err
+	}
+	if !principal.HasScope(auth.ScopeAdmin) && (link.UserID == "" || link.UserID != principal.Owner) {
+		return models.Link{}, appErrors.New(appErrors.ErrForbidden, "link belongs to another user")
+	}
+	if link.Deleted {
+		return models.Link{}, appErrors.ErrDeleted
+	}
+	return link, nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+type RowAPIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func NewRowAPIKey(key models.APIKey) RowAPIKey {
+	return RowAPIKey(key)
+}
+
+func (r RowAPIKey) APIKey() models.APIKey {
+	return models.APIKey(r)
+}
+
+func sortAPIKeys(keys []models.APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+type cacheEntry struct {
+	key     string
+	url     string
+	missing bool
+	expires time.Time
+}
+
+// CacheStorage counts invalidations in generation. Entries read from the
+// backend are only stored when no invalidation happened since the read began,
+// so a read racing a change never caches the url the change replaced.
+type CacheStorage struct {
+	sync.Mutex
+	storage    StorageExpected
+	capacity   int
+	ttl        time.Duration
+	negative   bool
+	items      map[string]*list.Element
+	order      *list.List
+	generation uint64
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func NewCacheStorage(storage StorageExpected, config *config.Config) *CacheStorage {
+	return &CacheStorage{
+		storage:  storage,
+		capacity: config.CacheSize,
+		ttl:      config.CacheTTL,
+		negative: config.CacheNegative,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *CacheStorage) Ping(ctx context.Context) error {
+	return c.storage.Ping(ctx)
+}
+
+func (c *CacheStorage) Close() error {
+	return c.storage.Close()
+}
+
+func (c *CacheStorage) Get(ctx context.Context, key string) (string, error) {
+	if entry, ok := c.lookup(key); ok {
+		c.hits.Add(1)
+		if entry.missing {
+			return "", appErrors.ErrKey
+		}
+		return entry.url, nil
+	}
+	c.misses.Add(1)
+
+	generation := c.currentGeneration()
+	url, err := c.storage.Get(ctx, key)
+	switch {
+	case err == nil:
+		c.put(key, url, false, generation)
+	case c.negative && errors.Is(err, appErrors.ErrNotFound):
+		c.put(key, "", true, generation)
+	}
+	return url, err
+}
+
+func (c *CacheStorage) Add(ctx context.Context, url string) (string, error) {
+	generation := c.currentGeneration()
+	key, err := c.storage.Add(ctx, url)
+	if err == nil || errors.Is(err, appErrors.ErrConflict) {
+		c.put(key, url, false, generation)
+	}
+	return key, err
+}
+
+func (c *CacheStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	generation := c.currentGeneration()
+	shortURLs, err := c.storage.AddByBatch(ctx, requestURLs)
+	if err != nil {
+		return nil, err
+	}
+	// Keys of edited links are not the hash of their url, so the key is taken
+	// from the short url the backend returned.
+	for i, shortURL := range shortURLs {
+		key := shortURL.ShortURL[strings.LastIndex(shortURL.ShortURL, "/")+1:]
+		c.put(key, requestURLs[i].OriginalURL, false, generation)
+	}
+	return shortURLs, nil
+}
+
+func (c *CacheStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return c.storage.Iterate(ctx, fn)
+}
+
+func (c *CacheStorage) Import(ctx context.Context, links []models.Link) error {
+	err := c.storage.Import(ctx, links)
+	for _, link := range links {
+		c.Invalidate(link.Key)
+	}
+	return err
+}
+
+func (c *CacheStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return c.storage.GetLink(ctx, key)
+}
+
+func (c *CacheStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	err := c.storage.UpdateLink(ctx, link)
+	c.Invalidate(link.Key)
+	return err
+}
+
+func (c *CacheStorage) PutLink(ctx context.Context, link models.Link) error {
+	err := c.storage.PutLink(ctx, link)
+	c.Invalidate(link.Key)
+	return err
+}
+
+// SetMetadata leaves the cached destination as it is.
+func (c *CacheStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	return c.storage.SetMetadata(ctx, key, url, metadata)
+}
+
+func (c *CacheStorage) DeleteLink(ctx context.Context, key string) error {
+	err := c.storage.DeleteLink(ctx, key)
+	c.Invalidate(key)
+	return err
+}
+
+func (c *CacheStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	return c.storage.LinkHistory(ctx, key)
+}
+
+func (c *CacheStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	return c.storage.ListLinks(ctx, query, page)
+}
+
+func (c *CacheStorage) CountClick(ctx context.Context, key string) error {
+	return c.storage.CountClick(ctx, key)
+}
+
+func (c *CacheStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	return c.storage.LinkClicks(ctx, key)
+}
+
+func (c *CacheStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	return c.storage.AppendAudit(ctx, event)
+}
+
+func (c *CacheStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	return c.storage.ListAudit(ctx, query, page)
+}
+
+func (c *CacheStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.storage.IterateAudit(ctx, fn)
+}
+
+func (c *CacheStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	return c.storage.GetIdempotency(ctx, key)
+}
+
+func (c *CacheStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	return c.storage.SaveIdempotency(ctx, record)
+}
+
+func (c *CacheStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	return c.storage.CreateAPIKey(ctx, key)
+}
+
+func (c *CacheStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	return c.storage.GetAPIKey(ctx, id)
+}
+
+func (c *CacheStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	return c.storage.ListAPIKeys(ctx)
+}
+
+func (c *CacheStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return c.storage.RevokeAPIKey(ctx, id, at)
+}
+
+func (c *CacheStorage) Invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *CacheStorage) Stats() CacheStats {
+	c.Lock()
+	size := c.order.Len()
+	c.Unlock()
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+func (c *CacheStorage) lookup(key string) (cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(el)
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return *entry, true
+}
+
+func (c *CacheStorage) currentGeneration() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// put stores the entry read at generation unless it was invalidated since.
+func (c *CacheStorage) put(key string, url string, missing bool, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.url = url
+		entry.missing = missing
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+	entry := &cacheEntry{key: key, url: url, missing: missing, expires: expires}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *CacheStorage) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
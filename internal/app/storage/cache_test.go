@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+)
+
+type countingStorage struct {
+	*InmemoryStorage
+	gets int
+}
+
+func (c *countingStorage) Get(ctx context.Context, key string) (string, error) {
+	c.gets++
+	return c.InmemoryStorage.Get(ctx, key)
+}
+
+func newCountingStorage(configTest *config.Config) *countingStorage {
+	return &countingStorage{InmemoryStorage: NewInmemoryStorage(configTest)}
+}
+
+func TestCacheStorage_Get(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 2}
+	backend := newCountingStorage(&configTest)
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	key, _ := backend.Add(ctx, "https://example.com")
+	for i := 0; i < 3; i++ {
+		url, err := cache.Get(ctx, key)
+		if err != nil || url != "https://example.com" {
+			t.Fatalf("Expected https://example.com, got %q, %v", url, err)
+		}
+	}
+	if backend.gets != 1 {
+		t.Errorf("Expected 1 backend call, got %d", backend.gets)
+	}
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheStorage_Evict(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 2}
+	backend := newCountingStorage(&configTest)
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	first, _ := cache.Add(ctx, "https://example.com/1")
+	second, _ := cache.Add(ctx, "https://example.com/2")
+	cache.Get(ctx, first)
+	cache.Add(ctx, "https://example.com/3")
+
+	cache.Get(ctx, first)
+	if backend.gets != 0 {
+		t.Errorf("Expected recently used key to stay cached, got %d backend calls", backend.gets)
+	}
+	cache.Get(ctx, second)
+	if backend.gets != 1 {
+		t.Errorf("Expected least recently used key to be evicted, got %d backend calls", backend.gets)
+	}
+}
+
+func TestCacheStorage_Negative(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 10, CacheNegative: true}
+	backend := newCountingStorage(&configTest)
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	key, _ := GetURLHash("https://example.com")
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Get(ctx, key); !errors.Is(err, appErrors.ErrKey) {
+			t.Fatalf("Expected ErrKey, got %v", err)
+		}
+	}
+	if backend.gets != 1 {
+		t.Errorf("Expected missing key to be cached, got %d backend calls", backend.gets)
+	}
+	cache.Add(ctx, "https://example.com")
+	if url, err := cache.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected added key to replace negative entry, got %q, %v", url, err)
+	}
+}
+
+func TestCacheStorage_TTL(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 10, CacheTTL: 10 * time.Millisecond}
+	backend := newCountingStorage(&configTest)
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	key, _ := backend.Add(ctx, "https://example.com")
+	cache.Get(ctx, key)
+	time.Sleep(20 * time.Millisecond)
+	cache.Get(ctx, key)
+	if backend.gets != 2 {
+		t.Errorf("Expected expired entry to be reloaded, got %d backend calls", backend.gets)
+	}
+}
+
+// stallingStorage reads the url and then holds Get until release is closed.
+type stallingStorage struct {
+	*InmemoryStorage
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (c *stallingStorage) Get(ctx context.Context, key string) (string, error) {
+	url, err := c.InmemoryStorage.Get(ctx, key)
+	close(c.read)
+	<-c.release
+	return url, err
+}
+
+func TestCacheStorage_MissRacingInvalidate(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 2}
+	backend := &stallingStorage{InmemoryStorage: NewInmemoryStorage(&configTest), read: make(chan struct{}), release: make(chan struct{})}
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	key, _ := backend.Add(ctx, "https://example.com")
+	done := make(chan string)
+	go func() {
+		url, _ := cache.Get(ctx, key)
+		done <- url
+	}()
+	<-backend.read
+	cache.Invalidate(key)
+	close(backend.release)
+	if url := <-done; url != "https://example.com" {
+		t.Fatalf("Expected the miss to return the url it read, got %q", url)
+	}
+	if _, ok := cache.lookup(key); ok {
+		t.Errorf("Expected the url read before the change not to be cached")
+	}
+}
+
+func TestCacheStorage_InvalidateOnChange(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", CacheSize: 2}
+	backend := newCountingStorage(&configTest)
+	cache := NewCacheStorage(backend, &configTest)
+	ctx := context.Background()
+
+	key, _ := cache.Add(ctx, "https://example.com")
+	link, _ := cache.GetLink(ctx, key)
+	link.Disabled = true
+	if err := cache.UpdateLink(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, key); !errors.Is(err, appErrors.ErrDisabled) {
+		t.Errorf("Expected disabled link, got %v", err)
+	}
+
+	link.Disabled = false
+	cache.UpdateLink(ctx, link)
+	cache.Get(ctx, key)
+	if err := cache.DeleteLink(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, key); !errors.Is(err, appErrors.ErrNotFound) {
+		t.Errorf("Expected deleted link to be not found, got %v", err)
+	}
+}
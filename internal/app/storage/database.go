@@ -2,11 +2,17 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
 	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 	"github.com/jackc/pgconn"
@@ -18,7 +24,21 @@ const schemaSqlite3 = `
 CREATE TABLE IF NOT EXISTS link (
     id INTEGER PRIMARY KEY,
     key text NOT NULL,
-    value text NOT NULL
+    value text NOT NULL,
+    user_id text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    is_deleted boolean NOT NULL DEFAULT false,
+    is_disabled boolean NOT NULL DEFAULT false,
+    version bigint NOT NULL DEFAULT 1,
+    domain text NOT NULL DEFAULT '',
+    title text NOT NULL DEFAULT '',
+    tags text NOT NULL DEFAULT '',
+    notes text NOT NULL DEFAULT '',
+    search text NOT NULL DEFAULT '',
+    meta_title text NOT NULL DEFAULT '',
+    meta_description text NOT NULL DEFAULT '',
+    meta_image text NOT NULL DEFAULT '',
+    meta_fetched_at timestamp
 )`
 const schemaPostgres = `
 CREATE TABLE IF NOT EXISTS link (
@@ -28,38 +48,383 @@ CREATE TABLE IF NOT EXISTS link (
 		constraint cnst_link_value unique (value)
 )`
 
+const indexLinkKey = `CREATE UNIQUE INDEX IF NOT EXISTS link_key_idx ON link (key)`
+
+const indexLinkUserID = `CREATE INDEX IF NOT EXISTS link_user_id_idx ON link (user_id, created_at)`
+
+// Listings page by creation time and key.
+const indexLinkCreated = `CREATE INDEX IF NOT EXISTS link_created_idx ON link (created_at, key)`
+
+// search holds the words of searchTokens, Postgres matches them through a
+// tsvector so the same words match as in the other backends.
+const indexLinkSearchPostgres = `CREATE INDEX IF NOT EXISTS link_search_idx ON link USING gin (to_tsvector('simple', search))`
+
+// A url is shortened once per domain.
+const indexLinkDomainValue = `CREATE UNIQUE INDEX IF NOT EXISTS link_domain_value_idx ON link (domain, value)`
+
+const schemaIdempotencySqlite3 = `
+CREATE TABLE IF NOT EXISTS idempotency (
+    key text PRIMARY KEY,
+    fingerprint text NOT NULL,
+    status integer NOT NULL,
+    content_type text NOT NULL DEFAULT '',
+    body blob,
+    expires_at timestamp NOT NULL
+)`
+const schemaAPIKey = `
+CREATE TABLE IF NOT EXISTS api_key (
+    id text PRIMARY KEY,
+    name text NOT NULL DEFAULT '',
+    owner text NOT NULL,
+    scopes text NOT NULL,
+    hash text NOT NULL,
+    created_at timestamp NOT NULL,
+    revoked_at timestamp
+)`
+const schemaIdempotencyPostgres = `
+CREATE TABLE IF NOT EXISTS idempotency (
+    key text PRIMARY KEY,
+    fingerprint text NOT NULL,
+    status integer NOT NULL,
+    content_type text NOT NULL DEFAULT '',
+    body bytea,
+    expires_at timestamptz NOT NULL
+)`
+
+const schemaAuditSqlite3 = `
+CREATE TABLE IF NOT EXISTS audit (
+    seq INTEGER PRIMARY KEY,
+    id text NOT NULL,
+    at timestamp NOT NULL,
+    actor text NOT NULL,
+    action text NOT NULL,
+    key text NOT NULL DEFAULT '',
+    old_value text NOT NULL DEFAULT '',
+    new_value text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT '',
+    request_id text NOT NULL DEFAULT ''
+)`
+const schemaAuditPostgres = `
+CREATE TABLE IF NOT EXISTS audit (
+    seq BIGSERIAL PRIMARY KEY,
+    id text NOT NULL,
+    at timestamptz NOT NULL,
+    actor text NOT NULL,
+    action text NOT NULL,
+    key text NOT NULL DEFAULT '',
+    old_value text NOT NULL DEFAULT '',
+    new_value text NOT NULL DEFAULT ''
+)`
+
+// The audit log is filtered by key and actor, pages follow seq.
+const (
+	indexAuditKey   = `CREATE INDEX IF NOT EXISTS audit_key_idx ON audit (key, seq)`
+	indexAuditActor = `CREATE INDEX IF NOT EXISTS audit_actor_idx ON audit (actor, seq)`
+)
+
+const schemaHistorySqlite3 = `
+CREATE TABLE IF NOT EXISTS link_history (
+    id INTEGER PRIMARY KEY,
+    key text NOT NULL,
+    url text NOT NULL,
+    replaced_at timestamp NOT NULL
+)`
+const schemaHistoryPostgres = `
+CREATE TABLE IF NOT EXISTS link_history (
+    id BIGSERIAL PRIMARY KEY,
+    key text NOT NULL,
+    url text NOT NULL,
+    replaced_at timestamptz NOT NULL
+)`
+
+const indexHistoryKey = `CREATE INDEX IF NOT EXISTS link_history_key_idx ON link_history (key)`
+
+// Clicks are counted apart from the link row, so counting never conflicts
+// with changes to the link.
+const schemaClicks = `
+CREATE TABLE IF NOT EXISTS link_click (
+    key text PRIMARY KEY,
+    clicks bigint NOT NULL DEFAULT 0
+)`
+
+var migrationsPostgres = []string{
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS user_id text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now()`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS is_deleted boolean NOT NULL DEFAULT false`,
+	indexLinkKey,
+	schemaIdempotencyPostgres,
+	schemaAPIKey,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS is_disabled boolean NOT NULL DEFAULT false`,
+	schemaAuditPostgres,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1`,
+	`ALTER TABLE audit ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT ''`,
+	`ALTER TABLE audit ADD COLUMN IF NOT EXISTS request_id text NOT NULL DEFAULT ''`,
+	indexAuditKey,
+	indexAuditActor,
+	schemaHistoryPostgres,
+	indexHistoryKey,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS domain text NOT NULL DEFAULT ''`,
+	indexLinkDomainValue,
+	`ALTER TABLE link DROP CONSTRAINT IF EXISTS cnst_link_value`,
+	`ALTER TABLE link DROP CONSTRAINT IF EXISTS link_value_key`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS title text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS tags text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS notes text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS search text NOT NULL DEFAULT ''`,
+	indexLinkUserID,
+	indexLinkSearchPostgres,
+	indexLinkCreated,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS meta_title text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS meta_description text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS meta_image text NOT NULL DEFAULT ''`,
+	`ALTER TABLE link ADD COLUMN IF NOT EXISTS meta_fetched_at timestamp`,
+	schemaClicks,
+}
+
+const schemaVersionPostgres = `CREATE TABLE IF NOT EXISTS schema_version (version integer PRIMARY KEY)`
+
+// dataMigrationsPostgres rewrite existing rows, unlike the statements above
+// they run once. The version of a data migration is its position in the list
+// and schema_version records the versions applied.
+var dataMigrationsPostgres = []string{
+	`UPDATE link SET search = trim(regexp_replace(lower(value), '[^[:alnum:]]+', ' ', 'g')) WHERE search = ''`,
+}
+
+func isPostgresSpec(spec string) bool {
+	return strings.HasPrefix(spec, "postgres://") || strings.HasPrefix(spec, "postgresql://")
+}
+
 type RowDatabase struct {
-	ID    string `db:"id"`
-	Key   string `db:"key"`
-	Value string `db:"value"`
+	ID              string       `db:"id"`
+	Key             string       `db:"key"`
+	Value           string       `db:"value"`
+	UserID          string       `db:"user_id"`
+	CreatedAt       time.Time    `db:"created_at"`
+	Deleted         bool         `db:"is_deleted"`
+	Disabled        bool         `db:"is_disabled"`
+	Domain          string       `db:"domain"`
+	Title           string       `db:"title"`
+	Tags            string       `db:"tags"`
+	Notes           string       `db:"notes"`
+	Search          string       `db:"search"`
+	MetaTitle       string       `db:"meta_title"`
+	MetaDescription string       `db:"meta_description"`
+	MetaImage       string       `db:"meta_image"`
+	MetaFetchedAt   sql.NullTime `db:"meta_fetched_at"`
+	Version         int64        `db:"version"`
+}
+
+func (r RowDatabase) Link() models.Link {
+	return models.Link{
+		Key:         r.Key,
+		OriginalURL: r.Value,
+		UserID:      r.UserID,
+		CreatedAt:   r.CreatedAt,
+		Deleted:     r.Deleted,
+		Disabled:    r.Disabled,
+		Version:     r.Version,
+		LinkDetails: models.LinkDetails{Title: r.Title, Tags: splitTags(r.Tags), Notes: r.Notes},
+		Metadata:    r.metadata(),
+	}
+}
+
+// Links without metadata have no fetch time.
+func (r RowDatabase) metadata() *models.LinkMetadata {
+	if !r.MetaFetchedAt.Valid {
+		return nil
+	}
+	return &models.LinkMetadata{
+		Title:       r.MetaTitle,
+		Description: r.MetaDescription,
+		Image:       r.MetaImage,
+		FetchedAt:   r.MetaFetchedAt.Time.UTC(),
+	}
+}
+
+func metadataColumns(metadata *models.LinkMetadata) (string, string, string, sql.NullTime) {
+	if metadata == nil {
+		return "", "", "", sql.NullTime{}
+	}
+	return metadata.Title, metadata.Description, metadata.Image, sql.NullTime{Time: metadata.FetchedAt.UTC(), Valid: true}
+}
+
+// Tags are stored comma separated, tags never contain commas.
+func joinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+func searchText(link models.Link) string {
+	return strings.Join(linkTokens(link), " ")
+}
+
+type RowAudit struct {
+	Seq       int64     `db:"seq"`
+	ID        string    `db:"id"`
+	Time      time.Time `db:"at"`
+	Actor     string    `db:"actor"`
+	Action    string    `db:"action"`
+	Key       string    `db:"key"`
+	Old       string    `db:"old_value"`
+	New       string    `db:"new_value"`
+	IP        string    `db:"ip"`
+	RequestID string    `db:"request_id"`
+}
+
+type RowDatabaseHistory struct {
+	URL        string    `db:"url"`
+	ReplacedAt time.Time `db:"replaced_at"`
+}
+
+type RowIdempotency struct {
+	Key         string    `db:"key"`
+	Fingerprint string    `db:"fingerprint"`
+	Status      int       `db:"status"`
+	ContentType string    `db:"content_type"`
+	Body        []byte    `db:"body"`
+	ExpiresAt   time.Time `db:"expires_at"`
+}
+
+type RowDatabaseAPIKey struct {
+	ID        string     `db:"id"`
+	Name      string     `db:"name"`
+	Owner     string     `db:"owner"`
+	Scopes    string     `db:"scopes"`
+	Hash      string     `db:"hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+func (r RowDatabaseAPIKey) APIKey() models.APIKey {
+	return models.APIKey{
+		ID:        r.ID,
+		Name:      r.Name,
+		Owner:     r.Owner,
+		Scopes:    strings.Split(r.Scopes, ","),
+		Hash:      r.Hash,
+		CreatedAt: r.CreatedAt,
+		RevokedAt: r.RevokedAt,
+	}
 }
 
 type DatabaseStorage struct {
 	sync.RWMutex
-	db     *sqlx.DB
-	config *config.Config
+	db       *sqlx.DB
+	replicas *replicaSet
+	config   *config.Config
+	done     chan struct{}
+	once     sync.Once
 }
 
 func NewDatabaseStorage(db *sqlx.DB, config *config.Config) (*DatabaseStorage, error) {
-	return &DatabaseStorage{db: db, config: config}, nil
+	return &DatabaseStorage{db: db, config: config, done: make(chan struct{})}, nil
+}
+
+func (c *DatabaseStorage) SetReplicas(replicas []*sqlx.DB, window time.Duration) {
+	c.replicas = newReplicaSet(replicas, window)
+}
+
+func (c *DatabaseStorage) RunReplicaChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.replicas.check(context.Background())
+		}
+	}
+}
+
+// read runs fn on a replica unless the user of ctx wrote recently. A row
+// missing on the replica may not have reached it yet, so misses are read
+// again from the primary.
+func (c *DatabaseStorage) read(ctx context.Context, fn func(db *sqlx.DB) error) error {
+	if c.replicas != nil {
+		if r := c.replicas.pick(auth.UserID(ctx)); r != nil {
+			err := fn(r.db)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				c.replicas.failed(r, err)
+			}
+		}
+	}
+	return fn(c.db)
+}
+
+func (c *DatabaseStorage) written(ctx context.Context) {
+	if c.replicas != nil {
+		c.replicas.markWritten(auth.UserID(ctx))
+	}
 }
 
 func (c *DatabaseStorage) Migrate() error {
-	var schema string
+	var schema []string
 
 	switch c.db.DriverName() {
 	case "sqlite3":
-		schema = schemaSqlite3
+		schema = []string{schemaSqlite3, indexLinkKey, schemaIdempotencySqlite3, schemaAPIKey, schemaAuditSqlite3,
+			indexAuditKey, indexAuditActor, schemaHistorySqlite3, indexHistoryKey, indexLinkDomainValue, indexLinkUserID, indexLinkCreated, schemaClicks}
 	case "pgx":
-		schema = schemaPostgres
+		schema = append([]string{schemaPostgres}, migrationsPostgres...)
+		schema = append(schema, schemaVersionPostgres)
 	default:
 		return errors.New("unsupported driver type")
 	}
-	_, err := c.db.Exec(schema)
-	return err
+	for _, statement := range schema {
+		if _, err := c.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if c.db.DriverName() != "pgx" {
+		return nil
+	}
+	for i, statement := range dataMigrationsPostgres {
+		if err := c.migrateData(i+1, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateData runs the data migration statement unless version was recorded.
+// Recording the version in the same transaction makes a replica starting
+// meanwhile wait for it and skip it.
+func (c *DatabaseStorage) migrateData(version int, statement string) error {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO schema_version(version) VALUES($1) ON CONFLICT DO NOTHING", version)
+	if err != nil {
+		return err
+	}
+	if recorded, err := result.RowsAffected(); err != nil || recorded == 0 {
+		return err
+	}
+	if _, err := tx.Exec(statement); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (c *DatabaseStorage) Close() error {
+	c.once.Do(func() { close(c.done) })
+	if c.replicas != nil {
+		if err := c.replicas.Close(); err != nil {
+			return err
+		}
+	}
 	err := c.db.Close()
 	if err != nil {
 		return err
@@ -68,62 +433,603 @@ func (c *DatabaseStorage) Close() error {
 }
 
 func (c *DatabaseStorage) Ping(ctx context.Context) error {
-	return c.db.PingContext(ctx)
+	return databaseError(c.db.PingContext(ctx))
 }
 
 func (c *DatabaseStorage) Add(ctx context.Context, url string) (string, error) {
 	c.Lock()
 	defer c.Unlock()
-	query := "INSERT INTO link(key, value) VALUES($1, $2) returning id"
-
-	key, err := GetURLHash(url)
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", databaseError(err)
+	}
+	defer tx.Rollback()
+	key, created, err := c.add(ctx, tx, url)
 	if err != nil {
 		return "", err
 	}
-	var id string
-	var pgErr *pgconn.PgError
-	err = c.db.GetContext(ctx, &id, query, key, url)
+	if err := tx.Commit(); err != nil {
+		return "", databaseError(err)
+	}
+	c.written(ctx)
+	if !created {
+		return key, appErrors.ErrConflict
+	}
+	return key, nil
+}
 
-	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
-		key, err = c.GetURLKey(ctx, url)
+// add inserts a link for url within tx unless there is one, the audit events
+// of ctx are inserted along with a new link. Conflicts are not errors, so
+// they leave tx usable.
+func (c *DatabaseStorage) add(ctx context.Context, tx *sqlx.Tx, url string) (string, bool, error) {
+	query := `INSERT INTO link(key, value, user_id, domain, search, created_at) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING RETURNING id`
+	domain := domains.FromContext(ctx)
+	search := searchText(models.Link{OriginalURL: url})
+	createdAt := time.Now().UTC()
+
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		key, err := urlKey(domain, url, attempt)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
-		return key, appErrors.ErrConflict
+		var id string
+		err = tx.GetContext(ctx, &id, query, key, url, auth.UserID(ctx), domain, search, createdAt)
+		if err == nil {
+			return key, true, insertAudit(ctx, tx, audit.Events(ctx, key, url))
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, databaseError(err)
+		}
+		var existing string
+		err = tx.GetContext(ctx, &existing, "SELECT key FROM link WHERE domain=$1 AND value=$2", domain, url)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, databaseError(err)
+		}
+		// The key of an edited link no longer matches its url, a url hashing
+		// to it moves on to the next candidate.
 	}
-	return key, nil
+	return "", false, errNoFreeKey
 }
 
 func (c *DatabaseStorage) Get(ctx context.Context, key string) (string, error) {
 	c.RLock()
 	defer c.RUnlock()
 	var row RowDatabase
-	if err := c.db.GetContext(ctx, &row, "SELECT * FROM link where key=$1", key); err != nil {
-		return "", err
+	err := c.read(ctx, func(db *sqlx.DB) error {
+		return db.GetContext(ctx, &row, "SELECT * FROM link where key=$1", key)
+	})
+	if err != nil {
+		return "", databaseError(err)
+	}
+	if row.Deleted {
+		return "", appErrors.ErrDeleted
+	}
+	if row.Disabled {
+		return "", appErrors.ErrDisabled
 	}
 	return row.Value, nil
 }
 
+// AddByBatch inserts the batch in one transaction, a failing url stores none
+// of it.
 func (c *DatabaseStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	c.Lock()
+	defer c.Unlock()
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	defer tx.Rollback()
 	shortURLs := make([]models.URLRowShort, 0)
 	for _, url := range requestURLs {
-		key, err := c.Add(ctx, url.OriginalURL)
+		key, created, err := c.add(ctx, tx, url.OriginalURL)
 		if err != nil {
 			return nil, err
 		}
 		shortURL := models.URLRowShort{
 			CorrelationID: url.CorrelationID,
 			ShortURL:      fmt.Sprintf("%s/%s", c.config.ShortAddr, key),
+			Created:       created,
 		}
 		shortURLs = append(shortURLs, shortURL)
 	}
+	if err := tx.Commit(); err != nil {
+		return nil, databaseError(err)
+	}
+	c.written(ctx)
 	return shortURLs, nil
 }
 
-func (c *DatabaseStorage) GetURLKey(ctx context.Context, originURL string) (string, error) {
+func (c *DatabaseStorage) GetURLKey(ctx context.Context, domain string, originURL string) (string, error) {
 	var row RowDatabase
-	if err := c.db.GetContext(ctx, &row, "SELECT * FROM link where value=$1", originURL); err != nil {
-		return "", err
+	if err := c.db.GetContext(ctx, &row, "SELECT * FROM link where domain=$1 AND value=$2", domain, originURL); err != nil {
+		return "", databaseError(err)
 	}
 	return row.Key, nil
 }
+
+func (c *DatabaseStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	var rows *sqlx.Rows
+	err := c.read(ctx, func(db *sqlx.DB) error {
+		var err error
+		rows, err = db.QueryxContext(ctx, "SELECT * FROM link ORDER BY created_at, id")
+		return err
+	})
+	if err != nil {
+		return databaseError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row RowDatabase
+		if err := rows.StructScan(&row); err != nil {
+			return databaseError(err)
+		}
+		if err := fn(row.Link()); err != nil {
+			return err
+		}
+	}
+	return databaseError(rows.Err())
+}
+
+func (c *DatabaseStorage) Import(ctx context.Context, links []models.Link) error {
+	c.Lock()
+	defer c.Unlock()
+	query := `INSERT INTO link(key, value, user_id, created_at, is_deleted, is_disabled, domain, title, tags, notes, search,
+		meta_title, meta_description, meta_image, meta_fetched_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) ON CONFLICT DO NOTHING`
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return databaseError(err)
+	}
+	defer tx.Rollback()
+	for _, link := range links {
+		domain, _ := domains.Split(link.Key)
+		metaTitle, metaDescription, metaImage, metaFetchedAt := metadataColumns(link.Metadata)
+		_, err := tx.ExecContext(ctx, query, link.Key, link.OriginalURL, link.UserID, link.CreatedAt.UTC(), link.Deleted, link.Disabled, domain,
+			link.Title, joinTags(link.Tags), link.Notes, searchText(link), metaTitle, metaDescription, metaImage, metaFetchedAt)
+		if err != nil {
+			return databaseError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return databaseError(err)
+	}
+	c.written(ctx)
+	return nil
+}
+
+// GetLink reads from the primary, it is used to modify links and must not
+// see a lagging replica.
+func (c *DatabaseStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	var row RowDatabase
+	if err := c.db.GetContext(ctx, &row, "SELECT * FROM link WHERE key=$1", key); err != nil {
+		return models.Link{}, databaseError(err)
+	}
+	return row.Link(), nil
+}
+
+func (c *DatabaseStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	c.Lock()
+	defer c.Unlock()
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return databaseError(err)
+	}
+	defer tx.Rollback()
+	var row RowDatabase
+	if err := tx.GetContext(ctx, &row, "SELECT * FROM link WHERE key=$1", link.Key); err != nil {
+		return databaseError(err)
+	}
+	stored := row.Link()
+	if err := checkVersion(stored, link); err != nil {
+		return err
+	}
+	updated := updatedLink(stored, link)
+	if replaced := replacedVersion(stored, updated); replaced != nil {
+		var taken int
+		err := tx.GetContext(ctx, &taken, "SELECT count(*) FROM link WHERE domain=$1 AND value=$2 AND key<>$3",
+			row.Domain, updated.OriginalURL, link.Key)
+		if err != nil {
+			return databaseError(err)
+		}
+		if taken > 0 {
+			return appErrors.ErrURLTaken
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO link_history(key, url, replaced_at) VALUES($1, $2, $3)",
+			link.Key, replaced.URL, *replaced.ReplacedAt)
+		if err != nil {
+			return databaseError(err)
+		}
+	}
+	metaTitle, metaDescription, metaImage, metaFetchedAt := metadataColumns(updated.Metadata)
+	// The version condition catches a change committed by another process
+	// since the row was read.
+	result, err := tx.ExecContext(ctx, `UPDATE link SET value=$1, user_id=$2, is_deleted=$3, is_disabled=$4, title=$5, tags=$6, notes=$7, search=$8,
+		meta_title=$9, meta_description=$10, meta_image=$11, meta_fetched_at=$12, version=$13
+		WHERE key=$14 AND version=$15`, updated.OriginalURL, updated.UserID, updated.Deleted, updated.Disabled,
+		updated.Title, joinTags(updated.Tags), updated.Notes, searchText(updated),
+		metaTitle, metaDescription, metaImage, metaFetchedAt, updated.Version, link.Key, stored.Version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return appErrors.ErrURLTaken
+	}
+	if err != nil {
+		return databaseError(err)
+	}
+	if updatedRows, err := result.RowsAffected(); err == nil && updatedRows == 0 {
+		return appErrors.ErrStaleVersion
+	}
+	if err := insertAudit(ctx, tx, audit.Events(ctx, link.Key, updated.OriginalURL)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return databaseError(err)
+	}
+	c.written(ctx)
+	return nil
+}
+
+// PutLink stores link as it is under its key, replacing the stored one.
+func (c *DatabaseStorage) PutLink(ctx context.Context, link models.Link) error {
+	c.Lock()
+	defer c.Unlock()
+	domain, _ := domains.Split(link.Key)
+	metaTitle, metaDescription, metaImage, metaFetchedAt := metadataColumns(link.Metadata)
+	_, err := c.db.ExecContext(ctx, `INSERT INTO link(key, value, user_id, created_at, is_deleted, is_disabled, domain, title, tags, notes, search,
+		meta_title, meta_description, meta_image, meta_fetched_at, version)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		ON CONFLICT (key) DO UPDATE SET value=excluded.value, user_id=excluded.user_id, created_at=excluded.created_at,
+		is_deleted=excluded.is_deleted, is_disabled=excluded.is_disabled, title=excluded.title, tags=excluded.tags,
+		notes=excluded.notes, search=excluded.search, meta_title=excluded.meta_title, meta_description=excluded.meta_description,
+		meta_image=excluded.meta_image, meta_fetched_at=excluded.meta_fetched_at, version=excluded.version`,
+		link.Key, link.OriginalURL, link.UserID, link.CreatedAt.UTC(), link.Deleted, link.Disabled, domain,
+		link.Title, joinTags(link.Tags), link.Notes, searchText(link), metaTitle, metaDescription, metaImage, metaFetchedAt, max(link.Version, 1))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return appErrors.ErrURLTaken
+	}
+	if err != nil {
+		return databaseError(err)
+	}
+	c.written(ctx)
+	return nil
+}
+
+// SetMetadata keeps the version of the link, metadata is not an edit of it.
+func (c *DatabaseStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	c.Lock()
+	defer c.Unlock()
+	metaTitle, metaDescription, metaImage, metaFetchedAt := metadataColumns(&metadata)
+	result, err := c.db.ExecContext(ctx, `UPDATE link SET meta_title=$1, meta_description=$2, meta_image=$3, meta_fetched_at=$4
+		WHERE key=$5 AND value=$6 AND NOT is_deleted`, metaTitle, metaDescription, metaImage, metaFetchedAt, key, url)
+	if err != nil {
+		return databaseError(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		var exists int
+		if err := c.db.GetContext(ctx, &exists, "SELECT count(*) FROM link WHERE key=$1", key); err != nil {
+			return databaseError(err)
+		}
+		if exists == 0 {
+			return appErrors.ErrKey
+		}
+	}
+	c.written(ctx)
+	return nil
+}
+
+func (c *DatabaseStorage) DeleteLink(ctx context.Context, key string) error {
+	c.Lock()
+	defer c.Unlock()
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return databaseError(err)
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "DELETE FROM link WHERE key=$1", key)
+	if err != nil {
+		return databaseError(err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return appErrors.ErrKey
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM link_history WHERE key=$1", key); err != nil {
+		return databaseError(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM link_click WHERE key=$1", key); err != nil {
+		return databaseError(err)
+	}
+	if err := insertAudit(ctx, tx, audit.Events(ctx, key, "")); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return databaseError(err)
+	}
+	c.written(ctx)
+	return nil
+}
+
+// ListLinks filters and pages in SQL. Postgres matches the search words with
+// its full-text search and SQLite with one LIKE per word.
+func (c *DatabaseStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	p, err := newPager(query, page)
+	if err != nil {
+		return models.LinkPage{}, err
+	}
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	conditions := make([]string, 0)
+	if !query.IncludeDeleted {
+		conditions = append(conditions, "NOT is_deleted")
+	}
+	if query.KeyPrefix != "" {
+		conditions = append(conditions, "key LIKE "+arg(escapeLike(query.KeyPrefix)+"%")+` ESCAPE '\'`)
+	}
+	if query.URL != "" {
+		conditions = append(conditions, "lower(value) LIKE "+arg("%"+escapeLike(strings.ToLower(query.URL))+"%")+` ESCAPE '\'`)
+	}
+	if query.Owner != "" {
+		conditions = append(conditions, "user_id = "+arg(query.Owner))
+	}
+	if query.Tag != "" {
+		conditions = append(conditions, "',' || tags || ',' LIKE "+arg("%,"+escapeLike(query.Tag)+",%")+` ESCAPE '\'`)
+	}
+	if tokens := searchTokens(query.Search); len(tokens) > 0 {
+		if c.db.DriverName() == "pgx" {
+			conditions = append(conditions, "to_tsvector('simple', search) @@ plainto_tsquery('simple', "+arg(strings.Join(tokens, " "))+")")
+		} else {
+			for _, token := range tokens {
+				conditions = append(conditions, "' ' || search || ' ' LIKE "+arg("% "+token+" %"))
+			}
+		}
+	}
+	if !query.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(query.CreatedAfter.UTC()))
+	}
+	if !query.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(query.CreatedBefore.UTC()))
+	}
+	order, direction := "created_at, key", ">"
+	if page.Descending {
+		order, direction = "created_at DESC, key DESC", "<"
+	}
+	if p.after != nil {
+		createdAt, key := arg(p.after.CreatedAt), arg(p.after.Key)
+		conditions = append(conditions, fmt.Sprintf("(created_at %s %s OR (created_at = %s AND key %s %s))",
+			direction, createdAt, createdAt, direction, key))
+	}
+	statement := "SELECT * FROM link"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + order + " LIMIT " + arg(p.limit+1)
+
+	var rows []RowDatabase
+	err = c.read(ctx, func(db *sqlx.DB) error {
+		return db.SelectContext(ctx, &rows, statement, args...)
+	})
+	if err != nil {
+		return models.LinkPage{}, databaseError(err)
+	}
+	for _, row := range rows {
+		p.add(row.Link())
+	}
+	return p.result(), nil
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+func (c *DatabaseStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	var rows []RowDatabaseHistory
+	err := c.db.SelectContext(ctx, &rows, "SELECT url, replaced_at FROM link_history WHERE key=$1 ORDER BY id", key)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	versions := make([]models.LinkVersion, 0, len(rows))
+	for _, row := range rows {
+		replacedAt := row.ReplacedAt
+		versions = append(versions, models.LinkVersion{URL: row.URL, ReplacedAt: &replacedAt})
+	}
+	return versions, nil
+}
+
+func (c *DatabaseStorage) CountClick(ctx context.Context, key string) error {
+	result, err := c.db.ExecContext(ctx, `INSERT INTO link_click(key, clicks) SELECT key, 1 FROM link WHERE key=$1
+		ON CONFLICT (key) DO UPDATE SET clicks = link_click.clicks + 1`, key)
+	if err != nil {
+		return databaseError(err)
+	}
+	if counted, err := result.RowsAffected(); err == nil && counted == 0 {
+		return appErrors.ErrKey
+	}
+	return nil
+}
+
+func (c *DatabaseStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	var clicks int64
+	err := c.db.GetContext(ctx, &clicks, "SELECT clicks FROM link_click WHERE key=$1", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return clicks, databaseError(err)
+}
+
+func (c *DatabaseStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	return insertAudit(ctx, c.db, []models.AuditEvent{event})
+}
+
+// insertAudit inserts events through db, which is the transaction of the
+// change they describe.
+func insertAudit(ctx context.Context, db sqlx.ExecerContext, events []models.AuditEvent) error {
+	query := `INSERT INTO audit(id, at, actor, action, key, old_value, new_value, ip, request_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	for _, event := range events {
+		_, err := db.ExecContext(ctx, query, event.ID, event.Time.UTC(), event.Actor, event.Action, event.Key,
+			event.Old, event.New, event.IP, event.RequestID)
+		if err != nil {
+			return databaseError(err)
+		}
+	}
+	return nil
+}
+
+// ListAudit filters and pages in SQL, the sequence number is the serial
+// primary key of the audit table.
+func (c *DatabaseStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	var last int64
+	if err := c.db.GetContext(ctx, &last, "SELECT COALESCE(MAX(seq), 0) FROM audit"); err != nil {
+		return models.AuditPage{}, databaseError(err)
+	}
+	p, err := newAuditPager(query, page, last)
+	if err != nil {
+		return models.AuditPage{}, err
+	}
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	conditions := []string{"seq > " + arg(p.after)}
+	if query.Actor != "" {
+		conditions = append(conditions, "actor = "+arg(query.Actor))
+	}
+	if query.Action != "" {
+		conditions = append(conditions, "action = "+arg(query.Action))
+	}
+	if query.Key != "" {
+		conditions = append(conditions, "key = "+arg(query.Key))
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "at >= "+arg(query.Since.UTC()))
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "at < "+arg(query.Until.UTC()))
+	}
+	statement := "SELECT " + auditColumns + " FROM audit WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY seq LIMIT " + arg(p.limit+1)
+
+	var rows []RowAudit
+	if err := c.db.SelectContext(ctx, &rows, statement, args...); err != nil {
+		return models.AuditPage{}, databaseError(err)
+	}
+	for _, row := range rows {
+		p.add(models.AuditEvent(row))
+	}
+	return p.result(), nil
+}
+
+const auditColumns = "seq, id, at, actor, action, key, old_value, new_value, ip, request_id"
+
+func (c *DatabaseStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	rows, err := c.db.QueryxContext(ctx, "SELECT "+auditColumns+" FROM audit ORDER BY seq")
+	if err != nil {
+		return databaseError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row RowAudit
+		if err := rows.StructScan(&row); err != nil {
+			return databaseError(err)
+		}
+		if err := fn(models.AuditEvent(row)); err != nil {
+			return err
+		}
+	}
+	return databaseError(rows.Err())
+}
+
+func (c *DatabaseStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	var row RowIdempotency
+	err := c.db.GetContext(ctx, &row, "SELECT * FROM idempotency WHERE key=$1 AND expires_at > $2", key, time.Now().UTC())
+	if err != nil {
+		return models.IdempotencyRecord{}, databaseError(err)
+	}
+	return models.IdempotencyRecord(row), nil
+}
+
+func (c *DatabaseStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	query := `INSERT INTO idempotency(key, fingerprint, status, content_type, body, expires_at) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET fingerprint=excluded.fingerprint, status=excluded.status,
+		content_type=excluded.content_type, body=excluded.body, expires_at=excluded.expires_at`
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return databaseError(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency WHERE expires_at <= $1", time.Now().UTC()); err != nil {
+		return databaseError(err)
+	}
+	_, err = tx.ExecContext(ctx, query, record.Key, record.Fingerprint, record.Status, record.ContentType, record.Body, record.ExpiresAt.UTC())
+	if err != nil {
+		return databaseError(err)
+	}
+	return databaseError(tx.Commit())
+}
+
+func (c *DatabaseStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	query := `INSERT INTO api_key(id, name, owner, scopes, hash, created_at) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING`
+	result, err := c.db.ExecContext(ctx, query,
+		key.ID, key.Name, key.Owner, strings.Join(key.Scopes, ","), key.Hash, key.CreatedAt.UTC())
+	if err != nil {
+		return databaseError(err)
+	}
+	if inserted, err := result.RowsAffected(); err == nil && inserted == 0 {
+		return appErrors.ErrConflict
+	}
+	return nil
+}
+
+func (c *DatabaseStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	var row RowDatabaseAPIKey
+	if err := c.db.GetContext(ctx, &row, "SELECT * FROM api_key WHERE id=$1", id); err != nil {
+		return models.APIKey{}, databaseError(err)
+	}
+	return row.APIKey(), nil
+}
+
+func (c *DatabaseStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	var rows []RowDatabaseAPIKey
+	if err := c.db.SelectContext(ctx, &rows, "SELECT * FROM api_key ORDER BY created_at, id"); err != nil {
+		return nil, databaseError(err)
+	}
+	keys := make([]models.APIKey, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, row.APIKey())
+	}
+	return keys, nil
+}
+
+func (c *DatabaseStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	result, err := c.db.ExecContext(ctx, "UPDATE api_key SET revoked_at=COALESCE(revoked_at, $1) WHERE id=$2", at.UTC(), id)
+	if err != nil {
+		return databaseError(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return appErrors.ErrKey
+	}
+	return nil
+}
+
+func databaseError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return appErrors.ErrKey
+	case isRetryable(err), errors.Is(err, sql.ErrConnDone):
+		return appErrors.Wrap(appErrors.ErrUnavailable, "database", err)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestDatabaseStorage_Replicas(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	ctx := context.Background()
+	primary := newTestDB(t)
+	replicaDB := newTestDB(t)
+	dbStorage, _ := NewDatabaseStorage(primary, &configTest)
+	if err := dbStorage.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	replicaStorage, _ := NewDatabaseStorage(replicaDB, &configTest)
+	if err := replicaStorage.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	dbStorage.SetReplicas([]*sqlx.DB{replicaDB}, 50*time.Millisecond)
+	defer dbStorage.Close()
+
+	owner := auth.WithPrincipal(ctx, auth.Principal{Owner: "owner"})
+	key, err := dbStorage.Add(owner, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, err := dbStorage.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected a replica miss to be read from primary, got %q, %v", url, err)
+	}
+
+	// The replica lags behind with an older url for the key.
+	replicaStorage.Import(ctx, []models.Link{{Key: key, OriginalURL: "https://example.com/stale"}})
+	if url, err := dbStorage.Get(owner, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected own write to be read from primary, got %q, %v", url, err)
+	}
+	if url, err := dbStorage.Get(ctx, key); err != nil || url != "https://example.com/stale" {
+		t.Errorf("Expected other users to read from the lagging replica, got %q, %v", url, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if url, err := dbStorage.Get(owner, key); err != nil || url != "https://example.com/stale" {
+		t.Errorf("Expected read to go to lagging replica after window, got %q, %v", url, err)
+	}
+	if _, err := dbStorage.Get(ctx, "missing"); !errors.Is(err, appErrors.ErrKey) {
+		t.Errorf("Expected ErrKey for a key missing on both, got %v", err)
+	}
+	if dbStorage.replicas.pick("") == nil {
+		t.Errorf("Expected a miss to keep the replica healthy")
+	}
+
+	replicaDB.Close()
+	if url, err := dbStorage.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected fallback to primary, got %q, %v", url, err)
+	}
+	if dbStorage.replicas.pick("") != nil {
+		t.Errorf("Expected failed replica to be marked unhealthy")
+	}
+}
+
+func TestDatabaseStorage_Errors(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	ctx := context.Background()
+	dbStorage, _ := NewDatabaseStorage(newTestDB(t), &configTest)
+	if err := dbStorage.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbStorage.Close()
+	dbStorage.Import(ctx, []models.Link{{Key: "deleted", OriginalURL: "https://example.org", Deleted: true}})
+
+	tests := []struct {
+		name string
+		key  string
+		kind error
+	}{
+		{
+			name: "missing",
+			key:  "missing",
+			kind: appErrors.ErrNotFound,
+		},
+		{
+			name: "deleted",
+			key:  "deleted",
+			kind: appErrors.ErrGone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dbStorage.Get(ctx, tt.key); !errors.Is(err, tt.kind) {
+				t.Errorf("Expected %v, got %v", tt.kind, err)
+			}
+		})
+	}
+}
+
+func TestDatabaseStorage_DataMigrationRunsOnce(t *testing.T) {
+	db := newTestDB(t)
+	dbStorage, _ := NewDatabaseStorage(db, &config.Config{ShortAddr: "http://127.0.0.1:8080"})
+	defer dbStorage.Close()
+	if err := dbStorage.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{schemaVersionPostgres, `CREATE TABLE runs (n integer)`} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := dbStorage.migrateData(1, `INSERT INTO runs(n) VALUES(1)`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var runs int
+	if err := db.Get(&runs, `SELECT count(*) FROM runs`); err != nil || runs != 1 {
+		t.Errorf("Expected the data migration to run once, got %d, %v", runs, err)
+	}
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const shadowReadTimeout = time.Second
+
+// Shadow reads run on a fixed number of workers, reads finding the queue full
+// are not compared so a slow secondary never piles up goroutines.
+const (
+	shadowWorkers   = 4
+	shadowQueueSize = 1024
+)
+
+type shadowRead struct {
+	ctx context.Context
+	key string
+	url string
+	err error
+}
+
+type DualStats struct {
+	SecondaryErrors uint64
+	ShadowReads     uint64
+	ShadowDropped   uint64
+	Mismatches      uint64
+}
+
+type DualStorage struct {
+	primary         StorageExpected
+	secondary       StorageExpected
+	shadowRead      bool
+	shadowQueue     chan shadowRead
+	shadows         sync.WaitGroup
+	done            chan struct{}
+	once            sync.Once
+	secondaryErrors atomic.Uint64
+	shadowReads     atomic.Uint64
+	shadowDropped   atomic.Uint64
+	mismatches      atomic.Uint64
+}
+
+func NewDualStorage(primary StorageExpected, secondary StorageExpected, config *config.Config) *DualStorage {
+	dual := &DualStorage{
+		primary:    primary,
+		secondary:  secondary,
+		shadowRead: config.ShadowRead,
+		done:       make(chan struct{}),
+	}
+	if dual.shadowRead {
+		dual.shadowQueue = make(chan shadowRead, shadowQueueSize)
+		for i := 0; i < shadowWorkers; i++ {
+			dual.shadows.Add(1)
+			go dual.runShadowReads()
+		}
+	}
+	return dual
+}
+
+func (c *DualStorage) Ping(ctx context.Context) error {
+	if err := c.secondary.Ping(ctx); err != nil {
+		Sugar.Warnln("secondary storage ping failed", err)
+	}
+	return c.primary.Ping(ctx)
+}
+
+func (c *DualStorage) Close() error {
+	c.once.Do(func() { close(c.done) })
+	c.shadows.Wait()
+	return errors.Join(c.primary.Close(), c.secondary.Close())
+}
+
+// Add mirrors the link the primary stored, the secondary never picks keys of
+// its own so both map every key to the same url.
+func (c *DualStorage) Add(ctx context.Context, url string) (string, error) {
+	key, err := c.primary.Add(ctx, url)
+	switch {
+	case errors.Is(err, appErrors.ErrConflict):
+		c.mirror(ctx, "add", key, nil)
+	case err == nil:
+		c.mirror(ctx, "add", key, audit.Events(ctx, key, url))
+	}
+	return key, err
+}
+
+func (c *DualStorage) Get(ctx context.Context, key string) (string, error) {
+	url, err := c.primary.Get(ctx, key)
+	if c.shadowRead {
+		select {
+		case c.shadowQueue <- shadowRead{ctx: context.WithoutCancel(ctx), key: key, url: url, err: err}:
+		default:
+			c.shadowDropped.Add(1)
+		}
+	}
+	return url, err
+}
+
+func (c *DualStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	shortURLs, err := c.primary.AddByBatch(ctx, requestURLs)
+	if err != nil {
+		return nil, err
+	}
+	for i, shortURL := range shortURLs {
+		key := shortURL.ShortURL[strings.LastIndex(shortURL.ShortURL, "/")+1:]
+		var events []models.AuditEvent
+		if shortURL.Created {
+			events = audit.Events(ctx, key, requestURLs[i].OriginalURL)
+		}
+		c.mirror(ctx, "add by batch", key, events)
+	}
+	return shortURLs, nil
+}
+
+func (c *DualStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return c.primary.Iterate(ctx, fn)
+}
+
+func (c *DualStorage) Import(ctx context.Context, links []models.Link) error {
+	if err := c.primary.Import(ctx, links); err != nil {
+		return err
+	}
+	if err := c.secondary.Import(ctx, links); err != nil {
+		c.secondaryFailed("import", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return c.primary.GetLink(ctx, key)
+}
+
+func (c *DualStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	if err := c.primary.UpdateLink(ctx, link); err != nil {
+		return err
+	}
+	c.mirror(ctx, "update link", link.Key, audit.Events(ctx, link.Key, link.OriginalURL))
+	return nil
+}
+
+func (c *DualStorage) PutLink(ctx context.Context, link models.Link) error {
+	if err := c.primary.PutLink(ctx, link); err != nil {
+		return err
+	}
+	if err := c.secondary.PutLink(ctx, link); err != nil {
+		c.secondaryFailed("put link", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	if err := c.primary.SetMetadata(ctx, key, url, metadata); err != nil {
+		return err
+	}
+	c.mirror(ctx, "set metadata", key, nil)
+	return nil
+}
+
+func (c *DualStorage) DeleteLink(ctx context.Context, key string) error {
+	if err := c.primary.DeleteLink(ctx, key); err != nil {
+		return err
+	}
+	if err := c.secondary.DeleteLink(ctx, key); err != nil && !errors.Is(err, appErrors.ErrNotFound) {
+		c.secondaryFailed("delete link", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	return c.primary.LinkHistory(ctx, key)
+}
+
+func (c *DualStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	return c.primary.ListLinks(ctx, query, page)
+}
+
+func (c *DualStorage) CountClick(ctx context.Context, key string) error {
+	if err := c.primary.CountClick(ctx, key); err != nil {
+		return err
+	}
+	if err := c.secondary.CountClick(ctx, key); err != nil {
+		c.secondaryFailed("count click", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	return c.primary.LinkClicks(ctx, key)
+}
+
+func (c *DualStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	if err := c.primary.AppendAudit(ctx, event); err != nil {
+		return err
+	}
+	if err := c.secondary.AppendAudit(ctx, event); err != nil {
+		c.secondaryFailed("append audit", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.primary.IterateAudit(ctx, fn)
+}
+
+func (c *DualStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	return c.primary.ListAudit(ctx, query, page)
+}
+
+func (c *DualStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	return c.primary.GetIdempotency(ctx, key)
+}
+
+func (c *DualStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	return c.primary.SaveIdempotency(ctx, record)
+}
+
+func (c *DualStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	if err := c.primary.CreateAPIKey(ctx, key); err != nil {
+		return err
+	}
+	if err := c.secondary.CreateAPIKey(ctx, key); err != nil {
+		c.secondaryFailed("create api key", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	return c.primary.GetAPIKey(ctx, id)
+}
+
+func (c *DualStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	return c.primary.ListAPIKeys(ctx)
+}
+
+func (c *DualStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	if err := c.primary.RevokeAPIKey(ctx, id, at); err != nil {
+		return err
+	}
+	if err := c.secondary.RevokeAPIKey(ctx, id, at); err != nil {
+		c.secondaryFailed("revoke api key", err)
+	}
+	return nil
+}
+
+func (c *DualStorage) Stats() DualStats {
+	return DualStats{
+		SecondaryErrors: c.secondaryErrors.Load(),
+		ShadowReads:     c.shadowReads.Load(),
+		ShadowDropped:   c.shadowDropped.Load(),
+		Mismatches:      c.mismatches.Load(),
+	}
+}
+
+// runShadowReads compares queued reads until the storage is closed, the
+// reads still queued then are compared before it returns.
+func (c *DualStorage) runShadowReads() {
+	defer c.shadows.Done()
+	for {
+		select {
+		case read := <-c.shadowQueue:
+			c.compare(read.ctx, read.key, read.url, read.err)
+		case <-c.done:
+			for {
+				select {
+				case read := <-c.shadowQueue:
+					c.compare(read.ctx, read.key, read.url, read.err)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *DualStorage) compare(ctx context.Context, key string, url string, err error) {
+	notFound := errors.Is(err, appErrors.ErrNotFound)
+	if err != nil && !notFound {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, shadowReadTimeout)
+	defer cancel()
+
+	c.shadowReads.Add(1)
+	shadowURL, shadowErr := c.secondary.Get(ctx, key)
+	shadowNotFound := errors.Is(shadowErr, appErrors.ErrNotFound)
+	switch {
+	case shadowErr != nil && !shadowNotFound:
+		c.secondaryFailed("shadow read", shadowErr)
+	case notFound != shadowNotFound || url != shadowURL:
+		c.mismatches.Add(1)
+		Sugar.Warnw("shadow read mismatch",
+			"key", key,
+			"primary", url,
+			"secondary", shadowURL,
+			"primary_found", !notFound,
+			"secondary_found", !shadowNotFound,
+		)
+	}
+}
+
+// mirror writes the link of the primary as it is to the secondary, along with
+// the audit events of its change. Replaying the change instead would let a
+// secondary that drifted pick other keys or reject the versions of the
+// primary.
+func (c *DualStorage) mirror(ctx context.Context, op string, key string, events []models.AuditEvent) {
+	link, err := c.primary.GetLink(ctx, key)
+	if err == nil {
+		err = c.secondary.PutLink(ctx, link)
+	}
+	for _, event := range events {
+		if err != nil {
+			break
+		}
+		err = c.secondary.AppendAudit(ctx, event)
+	}
+	if err != nil {
+		c.secondaryFailed(op, err)
+	}
+}
+
+func (c *DualStorage) secondaryFailed(op string, err error) {
+	c.secondaryErrors.Add(1)
+	Sugar.Warnln("secondary storage", op, "failed", err)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func TestDualStorage(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", ShadowRead: true}
+	primary := NewInmemoryStorage(&configTest)
+	secondary := NewInmemoryStorage(&configTest)
+	dual := NewDualStorage(primary, secondary, &configTest)
+	ctx := context.Background()
+
+	key, err := dual.Add(ctx, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dual.AddByBatch(ctx, []models.URLRowOriginal{{CorrelationID: "1", OriginalURL: "https://example.org"}})
+	if secondary.Len() != 2 {
+		t.Errorf("Expected writes to reach secondary, got %d links", secondary.Len())
+	}
+
+	if url, err := dual.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected https://example.com, got %s, %v", url, err)
+	}
+	primary.Put(models.Link{Key: "primary", OriginalURL: "https://example.net"})
+	dual.Get(ctx, "primary")
+	secondary.Put(models.Link{Key: "secondary", OriginalURL: "https://example.net"})
+	dual.Get(ctx, "secondary")
+	dual.Get(ctx, "missing")
+	dual.Close()
+
+	stats := dual.Stats()
+	if stats.ShadowReads != 4 || stats.Mismatches != 2 || stats.SecondaryErrors != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+// blockingStorage holds every Get until release is closed.
+type blockingStorage struct {
+	*InmemoryStorage
+	release chan struct{}
+}
+
+func (c *blockingStorage) Get(ctx context.Context, key string) (string, error) {
+	<-c.release
+	return c.InmemoryStorage.Get(ctx, key)
+}
+
+func TestDualStorage_ShadowReadsBounded(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", ShadowRead: true}
+	secondary := &blockingStorage{InmemoryStorage: NewInmemoryStorage(&configTest), release: make(chan struct{})}
+	dual := NewDualStorage(NewInmemoryStorage(&configTest), secondary, &configTest)
+	ctx := context.Background()
+
+	reads := shadowWorkers + shadowQueueSize + 10
+	for i := 0; i < reads; i++ {
+		dual.Get(ctx, "missing")
+	}
+	close(secondary.release)
+	dual.Close()
+
+	stats := dual.Stats()
+	if stats.ShadowDropped < 10 || stats.ShadowReads+stats.ShadowDropped != uint64(reads) {
+		t.Errorf("Expected reads beyond the queue to be dropped, got %+v", stats)
+	}
+}
+
+func TestDualStorage_MirrorsPrimaryLinks(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	primary := NewInmemoryStorage(&configTest)
+	secondary := NewInmemoryStorage(&configTest)
+	ctx := context.Background()
+
+	dual := NewDualStorage(primary, secondary, &configTest)
+	defer dual.Close()
+	key, err := dual.Add(ctx, "https://a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A secondary that drifted still follows the updates of the primary.
+	drifted, _ := secondary.GetLink(ctx, key)
+	drifted.Version = 7
+	secondary.Put(drifted)
+	update, _ := dual.GetLink(ctx, key)
+	update.Disabled = true
+	if err := dual.UpdateLink(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+
+	var links []models.Link
+	primary.Iterate(ctx, func(link models.Link) error {
+		links = append(links, link)
+		return nil
+	})
+	if err := secondary.Import(ctx, links); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range links {
+		if got, err := secondary.GetLink(ctx, want.Key); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the secondary to store %+v, got %+v, %v", want, got, err)
+		}
+	}
+	if stats := dual.Stats(); stats.SecondaryErrors != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
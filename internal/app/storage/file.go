@@ -2,29 +2,109 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 )
 
-const maxCapacity = 1024
+const fileScheme = "file:"
+
+const (
+	SyncAlways   = "always"
+	SyncBatch    = "batch"
+	SyncInterval = "interval"
+)
+
+const maxBatchSize = 1024
+
+// Rows other than links carry their kind, link rows have none so files
+// written before other rows existed load unchanged.
+const (
+	rowIdempotency = "idempotency"
+	rowAudit       = "audit"
+	rowHistory     = "history"
+	rowClicks      = "clicks"
+)
+
+const (
+	skipMalformed = "malformed"
+	skipChecksum  = "checksum"
+	skipTorn      = "torn"
+)
 
 type FileStorage struct {
 	sync.RWMutex
-	inmemory *InmemoryStorage
-	file     *os.File
-	filename string
-	config   *config.Config
+	inmemory  *InmemoryStorage
+	pendingMu sync.Mutex
+	reserved  map[string]chan struct{}
+	fileMu    sync.Mutex
+	clickMu   sync.Mutex
+	clicked   map[string]struct{}
+	file      *os.File
+	filename  string
+	config    *config.Config
+	syncMode  string
+	pending   chan pendingRow
+	rows      int
+	report    LoadReport
+	done      chan struct{}
+	once      sync.Once
+	workers   sync.WaitGroup
+}
+
+type pendingRow struct {
+	write *fileWrite
+	ack   chan error
 }
 
 type RowFile struct {
-	Key   string
-	Value string
+	Key       string
+	Value     string
+	UserID    string `json:",omitempty"`
+	CreatedAt time.Time
+	Deleted   bool                 `json:",omitempty"`
+	Disabled  bool                 `json:",omitempty"`
+	Title     string               `json:",omitempty"`
+	Tags      []string             `json:",omitempty"`
+	Notes     string               `json:",omitempty"`
+	Metadata  *models.LinkMetadata `json:",omitempty"`
+	Removed   bool                 `json:",omitempty"`
+	Version   int64                `json:",omitempty"`
+	Kind      string               `json:",omitempty"`
+
+	Idempotency *models.IdempotencyRecord `json:",omitempty"`
+	Audit       *models.AuditEvent        `json:",omitempty"`
+	History     *models.LinkVersion       `json:",omitempty"`
+	Clicks      int64                     `json:",omitempty"`
+
+	Checksum string `json:",omitempty"`
+}
+
+type LoadReport struct {
+	Records    int
+	Duplicates int
+	Skipped    map[string]int
+	Truncated  int64
 }
 
 func NewFileStorage(filename string, config *config.Config) (*FileStorage, error) {
@@ -33,86 +113,672 @@ func NewFileStorage(filename string, config *config.Config) (*FileStorage, error
 		return nil, err
 	}
 	inmemory := NewInmemoryStorage(config)
+	fileStorage := &FileStorage{
+		file:     file,
+		filename: filename,
+		inmemory: inmemory,
+		reserved: make(map[string]chan struct{}),
+		clicked:  make(map[string]struct{}),
+		config:   config,
+		syncMode: config.FileSyncMode,
+		done:     make(chan struct{}),
+	}
+
+	switch fileStorage.syncMode {
+	case "", SyncAlways:
+		fileStorage.syncMode = SyncAlways
+	case SyncBatch:
+		fileStorage.pending = make(chan pendingRow, maxBatchSize)
+		fileStorage.workers.Add(1)
+		go fileStorage.runGroupCommit()
+	case SyncInterval:
+		if config.FileSyncInterval <= 0 {
+			file.Close()
+			return nil, fmt.Errorf("invalid file sync interval %s", config.FileSyncInterval)
+		}
+		fileStorage.workers.Add(1)
+		go fileStorage.runIntervalSync(config.FileSyncInterval)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unsupported file sync mode %q", config.FileSyncMode)
+	}
+	fileStorage.workers.Add(1)
+	go fileStorage.runClickFlush(clickFlushInterval)
+	if config.FileCompactInterval > 0 {
+		fileStorage.workers.Add(1)
+		go fileStorage.runCompaction(config.FileCompactInterval)
+	}
+
+	return fileStorage, nil
+}
+
+func NewRowFile(link models.Link) RowFile {
+	row := RowFile{
+		Key:       link.Key,
+		Value:     link.OriginalURL,
+		UserID:    link.UserID,
+		CreatedAt: link.CreatedAt,
+		Deleted:   link.Deleted,
+		Disabled:  link.Disabled,
+		Title:     link.Title,
+		Tags:      link.Tags,
+		Notes:     link.Notes,
+		Metadata:  link.Metadata,
+		Version:   link.Version,
+	}
+	row.Checksum = row.checksum()
+	return row
+}
+
+func newIdempotencyRowFile(record models.IdempotencyRecord) RowFile {
+	row := RowFile{Key: record.Key, Kind: rowIdempotency, Idempotency: &record}
+	row.Checksum = row.checksum()
+	return row
+}
+
+func newAuditRowFile(event models.AuditEvent) RowFile {
+	row := RowFile{Key: event.ID, Kind: rowAudit, Audit: &event}
+	row.Checksum = row.checksum()
+	return row
+}
+
+// newHistoryRowFile is a replaced destination of the link key, the removed
+// row of a key drops the history loaded before it.
+func newHistoryRowFile(key string, version models.LinkVersion) RowFile {
+	row := RowFile{Key: key, Kind: rowHistory, History: &version}
+	row.Checksum = row.checksum()
+	return row
+}
+
+// newClicksRowFile is the number of clicks of the link key, the last one
+// loaded wins like for links.
+func newClicksRowFile(key string, clicks int64) RowFile {
+	row := RowFile{Key: key, Kind: rowClicks, Clicks: clicks}
+	row.Checksum = row.checksum()
+	return row
+}
+
+// newRemovedRowFile is the tombstone of a hard deleted link.
+func newRemovedRowFile(key string) RowFile {
+	row := RowFile{Key: key, CreatedAt: time.Now().UTC(), Removed: true}
+	row.Checksum = row.checksum()
+	return row
+}
+
+func (r RowFile) Link() models.Link {
+	return models.Link{
+		Key:         r.Key,
+		OriginalURL: r.Value,
+		UserID:      r.UserID,
+		CreatedAt:   r.CreatedAt,
+		Deleted:     r.Deleted,
+		Disabled:    r.Disabled,
+		Version:     r.Version,
+		LinkDetails: models.LinkDetails{Title: r.Title, Tags: r.Tags, Notes: r.Notes},
+		Metadata:    r.Metadata,
+	}
+}
+
+func (r RowFile) Valid() bool {
+	if r.Key == "" {
+		return false
+	}
+	return r.Checksum == "" || r.Checksum == r.checksum()
+}
+
+func (r RowFile) checksum() string {
+	data := fmt.Sprintf("%s\n%s\n%s\n%s\n%t", r.Key, r.Value, r.UserID, r.CreatedAt.Format(time.RFC3339Nano), r.Deleted)
+	// Flags added later are only part of the checksum when set, so rows written
+	// before they existed keep their checksum.
+	if r.Disabled {
+		data += "\ndisabled"
+	}
+	if r.Removed {
+		data += "\nremoved"
+	}
+	if r.Title != "" || len(r.Tags) > 0 || r.Notes != "" {
+		data += fmt.Sprintf("\n%s\n%s\n%s", r.Title, strings.Join(r.Tags, ","), r.Notes)
+	}
+	if r.Metadata != nil {
+		data += fmt.Sprintf("\n%s\n%s\n%s\n%s", r.Metadata.Title, r.Metadata.Description, r.Metadata.Image,
+			r.Metadata.FetchedAt.Format(time.RFC3339Nano))
+	}
+	if r.Version != 0 {
+		data += fmt.Sprintf("\nversion %d", r.Version)
+	}
+	if r.Kind != "" {
+		data += fmt.Sprintf("\n%s\n%s", r.Kind, r.payload())
+	}
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(data)))
+}
 
-	return &FileStorage{file: file, filename: filename, inmemory: inmemory, config: config}, nil
+// payload is the encoded record of a row of another kind than link.
+func (r RowFile) payload() []byte {
+	var payload interface{} = r.Idempotency
+	switch r.Kind {
+	case rowAudit:
+		payload = r.Audit
+	case rowHistory:
+		payload = r.History
+	case rowClicks:
+		payload = r.Clicks
+	}
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+func (r LoadReport) String() string {
+	reasons := make([]string, 0, len(r.Skipped))
+	for reason, count := range r.Skipped {
+		reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("loaded %d records, %d duplicates, skipped [%s], truncated %d bytes",
+		r.Records, r.Duplicates, strings.Join(reasons, " "), r.Truncated)
 }
 
 func (c *FileStorage) Close() error {
+	c.once.Do(func() { close(c.done) })
+	c.workers.Wait()
+	c.Lock()
+	defer c.Unlock()
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
 	return c.file.Close()
 }
 
 func (c *FileStorage) Ping(ctx context.Context) error {
 	c.RLock()
 	defer c.RUnlock()
-	_, err := os.OpenFile(c.filename, os.O_RDONLY|os.O_CREATE, 0777)
+	file, err := os.OpenFile(c.filename, os.O_RDONLY|os.O_CREATE, 0777)
 	if err != nil {
-		return err
+		return fileError(err)
 	}
-	return nil
+	return file.Close()
 }
 
-func (c *FileStorage) Load() error {
+func (c *FileStorage) Report() LoadReport {
 	c.RLock()
 	defer c.RUnlock()
+	return c.report
+}
+
+func (c *FileStorage) Load() error {
+	c.Lock()
+	defer c.Unlock()
 	file, err := os.OpenFile(c.filename, os.O_RDONLY|os.O_CREATE, 0777)
 	if err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(file)
-	buf := make([]byte, maxCapacity)
-	scanner.Buffer(buf, maxCapacity)
-	data := make(map[string]string)
-	for scanner.Scan() {
-		rawRow := scanner.Bytes()
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	report := LoadReport{Skipped: make(map[string]int)}
+	var offset, validSize int64
+	rows := 0
+	for {
+		rawRow, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if len(rawRow) == 0 {
+			break
+		}
+		offset += int64(len(rawRow))
+		terminated := bytes.HasSuffix(rawRow, []byte{'\n'})
+		rawRow = bytes.TrimSuffix(rawRow, []byte{'\n'})
+
 		var row RowFile
 		err := json.Unmarshal(rawRow, &row)
-		if err == nil {
-			data[row.Key] = row.Value
+		switch {
+		case !terminated && (err != nil || !row.Valid()):
+			report.Skipped[skipTorn]++
+			report.Truncated = offset - validSize
+			continue
+		case err != nil:
+			report.Skipped[skipMalformed]++
+		case !row.Valid():
+			report.Skipped[skipChecksum]++
+		case row.Kind == rowIdempotency:
+			if row.Idempotency != nil && row.Idempotency.ExpiresAt.After(time.Now()) {
+				c.inmemory.SaveIdempotency(context.Background(), *row.Idempotency)
+			}
+		case row.Kind == rowAudit:
+			if row.Audit != nil {
+				c.inmemory.AppendAudit(context.Background(), *row.Audit)
+			}
+		case row.Kind == rowHistory:
+			if row.History != nil {
+				c.inmemory.AddHistory(row.Key, *row.History)
+			}
+		case row.Kind == rowClicks:
+			c.inmemory.SetClicks(row.Key, row.Clicks)
+		case row.Removed:
+			c.inmemory.Remove(row.Key)
+		default:
+			if c.inmemory.Put(row.Link()) {
+				report.Duplicates++
+			}
+		}
+		rows++
+		validSize = offset
+		if !terminated {
+			if _, err := c.file.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+			validSize++
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+	if report.Truncated > 0 {
+		if err := c.file.Truncate(validSize); err != nil {
+			return err
+		}
 	}
-	if err := file.Close(); err != nil {
+	if err := c.file.Sync(); err != nil {
 		return err
 	}
-	if err := c.inmemory.Append(data); err != nil {
+	report.Records = c.inmemory.Len()
+	c.report = report
+	c.rows = rows
+	return c.loadAPIKeys()
+}
+
+// Compact rewrites the storage file with one row per link, its history and
+// clicks, one row per unexpired idempotency record and the whole audit log.
+// The snapshot is written under the read lock, only the rows appended
+// meanwhile are copied under the write lock before the new file replaces the
+// old one.
+func (c *FileStorage) Compact() error {
+	snapshot, err := c.writeSnapshot()
+	if err != nil || snapshot == nil {
 		return err
 	}
-	return nil
+	return c.replaceFile(snapshot)
 }
 
-func (c *FileStorage) Add(ctx context.Context, url string) (string, error) {
-	c.Lock()
-	defer c.Unlock()
-	key, err := c.inmemory.Add(ctx, url)
+// compaction is a compacted copy of the storage file up to offset.
+type compaction struct {
+	file   *os.File
+	name   string
+	offset int64
+	rows   int
+}
+
+func (s *compaction) abort() {
+	s.file.Close()
+	os.Remove(s.name)
+}
+
+// writeSnapshot writes the live rows to a new file, nil when there is nothing
+// to compact. The rows before the returned offset are all part of the
+// snapshot.
+func (c *FileStorage) writeSnapshot() (*compaction, error) {
+	c.RLock()
+	defer c.RUnlock()
+	// Writes are applied to memory under fileMu, so memory holds exactly the
+	// rows up to the offset and no audit event ends up in the snapshot twice.
+	c.fileMu.Lock()
+	rows := c.rows
+	info, err := c.file.Stat()
+	live := c.snapshotRows()
+	c.fileMu.Unlock()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	row := RowFile{Key: key, Value: url}
-	data, err := json.Marshal(row)
+	if len(live) == rows {
+		return nil, nil
+	}
+
+	name := c.filename + ".compact"
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0777)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	data = append(data, '\n')
-	_, err = c.file.Write(data)
+	snapshot := &compaction{file: file, name: name, offset: info.Size()}
+	writer := bufio.NewWriter(file)
+	for _, row := range live {
+		if err := writeRow(writer, row); err != nil {
+			snapshot.abort()
+			return nil, err
+		}
+		snapshot.rows++
+	}
+	if err := writer.Flush(); err != nil {
+		snapshot.abort()
+		return nil, err
+	}
+	return snapshot, nil
+}
 
+// replaceFile appends the rows written since the snapshot and renames it over
+// the storage file. The snapshot is already open for appending, so a failure
+// leaves the storage writing to the old file.
+func (c *FileStorage) replaceFile(snapshot *compaction) error {
+	c.Lock()
+	defer c.Unlock()
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+
+	tail, err := io.ReadAll(io.NewSectionReader(c.file, snapshot.offset, math.MaxInt64-snapshot.offset))
 	if err != nil {
-		return "", err
+		snapshot.abort()
+		return err
+	}
+	if _, err := snapshot.file.Write(tail); err != nil {
+		snapshot.abort()
+		return err
+	}
+	if err := snapshot.file.Sync(); err != nil {
+		snapshot.abort()
+		return err
+	}
+	if err := os.Rename(snapshot.name, c.filename); err != nil {
+		snapshot.abort()
+		return err
+	}
+	c.file.Close()
+	c.file = snapshot.file
+	c.rows = snapshot.rows + bytes.Count(tail, []byte{'\n'})
+	return syncDir(filepath.Dir(c.filename))
+}
+
+func (c *FileStorage) snapshotRows() []RowFile {
+	links := c.inmemory.Snapshot()
+	records := c.inmemory.IdempotencyRecords()
+	events := c.inmemory.AuditEvents()
+	rows := make([]RowFile, 0, len(links)+len(records)+len(events))
+	for _, link := range links {
+		rows = append(rows, NewRowFile(link))
+		history, _ := c.inmemory.LinkHistory(context.Background(), link.Key)
+		for _, version := range history {
+			rows = append(rows, newHistoryRowFile(link.Key, version))
+		}
+		if clicks, _ := c.inmemory.LinkClicks(context.Background(), link.Key); clicks > 0 {
+			rows = append(rows, newClicksRowFile(link.Key, clicks))
+		}
 	}
+	for _, record := range records {
+		rows = append(rows, newIdempotencyRowFile(record))
+	}
+	for _, event := range events {
+		rows = append(rows, newAuditRowFile(event))
+	}
+	return rows
+}
 
-	err = c.file.Sync()
+// runCompaction compacts the storage file until Close. Until Load counts the
+// rows of the file there is nothing to compact, so an early tick leaves the
+// file alone.
+func (c *FileStorage) runCompaction(interval time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Compact(); err != nil {
+				Sugar.Errorln("file storage compaction failed", err)
+			}
+		}
+	}
+}
+
+func (c *FileStorage) Add(ctx context.Context, url string) (string, error) {
+	key, _, err := c.add(ctx, url)
+	return key, err
+}
+
+func (c *FileStorage) add(ctx context.Context, url string) (string, bool, error) {
+	for {
+		key, write, wait, err := c.prepareAdd(ctx, url)
+		switch {
+		case err != nil:
+			return "", false, err
+		case wait != nil:
+			<-wait
+		case write == nil:
+			return key, false, nil
+		default:
+			if err := c.appendWrite(ctx, write); err != nil {
+				return "", false, err
+			}
+			return key, true, nil
+		}
+	}
+}
 
+// prepareAdd writes a new link along with the audit events of ctx.
+func (c *FileStorage) prepareAdd(ctx context.Context, url string) (string, *fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	domain := domains.FromContext(ctx)
+	index := urlName(domains.IndexKey(domain, url))
+	if wait := c.reserved[index]; wait != nil {
+		return "", nil, wait, nil
+	}
+	key, exists, err := c.inmemory.KeyFor(domain, url)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
+	}
+	if wait := c.reserved[keyName(key)]; wait != nil {
+		return "", nil, wait, nil
+	}
+	if stored, ok := c.inmemory.Link(key); exists && ok && !stored.Deleted {
+		return key, nil, nil, nil
+	}
+	link := models.Link{Key: key, OriginalURL: url, UserID: auth.UserID(ctx), CreatedAt: time.Now().UTC(), Version: 1}
+	write, err := c.linkWrite([]RowFile{NewRowFile(link)}, audit.Events(ctx, key, url), func() { c.inmemory.Put(link) })
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return key, c.reserve(write, index, keyName(key)), nil, nil
+}
+
+// linkWrite encodes the rows of a link change followed by its audit events,
+// so all of them are written and applied together.
+func (c *FileStorage) linkWrite(rows []RowFile, events []models.AuditEvent, apply func()) (*fileWrite, error) {
+	var buf bytes.Buffer
+	for _, event := range events {
+		rows = append(rows, newAuditRowFile(event))
 	}
+	for _, row := range rows {
+		if err := writeRow(&buf, row); err != nil {
+			return nil, err
+		}
+	}
+	return &fileWrite{data: buf.Bytes(), rows: len(rows), apply: func() {
+		apply()
+		for _, event := range events {
+			c.inmemory.AppendAudit(context.Background(), event)
+		}
+	}}, nil
+}
+
+// fileWrite is a batch of encoded rows and the change they make in memory.
+// The change is applied once the rows are written, so readers never see a
+// row that could still be lost. Until then the write holds its names, the
+// keys and urls it changes, and other writers of them wait for it.
+type fileWrite struct {
+	data  []byte
+	rows  int
+	apply func()
+	names []string
+	done  chan struct{}
+}
+
+func keyName(key string) string {
+	return "key:" + key
+}
+
+func urlName(index string) string {
+	return "url:" + index
+}
+
+// reserve holds names for write until it is done, the caller holds
+// pendingMu and checked none of them is held.
+func (c *FileStorage) reserve(write *fileWrite, names ...string) *fileWrite {
+	write.names = names
+	write.done = make(chan struct{})
+	for _, name := range names {
+		c.reserved[name] = write.done
+	}
+	return write
+}
+
+// appendWrite writes write to the storage file without holding the storage
+// lock. In batch mode it waits for the group commit the write is part of,
+// a write made after Close fails instead of waiting for a commit that never
+// comes.
+func (c *FileStorage) appendWrite(ctx context.Context, write *fileWrite) error {
+	if c.syncMode != SyncBatch {
+		return c.writeDirect(write, c.syncMode == SyncAlways)
+	}
+	select {
+	case <-c.done:
+		return c.abandon(write, os.ErrClosed)
+	default:
+	}
+	ack := make(chan error, 1)
+	select {
+	case c.pending <- pendingRow{write: write, ack: ack}:
+	case <-c.done:
+		return c.abandon(write, os.ErrClosed)
+	case <-ctx.Done():
+		return c.abandon(write, ctx.Err())
+	}
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return fileError(ctx.Err())
+	case <-c.done:
+	}
+	// The group commit writes the rows queued before it stopped, a row queued
+	// after that is never written.
+	c.workers.Wait()
+	select {
+	case err := <-ack:
+		return err
+	default:
+		return c.abandon(write, os.ErrClosed)
+	}
+}
+
+// abandon releases the names of a write that never reaches the file.
+func (c *FileStorage) abandon(write *fileWrite, err error) error {
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+	c.finish(write, err)
+	return fileError(err)
+}
+
+// writeDirect writes write to the storage file and syncs it when asked to.
+func (c *FileStorage) writeDirect(write *fileWrite, sync bool) error {
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+	_, err := c.file.Write(write.data)
+	if err == nil && sync {
+		err = c.file.Sync()
+	}
+	c.finish(write, err)
+	return fileError(err)
+}
+
+// finish applies a written row to memory and releases its names. The caller
+// holds fileMu, so compaction never finds a row in the file that is missing
+// in memory.
+func (c *FileStorage) finish(write *fileWrite, err error) {
+	if err == nil {
+		c.rows += write.rows
+		write.apply()
+	}
+	if write.done == nil {
+		return
+	}
+	c.pendingMu.Lock()
+	for _, name := range write.names {
+		delete(c.reserved, name)
+	}
+	c.pendingMu.Unlock()
+	close(write.done)
+}
 
-	return key, nil
+func (c *FileStorage) runGroupCommit() {
+	defer c.workers.Done()
+	batch := make([]pendingRow, 0, maxBatchSize)
+	for {
+		select {
+		case row := <-c.pending:
+			batch = append(batch[:0], row)
+		case <-c.done:
+			for {
+				select {
+				case row := <-c.pending:
+					c.commit([]pendingRow{row})
+				default:
+					return
+				}
+			}
+		}
+		runtime.Gosched()
+	collect:
+		for len(batch) < maxBatchSize {
+			select {
+			case row := <-c.pending:
+				batch = append(batch, row)
+			default:
+				break collect
+			}
+		}
+		c.commit(batch)
+	}
+}
+
+func (c *FileStorage) commit(batch []pendingRow) {
+	c.fileMu.Lock()
+	var buf bytes.Buffer
+	for _, row := range batch {
+		buf.Write(row.write.data)
+	}
+	_, err := c.file.Write(buf.Bytes())
+	if err == nil {
+		err = c.file.Sync()
+	}
+	for _, row := range batch {
+		c.finish(row.write, err)
+	}
+	c.fileMu.Unlock()
+	for _, row := range batch {
+		row.ack <- fileError(err)
+	}
+}
+
+func (c *FileStorage) runIntervalSync(interval time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.sync()
+			return
+		case <-ticker.C:
+			c.sync()
+		}
+	}
+}
+
+func (c *FileStorage) sync() {
+	c.fileMu.Lock()
+	defer c.fileMu.Unlock()
+	if err := c.file.Sync(); err != nil {
+		Sugar.Errorln("file storage sync failed", err)
+	}
 }
 
 func (c *FileStorage) Get(ctx context.Context, key string) (string, error) {
-	c.RLock()
-	defer c.RUnlock()
 	url, err := c.inmemory.Get(ctx, key)
 	if err != nil {
 		return "", err
@@ -123,15 +789,470 @@ func (c *FileStorage) Get(ctx context.Context, key string) (string, error) {
 func (c *FileStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
 	shortURLs := make([]models.URLRowShort, 0)
 	for _, url := range requestURLs {
-		key, err := c.Add(ctx, url.OriginalURL)
+		key, created, err := c.add(ctx, url.OriginalURL)
 		if err != nil {
 			return nil, err
 		}
 		shortURL := models.URLRowShort{
 			CorrelationID: url.CorrelationID,
 			ShortURL:      fmt.Sprintf("%s/%s", c.config.ShortAddr, key),
+			Created:       created,
 		}
 		shortURLs = append(shortURLs, shortURL)
 	}
 	return shortURLs, nil
 }
+
+func (c *FileStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return c.inmemory.Iterate(ctx, fn)
+}
+
+func (c *FileStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return c.inmemory.GetLink(ctx, key)
+}
+
+func (c *FileStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	return c.inmemory.ListLinks(ctx, query, page)
+}
+
+// Updates and hard deletes append a new row for the key, the last row wins
+// on load and compaction drops the older ones.
+func (c *FileStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	for {
+		write, wait, err := c.prepareUpdate(ctx, link)
+		switch {
+		case err != nil:
+			return err
+		case wait != nil:
+			<-wait
+		default:
+			return c.appendWrite(ctx, write)
+		}
+	}
+}
+
+// prepareUpdate writes the updated link along with the destination it
+// replaces.
+func (c *FileStorage) prepareUpdate(ctx context.Context, link models.Link) (*fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if wait := c.reserved[keyName(link.Key)]; wait != nil {
+		return nil, wait, nil
+	}
+	stored, ok := c.inmemory.Link(link.Key)
+	if !ok {
+		return nil, nil, appErrors.ErrKey
+	}
+	if err := checkVersion(stored, link); err != nil {
+		return nil, nil, err
+	}
+	updated := updatedLink(stored, link)
+	names := []string{keyName(link.Key)}
+	rows := []RowFile{NewRowFile(updated)}
+	replaced := replacedVersion(stored, updated)
+	if replaced != nil {
+		index := urlName(urlIndex(link.Key, updated.OriginalURL))
+		if wait := c.reserved[index]; wait != nil {
+			return nil, wait, nil
+		}
+		if key, ok := c.inmemory.URLKey(link.Key, updated.OriginalURL); ok && key != link.Key {
+			return nil, nil, appErrors.ErrURLTaken
+		}
+		names = append(names, index)
+		rows = append(rows, newHistoryRowFile(link.Key, *replaced))
+	}
+	write, err := c.linkWrite(rows, audit.Events(ctx, link.Key, updated.OriginalURL), func() {
+		c.inmemory.Put(updated)
+		if replaced != nil {
+			c.inmemory.AddHistory(link.Key, *replaced)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.reserve(write, names...), nil, nil
+}
+
+// PutLink appends link as it is, the row replaces the stored one on load.
+func (c *FileStorage) PutLink(ctx context.Context, link models.Link) error {
+	for {
+		write, wait, err := c.preparePut(link)
+		switch {
+		case err != nil:
+			return err
+		case wait != nil:
+			<-wait
+		default:
+			return c.appendWrite(ctx, write)
+		}
+	}
+}
+
+func (c *FileStorage) preparePut(link models.Link) (*fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	names := []string{keyName(link.Key), urlName(urlIndex(link.Key, link.OriginalURL))}
+	for _, name := range names {
+		if wait := c.reserved[name]; wait != nil {
+			return nil, wait, nil
+		}
+	}
+	write, err := c.linkWrite([]RowFile{NewRowFile(link)}, nil, func() { c.inmemory.Put(link) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.reserve(write, names...), nil, nil
+}
+
+// SetMetadata appends the link with its metadata under the same version.
+func (c *FileStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	for {
+		write, wait, err := c.prepareSetMetadata(key, url, metadata)
+		switch {
+		case err != nil:
+			return err
+		case wait != nil:
+			<-wait
+		case write == nil:
+			return nil
+		default:
+			return c.appendWrite(ctx, write)
+		}
+	}
+}
+
+func (c *FileStorage) prepareSetMetadata(key string, url string, metadata models.LinkMetadata) (*fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if wait := c.reserved[keyName(key)]; wait != nil {
+		return nil, wait, nil
+	}
+	stored, ok := c.inmemory.Link(key)
+	if !ok {
+		return nil, nil, appErrors.ErrKey
+	}
+	if !fetchedFor(stored, url) {
+		return nil, nil, nil
+	}
+	stored.Metadata = &metadata
+	write, err := c.linkWrite([]RowFile{NewRowFile(stored)}, nil, func() { c.inmemory.Put(stored) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.reserve(write, keyName(key)), nil, nil
+}
+
+// DeleteLink appends the tombstone of the key, which also drops its history
+// and clicks on load.
+func (c *FileStorage) DeleteLink(ctx context.Context, key string) error {
+	for {
+		write, wait, err := c.prepareDelete(ctx, key)
+		switch {
+		case err != nil:
+			return err
+		case wait != nil:
+			<-wait
+		default:
+			return c.appendWrite(ctx, write)
+		}
+	}
+}
+
+func (c *FileStorage) prepareDelete(ctx context.Context, key string) (*fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if wait := c.reserved[keyName(key)]; wait != nil {
+		return nil, wait, nil
+	}
+	if _, ok := c.inmemory.Link(key); !ok {
+		return nil, nil, appErrors.ErrKey
+	}
+	write, err := c.linkWrite([]RowFile{newRemovedRowFile(key)}, audit.Events(ctx, key, ""), func() { c.inmemory.Remove(key) })
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.reserve(write, keyName(key)), nil, nil
+}
+
+// Audit events are rows of the storage file, they are kept in memory like the
+// links.
+func (c *FileStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	data, err := encodeRow(newAuditRowFile(event))
+	if err != nil {
+		return err
+	}
+	return c.appendWrite(ctx, &fileWrite{data: data, rows: 1, apply: func() {
+		c.inmemory.AppendAudit(ctx, event)
+	}})
+}
+
+func (c *FileStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	return c.inmemory.ListAudit(ctx, query, page)
+}
+
+func (c *FileStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.inmemory.IterateAudit(ctx, fn)
+}
+
+func (c *FileStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	return c.inmemory.LinkHistory(ctx, key)
+}
+
+// Clicks are counted in memory and the keys clicked since the last flush
+// are written in one row each by the flush, so a redirect never waits for
+// the file. Clicks of the last interval are lost on a crash.
+func (c *FileStorage) CountClick(ctx context.Context, key string) error {
+	if err := c.inmemory.CountClick(ctx, key); err != nil {
+		return err
+	}
+	c.clickMu.Lock()
+	c.clicked[key] = struct{}{}
+	c.clickMu.Unlock()
+	return nil
+}
+
+func (c *FileStorage) runClickFlush(interval time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.flushClicks()
+			return
+		case <-ticker.C:
+			c.flushClicks()
+		}
+	}
+}
+
+// flushClicks writes the number of clicks of the keys clicked since the last
+// flush. It writes directly, syncing unless in interval mode, since the group
+// commit may already be stopped when the storage closes.
+func (c *FileStorage) flushClicks() {
+	write, keys, err := c.prepareClicks()
+	if err == nil && write != nil {
+		err = c.writeDirect(write, c.syncMode != SyncInterval)
+	}
+	if err != nil {
+		Sugar.Errorln("file storage click flush failed", err)
+		c.clickMu.Lock()
+		for _, key := range keys {
+			c.clicked[key] = struct{}{}
+		}
+		c.clickMu.Unlock()
+	}
+}
+
+// prepareClicks reserves the clicked keys, so a removal of a link is written
+// after its clicks. Keys reserved by another write are left for the next
+// flush and keys of removed links are dropped.
+func (c *FileStorage) prepareClicks() (*fileWrite, []string, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.clickMu.Lock()
+	defer c.clickMu.Unlock()
+	var buf bytes.Buffer
+	var keys, names []string
+	for key := range c.clicked {
+		if c.reserved[keyName(key)] != nil {
+			continue
+		}
+		delete(c.clicked, key)
+		if _, ok := c.inmemory.Link(key); !ok {
+			continue
+		}
+		keys = append(keys, key)
+		names = append(names, keyName(key))
+		clicks, _ := c.inmemory.LinkClicks(context.Background(), key)
+		if err := writeRow(&buf, newClicksRowFile(key, clicks)); err != nil {
+			return nil, keys, err
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+	return c.reserve(&fileWrite{data: buf.Bytes(), rows: len(names), apply: func() {}}, names...), keys, nil
+}
+
+func (c *FileStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	return c.inmemory.LinkClicks(ctx, key)
+}
+
+// API keys are rare and small, so they live in a separate file next to the
+// storage file which is rewritten as a whole on every change.
+func (c *FileStorage) apiKeysFilename() string {
+	return c.filename + ".keys"
+}
+
+func (c *FileStorage) loadAPIKeys() error {
+	data, err := os.ReadFile(c.apiKeysFilename())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rows []RowAPIKey
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := c.inmemory.CreateAPIKey(context.Background(), row.APIKey()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FileStorage) saveAPIKeys(ctx context.Context) error {
+	keys, err := c.inmemory.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	rows := make([]RowAPIKey, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, NewRowAPIKey(key))
+	}
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	tmpName := c.apiKeysFilename() + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fileError(err)
+	}
+	defer os.Remove(tmpName)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fileError(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fileError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fileError(err)
+	}
+	if err := os.Rename(tmpName, c.apiKeysFilename()); err != nil {
+		return fileError(err)
+	}
+	return syncDir(filepath.Dir(c.filename))
+}
+
+func (c *FileStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.inmemory.CreateAPIKey(ctx, key); err != nil {
+		return err
+	}
+	return c.saveAPIKeys(ctx)
+}
+
+func (c *FileStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	return c.inmemory.GetAPIKey(ctx, id)
+}
+
+func (c *FileStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	return c.inmemory.ListAPIKeys(ctx)
+}
+
+func (c *FileStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.inmemory.RevokeAPIKey(ctx, id, at); err != nil {
+		return err
+	}
+	return c.saveAPIKeys(ctx)
+}
+
+func (c *FileStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	return c.inmemory.GetIdempotency(ctx, key)
+}
+
+// SaveIdempotency appends the record to the storage file, compaction drops
+// the records that expired.
+func (c *FileStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	data, err := encodeRow(newIdempotencyRowFile(record))
+	if err != nil {
+		return err
+	}
+	return c.appendWrite(ctx, &fileWrite{data: data, rows: 1, apply: func() {
+		c.inmemory.SaveIdempotency(ctx, record)
+	}})
+}
+
+func (c *FileStorage) Import(ctx context.Context, links []models.Link) error {
+	for {
+		write, wait, err := c.prepareImport(links)
+		switch {
+		case err != nil || write == nil:
+			return err
+		case wait != nil:
+			<-wait
+		default:
+			return c.appendWrite(ctx, write)
+		}
+	}
+}
+
+func (c *FileStorage) prepareImport(links []models.Link) (*fileWrite, chan struct{}, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	var buf bytes.Buffer
+	imported := make([]models.Link, 0, len(links))
+	names := make([]string, 0, len(links))
+	for _, link := range links {
+		if wait := c.reserved[keyName(link.Key)]; wait != nil {
+			return nil, wait, nil
+		}
+		if _, ok := c.inmemory.Link(link.Key); ok || slices.Contains(names, keyName(link.Key)) {
+			continue
+		}
+		if err := writeRow(&buf, NewRowFile(link)); err != nil {
+			return nil, nil, err
+		}
+		imported = append(imported, link)
+		names = append(names, keyName(link.Key))
+	}
+	if len(imported) == 0 {
+		return nil, nil, nil
+	}
+	write := &fileWrite{data: buf.Bytes(), rows: len(imported), apply: func() {
+		for _, link := range imported {
+			c.inmemory.Put(link)
+		}
+	}}
+	return c.reserve(write, names...), nil, nil
+}
+
+func fileError(err error) error {
+	return appErrors.Wrap(appErrors.ErrUnavailable, "storage file", err)
+}
+
+func encodeRow(row RowFile) ([]byte, error) {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func writeRow(w io.Writer, row RowFile) error {
+	data, err := encodeRow(row)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
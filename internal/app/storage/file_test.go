@@ -0,0 +1,504 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func newTestFileStorage(t *testing.T, filename string) *FileStorage {
+	t.Helper()
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", FileStoragePath: filename}
+	fileStorage, err := NewFileStorage(filename, &configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStorage.Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fileStorage.Close() })
+	return fileStorage
+}
+
+func countLines(t *testing.T, filename string) int {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestFileStorage_LoadRecovery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	first := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	key, _ := first.Add(ctx, "https://example.com")
+	first.Close()
+
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0777)
+	file.WriteString("{\"Key\":\"broken\"\n")
+	file.WriteString("{\"Key\":\"abc\",\"Value\":\"https://example.org\",\"Checksum\":\"00000000\"}\n")
+	file.WriteString("{\"Key\":\"torn\",\"Val")
+	file.Close()
+
+	second := newTestFileStorage(t, filename)
+	report := second.Report()
+	if report.Records != 1 {
+		t.Errorf("Expected 1 record, got %d", report.Records)
+	}
+	for _, reason := range []string{skipMalformed, skipChecksum, skipTorn} {
+		if report.Skipped[reason] != 1 {
+			t.Errorf("Expected 1 %s row skipped, got %d", reason, report.Skipped[reason])
+		}
+	}
+	if report.Truncated == 0 {
+		t.Errorf("Expected torn row to be truncated")
+	}
+	if url, err := second.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected https://example.com, got %q, %v", url, err)
+	}
+
+	next, err := second.Add(ctx, "https://example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+	third := newTestFileStorage(t, filename)
+	if url, err := third.Get(ctx, next); err != nil || url != "https://example.net" {
+		t.Errorf("Expected row appended after truncation, got %q, %v", url, err)
+	}
+	if third.Report().Skipped[skipTorn] != 0 {
+		t.Errorf("Expected no torn rows after truncation")
+	}
+}
+
+func TestFileStorage_Compact(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	fileStorage.Add(ctx, "https://example.com")
+	fileStorage.Add(ctx, "https://example.com")
+	fileStorage.Add(ctx, "https://example.org")
+
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0777)
+	file.WriteString("garbage\n")
+	file.Close()
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	if err := fileStorage.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, filename); lines != 2 {
+		t.Errorf("Expected 2 lines after compaction, got %d", lines)
+	}
+	key, _ := fileStorage.Add(ctx, "https://example.net")
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	if report := fileStorage.Report(); report.Records != 3 || len(report.Skipped) != 0 {
+		t.Errorf("Unexpected report after compaction %s", report)
+	}
+	if url, err := fileStorage.Get(ctx, key); err != nil || url != "https://example.net" {
+		t.Errorf("Expected https://example.net, got %q, %v", url, err)
+	}
+}
+
+func TestFileStorage_CompactionInterval(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	fileStorage.Add(context.Background(), "https://example.com")
+	fileStorage.Close()
+	row, _ := os.ReadFile(filename)
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0777)
+	file.Write(row)
+	file.Close()
+
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", FileCompactInterval: 10 * time.Millisecond}
+	fileStorage, err := NewFileStorage(filename, &configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStorage.Load(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countLines(t, filename) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the duplicate row to be compacted in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fileStorage.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStorage_CompactConcurrentWrites(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	key, _ := fileStorage.Add(ctx, "https://example.com")
+	fileStorage.Close()
+	row, _ := os.ReadFile(filename)
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0777)
+	file.Write(row)
+	file.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	snapshot, err := fileStorage.writeSnapshot()
+	if err != nil || snapshot == nil {
+		t.Fatalf("Expected a snapshot, got %v", err)
+	}
+	// Rows appended while the snapshot is written go to the old file and are
+	// carried over when it is replaced.
+	added, _ := fileStorage.Add(ctx, "https://example.org")
+	if err := fileStorage.replaceFile(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, filename); lines != 2 {
+		t.Errorf("Expected 2 lines after compaction, got %d", lines)
+	}
+	last, _ := fileStorage.Add(ctx, "https://example.net")
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	for _, key := range []string{key, added, last} {
+		if _, err := fileStorage.Get(ctx, key); err != nil {
+			t.Errorf("Expected %s to survive compaction, got %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".compact"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no leftover compaction file, got %v", err)
+	}
+}
+
+func TestFileStorage_SyncModes(t *testing.T) {
+	for _, mode := range []string{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(mode, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "storage.txt")
+			configTest := config.Config{
+				ShortAddr:        "http://127.0.0.1:8080",
+				FileSyncMode:     mode,
+				FileSyncInterval: 10 * time.Millisecond,
+			}
+			fileStorage, err := NewFileStorage(filename, &configTest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if _, err := fileStorage.Add(ctx, fmt.Sprintf("https://example.com/%d", i)); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			fileStorage.Close()
+
+			if lines := countLines(t, filename); lines != 50 {
+				t.Errorf("Expected 50 lines, got %d", lines)
+			}
+		})
+	}
+}
+
+func TestFileStorage_FailedWriteNotVisible(t *testing.T) {
+	for _, mode := range []string{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(mode, func(t *testing.T) {
+			configTest := config.Config{
+				ShortAddr:        "http://127.0.0.1:8080",
+				FileSyncMode:     mode,
+				FileSyncInterval: 10 * time.Millisecond,
+			}
+			fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "storage.txt"), &configTest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fileStorage.Close()
+			ctx := context.Background()
+			fileStorage.file.Close()
+
+			url := "https://example.com/lost"
+			if _, err := fileStorage.Add(ctx, url); err == nil {
+				t.Fatal("Expected the write to a closed file to fail")
+			}
+			key, _ := GetURLHash(url)
+			if _, err := fileStorage.Get(ctx, key); err != appErrors.ErrKey {
+				t.Errorf("Expected the failed link to stay invisible, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStorage_WriteAfterClose(t *testing.T) {
+	for _, mode := range []string{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(mode, func(t *testing.T) {
+			configTest := config.Config{
+				ShortAddr:        "http://127.0.0.1:8080",
+				FileSyncMode:     mode,
+				FileSyncInterval: 10 * time.Millisecond,
+			}
+			fileStorage, err := NewFileStorage(filepath.Join(t.TempDir(), "storage.txt"), &configTest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			key, err := fileStorage.Add(ctx, "https://example.com/closed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileStorage.Close()
+
+			done := make(chan error, 2)
+			go func() {
+				_, err := fileStorage.Add(ctx, "https://example.com/after-close")
+				done <- err
+			}()
+			go func() {
+				done <- fileStorage.DeleteLink(ctx, key)
+			}()
+			for i := 0; i < 2; i++ {
+				select {
+				case err := <-done:
+					if !errors.Is(err, appErrors.ErrUnavailable) {
+						t.Errorf("Expected a write after close to be unavailable, got %v", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("Expected a write after close to fail instead of hanging")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFileStorage_Add(b *testing.B) {
+	for _, mode := range []string{SyncAlways, SyncBatch, SyncInterval} {
+		b.Run(mode, func(b *testing.B) {
+			configTest := config.Config{
+				ShortAddr:        "http://127.0.0.1:8080",
+				FileSyncMode:     mode,
+				FileSyncInterval: 100 * time.Millisecond,
+			}
+			fileStorage, err := NewFileStorage(filepath.Join(b.TempDir(), "storage.txt"), &configTest)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fileStorage.Close()
+			ctx := context.Background()
+			var counter atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					url := fmt.Sprintf("https://example.com/%d", counter.Add(1))
+					if _, err := fileStorage.Add(ctx, url); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestFileStorage_LoadLongURLs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	urls := make(map[string]string)
+	for _, size := range []int{1000, 4 * 1024, 64 * 1024} {
+		url := "https://example.com/?q=" + strings.Repeat("a", size)
+		key, err := fileStorage.Add(ctx, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls[key] = url
+	}
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	if report := fileStorage.Report(); report.Records != len(urls) {
+		t.Errorf("Expected %d records, got %s", len(urls), report)
+	}
+	for key, url := range urls {
+		if stored, err := fileStorage.Get(ctx, key); err != nil || stored != url {
+			t.Errorf("Expected url of %d bytes, got %d bytes, %v", len(url), len(stored), err)
+		}
+	}
+}
+
+func TestStorage_MaxURLLength(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", MaxURLLength: 4096}
+	storageTest, err := NewStorage(&configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := storageTest.Add(ctx, "https://example.com/"+strings.Repeat("a", 4000)); err != nil {
+		t.Errorf("Expected url within limit to be stored, got %v", err)
+	}
+	if _, err := storageTest.Add(ctx, "https://example.com/"+strings.Repeat("a", 5000)); err != appErrors.ErrURLTooLong {
+		t.Errorf("Expected ErrURLTooLong, got %v", err)
+	}
+	links := []models.Link{
+		{Key: "short", OriginalURL: "https://example.com/short"},
+		{Key: "long", OriginalURL: "https://example.com/" + strings.Repeat("a", 5000)},
+	}
+	if err := storageTest.Import(ctx, links); !errors.Is(err, appErrors.ErrURLTooLong) {
+		t.Errorf("Expected ErrURLTooLong on import, got %v", err)
+	}
+	if _, err := storageTest.Get(ctx, "short"); err != appErrors.ErrKey {
+		t.Errorf("Expected no link of the rejected batch to be imported, got %v", err)
+	}
+}
+
+func TestFileStorage_IdempotencyPersist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	record := models.IdempotencyRecord{Key: "key", Fingerprint: "fingerprint", Status: 201, ExpiresAt: time.Now().Add(time.Hour).UTC()}
+	expired := models.IdempotencyRecord{Key: "expired", Fingerprint: "fingerprint", Status: 201, ExpiresAt: time.Now().Add(-time.Second).UTC()}
+	for _, r := range []models.IdempotencyRecord{record, expired} {
+		if err := fileStorage.SaveIdempotency(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fileStorage.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, filename); lines != 1 {
+		t.Errorf("Expected compaction to drop the expired record, got %d lines", lines)
+	}
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	stored, err := fileStorage.GetIdempotency(ctx, record.Key)
+	if err != nil || stored.Fingerprint != record.Fingerprint || stored.Status != record.Status {
+		t.Errorf("Expected %+v to survive a restart, got %+v, %v", record, stored, err)
+	}
+	if _, err := fileStorage.GetIdempotency(ctx, expired.Key); !errors.Is(err, appErrors.ErrNotFound) {
+		t.Errorf("Expected expired record to be dropped, got %v", err)
+	}
+}
+
+func TestFileStorage_APIKeysPersist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	key := models.APIKey{ID: "abc", Name: "ci", Owner: "team", Scopes: []string{"read"}, Hash: "hash", CreatedAt: time.Now().UTC()}
+	if err := fileStorage.CreateAPIKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStorage.RevokeAPIKey(ctx, key.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	fileStorage.Close()
+
+	fileStorage = newTestFileStorage(t, filename)
+	stored, err := fileStorage.GetAPIKey(ctx, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash != key.Hash || stored.Owner != key.Owner || stored.RevokedAt == nil {
+		t.Errorf("Expected revoked %+v, got %+v", key, stored)
+	}
+}
+
+func TestFileStorage_LinkChangesPersist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "storage.txt")
+	fileStorage := newTestFileStorage(t, filename)
+	ctx := context.Background()
+	kept, _ := fileStorage.Add(ctx, "https://example.com/kept")
+	removed, _ := fileStorage.Add(ctx, "https://example.com/removed")
+	link, _ := fileStorage.GetLink(ctx, kept)
+	link.UserID = "bob"
+	link.Disabled = true
+	link.OriginalURL = "https://example.com/kept/v2"
+	link.LinkDetails = models.LinkDetails{Title: "Kept", Tags: []string{"a", "b"}, Notes: "second version"}
+	if err := fileStorage.UpdateLink(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	metadata := models.LinkMetadata{Title: "Kept page", Image: "https://example.com/kept.png", FetchedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	if err := fileStorage.SetMetadata(ctx, kept, link.OriginalURL, metadata); err != nil {
+		t.Fatal(err)
+	}
+	removedLink, _ := fileStorage.GetLink(ctx, removed)
+	removedLink.OriginalURL = "https://example.com/removed/v2"
+	if err := fileStorage.UpdateLink(ctx, removedLink); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{kept, kept, removed} {
+		if err := fileStorage.CountClick(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := models.AuditEvent{ID: "delete", Actor: "admin", Action: "delete", Key: removed, Time: time.Now().UTC()}
+	if err := fileStorage.DeleteLink(audit.WithEvents(ctx, deleted), removed); err != nil {
+		t.Fatal(err)
+	}
+	fileStorage.Close()
+
+	for _, compact := range []bool{false, true} {
+		fileStorage = newTestFileStorage(t, filename)
+		if report := fileStorage.Report(); report.Records != 1 || len(report.Skipped) != 0 {
+			t.Errorf("Unexpected report %s", report)
+		}
+		if stored, err := fileStorage.GetLink(ctx, kept); err != nil || stored.UserID != "bob" || !stored.Disabled ||
+			stored.OriginalURL != "https://example.com/kept/v2" || !reflect.DeepEqual(stored.LinkDetails, link.LinkDetails) ||
+			!reflect.DeepEqual(stored.Metadata, &metadata) {
+			t.Errorf("Expected edited disabled link owned by bob, got %+v, %v", stored, err)
+		}
+		if history, err := fileStorage.LinkHistory(ctx, kept); err != nil || len(history) != 1 || history[0].URL != "https://example.com/kept" {
+			t.Errorf("Expected the original url in history, got %+v, %v", history, err)
+		}
+		if clicks, err := fileStorage.LinkClicks(ctx, kept); err != nil || clicks != 2 {
+			t.Errorf("Expected 2 clicks, got %d, %v", clicks, err)
+		}
+		if history, err := fileStorage.LinkHistory(ctx, removed); err != nil || len(history) != 0 {
+			t.Errorf("Expected no history for the removed link, got %+v, %v", history, err)
+		}
+		if key, err := fileStorage.Add(ctx, "https://example.com/kept/v2"); err != nil || key != kept {
+			t.Errorf("Expected edited url to be indexed as %s, got %q, %v", kept, key, err)
+		}
+		if _, err := fileStorage.GetLink(ctx, removed); !errors.Is(err, appErrors.ErrNotFound) {
+			t.Errorf("Expected removed link to be not found, got %v", err)
+		}
+		if page, err := fileStorage.ListAudit(ctx, models.AuditQuery{}, models.PageRequest{}); err != nil ||
+			len(page.Events) != 1 || page.Events[0].ID != "delete" || page.Events[0].Key != removed {
+			t.Errorf("Expected the delete event, got %+v, %v", page, err)
+		}
+		if compact {
+			if lines := countLines(t, filename); lines != 4 {
+				t.Errorf("Expected the link, its history, its clicks and the audit event after compaction, got %d lines", lines)
+			}
+		} else if err := fileStorage.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		fileStorage.Close()
+	}
+}
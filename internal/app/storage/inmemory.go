@@ -1,26 +1,47 @@
 package storage
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
 	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 )
 
 type InmemoryStorage struct {
 	sync.RWMutex
-	links  map[string]string
-	config *config.Config
+	links       map[string]models.Link
+	urls        map[string]string
+	tokens      map[string]map[string]struct{}
+	history     map[string][]models.LinkVersion
+	clicks      map[string]int64
+	idempotency map[string]models.IdempotencyRecord
+	expiries    expiryHeap
+	apiKeys     map[string]models.APIKey
+	audit       []models.AuditEvent
+	config      *config.Config
 }
 
 func NewInmemoryStorage(config *config.Config) *InmemoryStorage {
-	links := make(map[string]string)
+	links := make(map[string]models.Link)
 	return &InmemoryStorage{
-		links:  links,
-		config: config,
+		links:       links,
+		urls:        make(map[string]string),
+		tokens:      make(map[string]map[string]struct{}),
+		history:     make(map[string][]models.LinkVersion),
+		clicks:      make(map[string]int64),
+		idempotency: make(map[string]models.IdempotencyRecord),
+		apiKeys:     make(map[string]models.APIKey),
+		config:      config,
 	}
 }
 
@@ -32,36 +53,160 @@ func (c *InmemoryStorage) Close() error {
 	return nil
 }
 
-func (c *InmemoryStorage) Append(data map[string]string) error {
+func (c *InmemoryStorage) Put(link models.Link) bool {
 	c.Lock()
 	defer c.Unlock()
-	c.links = data
-	return nil
+	return c.put(link)
 }
 
-func (c *InmemoryStorage) Add(ctx context.Context, url string) (string, error) {
+// put stores link, links stored before versions were tracked are version 1.
+func (c *InmemoryStorage) put(link models.Link) bool {
+	if link.Version == 0 {
+		link.Version = 1
+	}
+	stored, exists := c.links[link.Key]
+	if exists {
+		c.unindex(stored)
+	}
+	c.links[link.Key] = link
+	c.urls[urlIndex(link.Key, link.OriginalURL)] = link.Key
+	for _, token := range linkTokens(link) {
+		if c.tokens[token] == nil {
+			c.tokens[token] = make(map[string]struct{})
+		}
+		c.tokens[token][link.Key] = struct{}{}
+	}
+	return exists
+}
+
+func (c *InmemoryStorage) unindex(link models.Link) {
+	if c.urls[urlIndex(link.Key, link.OriginalURL)] == link.Key {
+		delete(c.urls, urlIndex(link.Key, link.OriginalURL))
+	}
+	for _, token := range linkTokens(link) {
+		delete(c.tokens[token], link.Key)
+		if len(c.tokens[token]) == 0 {
+			delete(c.tokens, token)
+		}
+	}
+}
+
+func (c *InmemoryStorage) Link(key string) (models.Link, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	link, ok := c.links[key]
+	return link, ok
+}
+
+// Remove drops the link, its history and clicks.
+func (c *InmemoryStorage) Remove(key string) bool {
 	c.Lock()
 	defer c.Unlock()
+	return c.remove(key)
+}
 
-	key, err := GetURLHash(url)
-	if err != nil {
-		return "", err
+func (c *InmemoryStorage) remove(key string) bool {
+	stored, exists := c.links[key]
+	if exists {
+		c.unindex(stored)
 	}
-	c.links[key] = url
+	delete(c.links, key)
+	delete(c.history, key)
+	delete(c.clicks, key)
+	return exists
+}
 
-	return key, nil
+// KeyFor returns the key of the link pointing to url on domain, or the first
+// free candidate key when there is none.
+func (c *InmemoryStorage) KeyFor(domain string, url string) (string, bool, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.keyFor(domain, url)
+}
+
+func (c *InmemoryStorage) keyFor(domain string, url string) (string, bool, error) {
+	if key, ok := c.urls[domains.IndexKey(domain, url)]; ok {
+		return key, true, nil
+	}
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		key, err := urlKey(domain, url, attempt)
+		if err != nil {
+			return "", false, err
+		}
+		if _, taken := c.links[key]; !taken {
+			return key, false, nil
+		}
+	}
+	return "", false, errNoFreeKey
+}
+
+// URLKey returns the key of the link pointing to url on the domain of the
+// link stored as key.
+func (c *InmemoryStorage) URLKey(key string, url string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	indexed, ok := c.urls[urlIndex(key, url)]
+	return indexed, ok
+}
+
+func (c *InmemoryStorage) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.links)
+}
+
+func (c *InmemoryStorage) Snapshot() []models.Link {
+	c.RLock()
+	links := make([]models.Link, 0, len(c.links))
+	for _, link := range c.links {
+		links = append(links, link)
+	}
+	c.RUnlock()
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.Before(links[j].CreatedAt)
+		}
+		return links[i].Key < links[j].Key
+	})
+	return links
+}
+
+func (c *InmemoryStorage) Add(ctx context.Context, url string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	key, _, err := c.add(ctx, url)
+	return key, err
+}
+
+// add stores a link for url unless there is one, the audit events of ctx are
+// recorded along with a new link.
+func (c *InmemoryStorage) add(ctx context.Context, url string) (string, bool, error) {
+	key, exists, err := c.keyFor(domains.FromContext(ctx), url)
+	if err != nil || exists {
+		return key, false, err
+	}
+	c.put(models.Link{Key: key, OriginalURL: url, UserID: auth.UserID(ctx), CreatedAt: time.Now().UTC()})
+	c.audit = append(c.audit, audit.Events(ctx, key, url)...)
+	return key, true, nil
 }
 
 func (c *InmemoryStorage) Get(ctx context.Context, key string) (string, error) {
 	c.RLock()
 	defer c.RUnlock()
 
-	url, ok := c.links[key]
+	link, ok := c.links[key]
 	if !ok {
 		return "", appErrors.ErrKey
 	}
+	if link.Deleted {
+		return "", appErrors.ErrDeleted
+	}
+	if link.Disabled {
+		return "", appErrors.ErrDisabled
+	}
 
-	return url, nil
+	return link.OriginalURL, nil
 }
 
 func (c *InmemoryStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
@@ -69,16 +214,321 @@ func (c *InmemoryStorage) AddByBatch(ctx context.Context, requestURLs []models.U
 	defer c.Unlock()
 	shortURLs := make([]models.URLRowShort, 0)
 	for _, url := range requestURLs {
-		key, err := GetURLHash(url.OriginalURL)
+		key, created, err := c.add(ctx, url.OriginalURL)
 		if err != nil {
 			return nil, err
 		}
-		c.links[key] = url.OriginalURL
 		shortURL := models.URLRowShort{
 			CorrelationID: url.CorrelationID,
 			ShortURL:      fmt.Sprintf("%s/%s", c.config.ShortAddr, key),
+			Created:       created,
 		}
 		shortURLs = append(shortURLs, shortURL)
 	}
 	return shortURLs, nil
 }
+
+func (c *InmemoryStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	for _, link := range c.Snapshot() {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *InmemoryStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	link, ok := c.Link(key)
+	if !ok {
+		return models.Link{}, appErrors.ErrKey
+	}
+	return link, nil
+}
+
+// UpdateLink replaces the destination, owner and state of an existing link, the
+// key and creation time never change.
+func (c *InmemoryStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	c.Lock()
+	defer c.Unlock()
+	stored, ok := c.links[link.Key]
+	if !ok {
+		return appErrors.ErrKey
+	}
+	if err := checkVersion(stored, link); err != nil {
+		return err
+	}
+	updated := updatedLink(stored, link)
+	if replaced := replacedVersion(stored, updated); replaced != nil {
+		if key, ok := c.urls[urlIndex(link.Key, updated.OriginalURL)]; ok && key != link.Key {
+			return appErrors.ErrURLTaken
+		}
+		c.history[link.Key] = append(c.history[link.Key], *replaced)
+	}
+	c.put(updated)
+	c.audit = append(c.audit, audit.Events(ctx, link.Key, updated.OriginalURL)...)
+	return nil
+}
+
+// PutLink stores link as it is under its key, replacing the stored one.
+func (c *InmemoryStorage) PutLink(ctx context.Context, link models.Link) error {
+	c.Put(link)
+	return nil
+}
+
+// SetMetadata keeps the version of the link, metadata is not an edit of it.
+func (c *InmemoryStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	c.Lock()
+	defer c.Unlock()
+	stored, ok := c.links[key]
+	if !ok {
+		return appErrors.ErrKey
+	}
+	if fetchedFor(stored, url) {
+		stored.Metadata = &metadata
+		c.put(stored)
+	}
+	return nil
+}
+
+func (c *InmemoryStorage) DeleteLink(ctx context.Context, key string) error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.remove(key) {
+		return appErrors.ErrKey
+	}
+	c.audit = append(c.audit, audit.Events(ctx, key, "")...)
+	return nil
+}
+
+func (c *InmemoryStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return slices.Clone(c.history[key]), nil
+}
+
+// AddHistory restores a replaced destination of a loaded link.
+func (c *InmemoryStorage) AddHistory(key string, version models.LinkVersion) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.links[key]; ok {
+		c.history[key] = append(c.history[key], version)
+	}
+}
+
+// ListLinks looks the words of the search up in the token index and only
+// checks the links containing the rarest of them.
+func (c *InmemoryStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	p, err := newPager(query, page)
+	if err != nil {
+		return models.LinkPage{}, err
+	}
+	c.RLock()
+	defer c.RUnlock()
+	candidates := c.links
+	for _, token := range searchTokens(query.Search) {
+		keys := c.tokens[token]
+		if len(keys) < len(candidates) {
+			candidates = make(map[string]models.Link, len(keys))
+			for key := range keys {
+				candidates[key] = c.links[key]
+			}
+		}
+	}
+	for _, link := range candidates {
+		p.add(link)
+	}
+	return p.result(), nil
+}
+
+func (c *InmemoryStorage) CountClick(ctx context.Context, key string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.links[key]; !ok {
+		return appErrors.ErrKey
+	}
+	c.clicks[key]++
+	return nil
+}
+
+// SetClicks restores the click count of a loaded link.
+func (c *InmemoryStorage) SetClicks(key string, clicks int64) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.links[key]; ok {
+		c.clicks[key] = clicks
+	}
+}
+
+func (c *InmemoryStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.clicks[key], nil
+}
+
+func (c *InmemoryStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	c.Lock()
+	defer c.Unlock()
+	c.audit = append(c.audit, event)
+	return nil
+}
+
+// AuditEvents returns the whole audit log.
+func (c *InmemoryStorage) AuditEvents() []models.AuditEvent {
+	c.RLock()
+	defer c.RUnlock()
+	return slices.Clone(c.audit)
+}
+
+// ListAudit starts at the event after the cursor, the sequence number of an
+// event is its position in the log.
+func (c *InmemoryStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	c.RLock()
+	defer c.RUnlock()
+	p, err := newAuditPager(query, page, int64(len(c.audit)))
+	if err != nil {
+		return models.AuditPage{}, err
+	}
+	for i := p.after; i < int64(len(c.audit)); i++ {
+		event := c.audit[i]
+		event.Seq = i + 1
+		if p.add(event) {
+			break
+		}
+	}
+	return p.result(), nil
+}
+
+func (c *InmemoryStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	c.RLock()
+	events := slices.Clone(c.audit)
+	c.RUnlock()
+	for i, event := range events {
+		event.Seq = int64(i) + 1
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *InmemoryStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	c.RLock()
+	defer c.RUnlock()
+	record, ok := c.idempotency[key]
+	if !ok || !record.ExpiresAt.After(time.Now()) {
+		return models.IdempotencyRecord{}, appErrors.ErrKey
+	}
+	return record, nil
+}
+
+// SaveIdempotency drops the records that expired, the expiry heap yields them
+// without looking at the others.
+func (c *InmemoryStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for len(c.expiries) > 0 && !c.expiries[0].expiresAt.After(now) {
+		expired := heap.Pop(&c.expiries).(idempotencyExpiry)
+		if stored, ok := c.idempotency[expired.key]; ok && stored.ExpiresAt.Equal(expired.expiresAt) {
+			delete(c.idempotency, expired.key)
+		}
+	}
+	c.idempotency[record.Key] = record
+	heap.Push(&c.expiries, idempotencyExpiry{key: record.Key, expiresAt: record.ExpiresAt})
+	return nil
+}
+
+// IdempotencyRecords returns the records that have not expired.
+func (c *InmemoryStorage) IdempotencyRecords() []models.IdempotencyRecord {
+	c.RLock()
+	defer c.RUnlock()
+	now := time.Now()
+	records := make([]models.IdempotencyRecord, 0, len(c.idempotency))
+	for _, record := range c.idempotency {
+		if record.ExpiresAt.After(now) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+// idempotencyExpiry is the expiry of the record saved as key. A record saved
+// again leaves its older expiry behind, it is skipped once it is popped.
+type idempotencyExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+type expiryHeap []idempotencyExpiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(idempotencyExpiry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+func (c *InmemoryStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.apiKeys[key.ID]; ok {
+		return appErrors.ErrConflict
+	}
+	c.apiKeys[key.ID] = key
+	return nil
+}
+
+func (c *InmemoryStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	c.RLock()
+	defer c.RUnlock()
+	key, ok := c.apiKeys[id]
+	if !ok {
+		return models.APIKey{}, appErrors.ErrKey
+	}
+	return key, nil
+}
+
+func (c *InmemoryStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	c.RLock()
+	keys := make([]models.APIKey, 0, len(c.apiKeys))
+	for _, key := range c.apiKeys {
+		keys = append(keys, key)
+	}
+	c.RUnlock()
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (c *InmemoryStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	key, ok := c.apiKeys[id]
+	if !ok {
+		return appErrors.ErrKey
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		c.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (c *InmemoryStorage) Import(ctx context.Context, links []models.Link) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, link := range links {
+		if _, ok := c.links[link.Key]; !ok {
+			c.put(link)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,794 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"go.etcd.io/bbolt"
+)
+
+const kvScheme = "kv:"
+
+var (
+	kvLinksBucket       = []byte("links")
+	kvURLsBucket        = []byte("urls")
+	kvIdempotencyBucket = []byte("idempotency")
+	kvAPIKeysBucket     = []byte("api_keys")
+	kvAuditBucket       = []byte("audit")
+	// Keys are the expiry of an idempotency record in big endian nanoseconds
+	// followed by the record key, so expired records come first.
+	kvIdempotencyExpiryBucket = []byte("idempotency_expiry")
+	kvHistoryBucket           = []byte("history")
+	kvCreatedBucket           = []byte("created")
+	kvClicksBucket            = []byte("clicks")
+)
+
+type KVStorage struct {
+	db      *bbolt.DB
+	config  *config.Config
+	clickMu sync.Mutex
+	clicks  map[string]int64
+	done    chan struct{}
+	once    sync.Once
+	workers sync.WaitGroup
+}
+
+type RowKV struct {
+	URL       string               `json:"url"`
+	UserID    string               `json:"user_id,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	Deleted   bool                 `json:"is_deleted,omitempty"`
+	Disabled  bool                 `json:"is_disabled,omitempty"`
+	Title     string               `json:"title,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+	Notes     string               `json:"notes,omitempty"`
+	Metadata  *models.LinkMetadata `json:"metadata,omitempty"`
+	Version   int64                `json:"version,omitempty"`
+}
+
+// Link returns the link stored as key, links stored before versions were
+// tracked are version 1.
+func (r RowKV) Link(key string) models.Link {
+	version := r.Version
+	if version == 0 {
+		version = 1
+	}
+	return models.Link{
+		Key:         key,
+		OriginalURL: r.URL,
+		UserID:      r.UserID,
+		CreatedAt:   r.CreatedAt,
+		Deleted:     r.Deleted,
+		Disabled:    r.Disabled,
+		Version:     version,
+		LinkDetails: models.LinkDetails{Title: r.Title, Tags: r.Tags, Notes: r.Notes},
+		Metadata:    r.Metadata,
+	}
+}
+
+func NewKVStorage(path string, config *config.Config) (*KVStorage, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{kvLinksBucket, kvURLsBucket, kvIdempotencyBucket, kvIdempotencyExpiryBucket, kvAPIKeysBucket, kvAuditBucket, kvHistoryBucket, kvClicksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(kvCreatedBucket) != nil {
+			return nil
+		}
+		// Files written before links were indexed by creation time get the
+		// index on first open.
+		created, err := tx.CreateBucket(kvCreatedBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(kvLinksBucket).ForEach(func(key []byte, data []byte) error {
+			var row RowKV
+			if err := json.Unmarshal(data, &row); err != nil {
+				return err
+			}
+			return created.Put([]byte(positionKey(row.Link(string(key)))), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	kvStorage := &KVStorage{db: db, config: config, clicks: make(map[string]int64), done: make(chan struct{})}
+	kvStorage.workers.Add(1)
+	go kvStorage.runClickFlush(clickFlushInterval)
+	return kvStorage, nil
+}
+
+// kvURLKey is the key of a url index entry. bbolt keys are capped at 32KB, so
+// the index is keyed by the hash of the url instead of the url itself.
+func kvURLKey(index string) []byte {
+	sum := sha256.Sum256([]byte(index))
+	return sum[:]
+}
+
+func expiryKey(record models.IdempotencyRecord) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(record.ExpiresAt.UnixNano()))
+	return append(key, record.Key...)
+}
+
+func (c *KVStorage) Ping(ctx context.Context) error {
+	return kvError(c.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(kvLinksBucket) == nil {
+			return fmt.Errorf("bucket %s not exist", kvLinksBucket)
+		}
+		return nil
+	}))
+}
+
+func (c *KVStorage) Close() error {
+	c.once.Do(func() { close(c.done) })
+	c.workers.Wait()
+	return c.db.Close()
+}
+
+func (c *KVStorage) Add(ctx context.Context, url string) (string, error) {
+	var key string
+	var conflict bool
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		key, conflict, err = c.put(ctx, tx, url)
+		return err
+	})
+	if err != nil {
+		return "", kvError(err)
+	}
+	if conflict {
+		return key, appErrors.ErrConflict
+	}
+	return key, nil
+}
+
+func (c *KVStorage) Get(ctx context.Context, key string) (string, error) {
+	var row RowKV
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(kvLinksBucket).Get([]byte(key))
+		if data == nil {
+			return appErrors.ErrKey
+		}
+		return json.Unmarshal(data, &row)
+	})
+	if err != nil {
+		return "", kvError(err)
+	}
+	if row.Deleted {
+		return "", appErrors.ErrDeleted
+	}
+	if row.Disabled {
+		return "", appErrors.ErrDisabled
+	}
+	return row.URL, nil
+}
+
+func (c *KVStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	shortURLs := make([]models.URLRowShort, 0)
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		for _, url := range requestURLs {
+			key, conflict, err := c.put(ctx, tx, url.OriginalURL)
+			if err != nil {
+				return err
+			}
+			shortURL := models.URLRowShort{
+				CorrelationID: url.CorrelationID,
+				ShortURL:      fmt.Sprintf("%s/%s", c.config.ShortAddr, key),
+				Created:       !conflict,
+			}
+			shortURLs = append(shortURLs, shortURL)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, kvError(err)
+	}
+	return shortURLs, nil
+}
+
+// put stores a link for url unless there is one, the audit events of ctx are
+// stored along with a new link.
+func (c *KVStorage) put(ctx context.Context, tx *bbolt.Tx, url string) (string, bool, error) {
+	domain := domains.FromContext(ctx)
+	urls := tx.Bucket(kvURLsBucket)
+	if key := urls.Get(kvURLKey(domains.IndexKey(domain, url))); key != nil {
+		return string(key), true, nil
+	}
+	key, err := c.freeKey(tx, domain, url)
+	if err != nil {
+		return "", false, err
+	}
+	link := models.Link{Key: key, OriginalURL: url, UserID: auth.UserID(ctx), CreatedAt: time.Now().UTC(), Version: 1}
+	if err := c.putLink(tx, link); err != nil {
+		return "", false, err
+	}
+	return key, false, appendAudit(tx, audit.Events(ctx, key, url))
+}
+
+func (c *KVStorage) freeKey(tx *bbolt.Tx, domain string, url string) (string, error) {
+	links := tx.Bucket(kvLinksBucket)
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		key, err := urlKey(domain, url, attempt)
+		if err != nil {
+			return "", err
+		}
+		if links.Get([]byte(key)) == nil {
+			return key, nil
+		}
+	}
+	return "", errNoFreeKey
+}
+
+func (c *KVStorage) putLink(tx *bbolt.Tx, link models.Link) error {
+	row := RowKV{
+		URL:       link.OriginalURL,
+		UserID:    link.UserID,
+		CreatedAt: link.CreatedAt,
+		Deleted:   link.Deleted,
+		Disabled:  link.Disabled,
+		Title:     link.Title,
+		Tags:      link.Tags,
+		Notes:     link.Notes,
+		Metadata:  link.Metadata,
+		Version:   link.Version,
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(kvLinksBucket).Put([]byte(link.Key), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(kvCreatedBucket).Put([]byte(positionKey(link)), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(kvURLsBucket).Put(kvURLKey(urlIndex(link.Key, link.OriginalURL)), []byte(link.Key))
+}
+
+func (c *KVStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return kvError(c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(kvLinksBucket).ForEach(func(key []byte, data []byte) error {
+			var row RowKV
+			if err := json.Unmarshal(data, &row); err != nil {
+				return err
+			}
+			return fn(row.Link(string(key)))
+		})
+	}))
+}
+
+func (c *KVStorage) Import(ctx context.Context, links []models.Link) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		for _, link := range links {
+			if tx.Bucket(kvLinksBucket).Get([]byte(link.Key)) != nil {
+				continue
+			}
+			if tx.Bucket(kvURLsBucket).Get(kvURLKey(urlIndex(link.Key, link.OriginalURL))) != nil {
+				continue
+			}
+			if err := c.putLink(tx, link); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func (c *KVStorage) getLink(tx *bbolt.Tx, key string) (models.Link, error) {
+	data := tx.Bucket(kvLinksBucket).Get([]byte(key))
+	if data == nil {
+		return models.Link{}, appErrors.ErrKey
+	}
+	var row RowKV
+	if err := json.Unmarshal(data, &row); err != nil {
+		return models.Link{}, err
+	}
+	return row.Link(key), nil
+}
+
+// ListLinks walks the creation time index from the cursor on and stops once
+// the page is full.
+func (c *KVStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	p, err := newPager(query, page)
+	if err != nil {
+		return models.LinkPage{}, err
+	}
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(kvCreatedBucket).Cursor()
+		var position []byte
+		switch {
+		case p.after == nil && page.Descending:
+			position, _ = cursor.Last()
+		case p.after == nil:
+			position, _ = cursor.First()
+		case page.Descending:
+			if position, _ = cursor.Seek([]byte(positionKey(*p.after))); position == nil {
+				position, _ = cursor.Last()
+			} else {
+				position, _ = cursor.Prev()
+			}
+		default:
+			after := []byte(positionKey(*p.after))
+			if position, _ = cursor.Seek(after); bytes.Equal(position, after) {
+				position, _ = cursor.Next()
+			}
+		}
+		for ; position != nil; position = c.step(cursor, page.Descending) {
+			link, err := c.getLink(tx, positionLinkKey(string(position)))
+			if err != nil {
+				return err
+			}
+			if p.add(link) {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return models.LinkPage{}, kvError(err)
+	}
+	return p.result(), nil
+}
+
+func (c *KVStorage) step(cursor *bbolt.Cursor, descending bool) []byte {
+	if descending {
+		position, _ := cursor.Prev()
+		return position
+	}
+	position, _ := cursor.Next()
+	return position
+}
+
+func (c *KVStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	var link models.Link
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		link, err = c.getLink(tx, key)
+		return err
+	})
+	return link, kvError(err)
+}
+
+func (c *KVStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := c.getLink(tx, link.Key)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(stored, link); err != nil {
+			return err
+		}
+		updated := updatedLink(stored, link)
+		if replaced := replacedVersion(stored, updated); replaced != nil {
+			urls := tx.Bucket(kvURLsBucket)
+			if key := urls.Get(kvURLKey(urlIndex(link.Key, updated.OriginalURL))); key != nil && string(key) != link.Key {
+				return appErrors.ErrURLTaken
+			}
+			if string(urls.Get(kvURLKey(urlIndex(link.Key, stored.OriginalURL)))) == link.Key {
+				if err := urls.Delete(kvURLKey(urlIndex(link.Key, stored.OriginalURL))); err != nil {
+					return err
+				}
+			}
+			if err := c.appendHistory(tx, link.Key, *replaced); err != nil {
+				return err
+			}
+		}
+		if err := c.putLink(tx, updated); err != nil {
+			return err
+		}
+		return appendAudit(tx, audit.Events(ctx, link.Key, updated.OriginalURL))
+	}))
+}
+
+// PutLink stores link as it is under its key, replacing the stored one.
+func (c *KVStorage) PutLink(ctx context.Context, link models.Link) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		if stored, err := c.getLink(tx, link.Key); err == nil {
+			urls := tx.Bucket(kvURLsBucket)
+			if string(urls.Get(kvURLKey(urlIndex(link.Key, stored.OriginalURL)))) == link.Key {
+				if err := urls.Delete(kvURLKey(urlIndex(link.Key, stored.OriginalURL))); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket(kvCreatedBucket).Delete([]byte(positionKey(stored))); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, appErrors.ErrNotFound) {
+			return err
+		}
+		return c.putLink(tx, link)
+	}))
+}
+
+// SetMetadata keeps the version of the link, metadata is not an edit of it.
+func (c *KVStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := c.getLink(tx, key)
+		if err != nil || !fetchedFor(stored, url) {
+			return err
+		}
+		stored.Metadata = &metadata
+		return c.putLink(tx, stored)
+	}))
+}
+
+// History entries are keyed by the link key and the bucket sequence, so a
+// prefix scan returns the versions of one link oldest first.
+func historyPrefix(key string) []byte {
+	return []byte(key + "/")
+}
+
+func (c *KVStorage) appendHistory(tx *bbolt.Tx, key string, version models.LinkVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	bucket := tx.Bucket(kvHistoryBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(binary.BigEndian.AppendUint64(historyPrefix(key), seq), data)
+}
+
+func (c *KVStorage) deleteHistory(tx *bbolt.Tx, key string) error {
+	prefix := historyPrefix(key)
+	cursor := tx.Bucket(kvHistoryBucket).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *KVStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	var versions []models.LinkVersion
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		prefix := historyPrefix(key)
+		cursor := tx.Bucket(kvHistoryBucket).Cursor()
+		for k, data := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = cursor.Next() {
+			var version models.LinkVersion
+			if err := json.Unmarshal(data, &version); err != nil {
+				return err
+			}
+			versions = append(versions, version)
+		}
+		return nil
+	})
+	return versions, kvError(err)
+}
+
+func (c *KVStorage) DeleteLink(ctx context.Context, key string) error {
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := c.getLink(tx, key)
+		if err != nil {
+			return err
+		}
+		urls := tx.Bucket(kvURLsBucket)
+		if string(urls.Get(kvURLKey(urlIndex(key, stored.OriginalURL)))) == key {
+			if err := urls.Delete(kvURLKey(urlIndex(key, stored.OriginalURL))); err != nil {
+				return err
+			}
+		}
+		if err := c.deleteHistory(tx, key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(kvCreatedBucket).Delete([]byte(positionKey(stored))); err != nil {
+			return err
+		}
+		if err := tx.Bucket(kvClicksBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(kvLinksBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return appendAudit(tx, audit.Events(ctx, key, ""))
+	})
+	if err != nil {
+		return kvError(err)
+	}
+	c.clickMu.Lock()
+	delete(c.clicks, key)
+	c.clickMu.Unlock()
+	return nil
+}
+
+// Clicks are big endian counters keyed by the link key. Redirects only count
+// in memory, the flush adds the counts to the counters in one transaction.
+// Clicks of the last interval are lost on a crash.
+func (c *KVStorage) CountClick(ctx context.Context, key string) error {
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(kvLinksBucket).Get([]byte(key)) == nil {
+			return appErrors.ErrKey
+		}
+		return nil
+	})
+	if err != nil {
+		return kvError(err)
+	}
+	c.clickMu.Lock()
+	c.clicks[key]++
+	c.clickMu.Unlock()
+	return nil
+}
+
+func (c *KVStorage) runClickFlush(interval time.Duration) {
+	defer c.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.flushClicks()
+			return
+		case <-ticker.C:
+			c.flushClicks()
+		}
+	}
+}
+
+// flushClicks adds the counted clicks to the counters, clicks of links
+// removed meanwhile are dropped. Counts are kept for the next flush when the
+// transaction fails.
+func (c *KVStorage) flushClicks() {
+	c.clickMu.Lock()
+	pending := c.clicks
+	c.clicks = make(map[string]int64)
+	c.clickMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		links, clicks := tx.Bucket(kvLinksBucket), tx.Bucket(kvClicksBucket)
+		for key, count := range pending {
+			if links.Get([]byte(key)) == nil {
+				continue
+			}
+			var counter [8]byte
+			binary.BigEndian.PutUint64(counter[:], uint64(count))
+			if data := clicks.Get([]byte(key)); len(data) == len(counter) {
+				binary.BigEndian.PutUint64(counter[:], binary.BigEndian.Uint64(data)+uint64(count))
+			}
+			if err := clicks.Put([]byte(key), counter[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Sugar.Errorln("kv storage click flush failed", err)
+		c.clickMu.Lock()
+		for key, count := range pending {
+			c.clicks[key] += count
+		}
+		c.clickMu.Unlock()
+	}
+}
+
+// LinkClicks adds the clicks not flushed yet to the stored counter.
+func (c *KVStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	var clicks int64
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		if data := tx.Bucket(kvClicksBucket).Get([]byte(key)); len(data) == 8 {
+			clicks = int64(binary.BigEndian.Uint64(data))
+		}
+		return nil
+	})
+	c.clickMu.Lock()
+	clicks += c.clicks[key]
+	c.clickMu.Unlock()
+	return clicks, kvError(err)
+}
+
+// Audit events are keyed by the bucket sequence, so a cursor returns them in
+// the order they were appended.
+func (c *KVStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		return appendAudit(tx, []models.AuditEvent{event})
+	}))
+}
+
+func appendAudit(tx *bbolt.Tx, events []models.AuditEvent) error {
+	bucket := tx.Bucket(kvAuditBucket)
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(binary.BigEndian.AppendUint64(nil, seq), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListAudit seeks to the event after the cursor, the filters are checked on
+// the events from there on.
+func (c *KVStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	var result models.AuditPage
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(kvAuditBucket)
+		p, err := newAuditPager(query, page, int64(bucket.Sequence()))
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for key, data := cursor.Seek(binary.BigEndian.AppendUint64(nil, uint64(p.after+1))); key != nil; key, data = cursor.Next() {
+			var event models.AuditEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			event.Seq = int64(binary.BigEndian.Uint64(key))
+			if p.add(event) {
+				break
+			}
+		}
+		result = p.result()
+		return nil
+	})
+	return result, kvError(err)
+}
+
+func (c *KVStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return kvError(c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(kvAuditBucket).ForEach(func(key []byte, data []byte) error {
+			var event models.AuditEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			event.Seq = int64(binary.BigEndian.Uint64(key))
+			return fn(event)
+		})
+	}))
+}
+
+func (c *KVStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(kvIdempotencyBucket).Get([]byte(key))
+		if data == nil {
+			return appErrors.ErrKey
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return models.IdempotencyRecord{}, kvError(err)
+	}
+	if !record.ExpiresAt.After(time.Now()) {
+		return models.IdempotencyRecord{}, appErrors.ErrKey
+	}
+	return record, nil
+}
+
+func (c *KVStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(kvIdempotencyBucket)
+		expiries := tx.Bucket(kvIdempotencyExpiryBucket)
+		now := uint64(time.Now().UnixNano())
+		cursor := expiries.Cursor()
+		for key, _ := cursor.First(); key != nil && binary.BigEndian.Uint64(key) <= now; key, _ = cursor.First() {
+			key = bytes.Clone(key)
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			// A record saved again has a later expiry and is kept.
+			var stored models.IdempotencyRecord
+			id := key[8:]
+			if err := json.Unmarshal(bucket.Get(id), &stored); err == nil && bytes.Equal(expiryKey(stored), key) {
+				if err := bucket.Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+		if err := expiries.Put(expiryKey(record), nil); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(record.Key), data)
+	}))
+}
+
+func (c *KVStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	data, err := json.Marshal(NewRowAPIKey(key))
+	if err != nil {
+		return err
+	}
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(kvAPIKeysBucket)
+		if bucket.Get([]byte(key.ID)) != nil {
+			return appErrors.ErrConflict
+		}
+		return bucket.Put([]byte(key.ID), data)
+	}))
+}
+
+func (c *KVStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	var row RowAPIKey
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(kvAPIKeysBucket).Get([]byte(id))
+		if data == nil {
+			return appErrors.ErrKey
+		}
+		return json.Unmarshal(data, &row)
+	})
+	if err != nil {
+		return models.APIKey{}, kvError(err)
+	}
+	return row.APIKey(), nil
+}
+
+func (c *KVStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	keys := make([]models.APIKey, 0)
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(kvAPIKeysBucket).ForEach(func(id []byte, data []byte) error {
+			var row RowAPIKey
+			if err := json.Unmarshal(data, &row); err != nil {
+				return err
+			}
+			keys = append(keys, row.APIKey())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, kvError(err)
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (c *KVStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return kvError(c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(kvAPIKeysBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return appErrors.ErrKey
+		}
+		var row RowAPIKey
+		if err := json.Unmarshal(data, &row); err != nil {
+			return err
+		}
+		if row.RevokedAt != nil {
+			return nil
+		}
+		row.RevokedAt = &at
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	}))
+}
+
+func kvError(err error) error {
+	if errors.Is(err, bbolt.ErrDatabaseNotOpen) || errors.Is(err, bbolt.ErrTimeout) {
+		return appErrors.Wrap(appErrors.ErrUnavailable, "kv storage", err)
+	}
+	return err
+}
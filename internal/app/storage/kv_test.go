@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+func TestKVStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.db")
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080", StorageSpec: kvScheme + path}
+	storageTest, err := NewStorage(&configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	key, err := storageTest.Add(ctx, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflictKey, err := storageTest.Add(ctx, "https://example.com"); err != appErrors.ErrConflict || conflictKey != key {
+		t.Errorf("Expected conflict with key %s, got %s, %v", key, conflictKey, err)
+	}
+	shortURLs, err := storageTest.AddByBatch(ctx, []models.URLRowOriginal{
+		{CorrelationID: "1", OriginalURL: "https://example.com"},
+		{CorrelationID: "2", OriginalURL: "https://example.org"},
+	})
+	if err != nil || len(shortURLs) != 2 {
+		t.Fatalf("Expected 2 short urls, got %v, %v", shortURLs, err)
+	}
+	if _, err := storageTest.Get(ctx, "missing"); err != appErrors.ErrKey {
+		t.Errorf("Expected ErrKey, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := storageTest.CountClick(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storageTest.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewKVStorage(path, &configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Ping(ctx); err != nil {
+		t.Error(err)
+	}
+	orgKey, _ := GetURLHash("https://example.org")
+	for key, want := range map[string]string{key: "https://example.com", orgKey: "https://example.org"} {
+		if url, err := reopened.Get(ctx, key); err != nil || url != want {
+			t.Errorf("Expected %s, got %s, %v", want, url, err)
+		}
+	}
+	if clicks, err := reopened.LinkClicks(ctx, key); err != nil || clicks != 2 {
+		t.Errorf("Expected the clicks to be flushed on close, got %d, %v", clicks, err)
+	}
+}
+
+func TestKVStorage_LongURL(t *testing.T) {
+	kvStorage, err := NewKVStorage(filepath.Join(t.TempDir(), "links.db"), &config.Config{ShortAddr: "http://127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvStorage.Close()
+	ctx := context.Background()
+
+	url := "https://example.com/" + strings.Repeat("a", 64*1024)
+	key, err := kvStorage.Add(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := kvStorage.Add(ctx, url); err != appErrors.ErrConflict || again != key {
+		t.Errorf("Expected conflict with key %s, got %s, %v", key, again, err)
+	}
+	if got, err := kvStorage.Get(ctx, key); err != nil || got != url {
+		t.Errorf("Expected the long url back, got %d bytes, %v", len(got), err)
+	}
+}
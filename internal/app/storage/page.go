@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+var errInvalidCursor error = appErrors.New(appErrors.ErrValidation, "invalid cursor")
+
+// Pages of links are ordered by creation time and key in every backend. A
+// cursor is the position of the last link of a page, so links inserted while
+// paging never shift the following pages.
+type pager struct {
+	query models.LinkQuery
+	page  models.PageRequest
+	limit int
+	after *models.Link
+	links []models.Link
+}
+
+func newPager(query models.LinkQuery, page models.PageRequest) (*pager, error) {
+	p := &pager{query: query, page: page, limit: pageLimit(page.Limit)}
+	if page.Cursor != "" {
+		position, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		p.after = &position
+	}
+	return p, nil
+}
+
+// add collects link when it matches and comes after the cursor, backends
+// visiting links in page order stop once it returns true.
+func (p *pager) add(link models.Link) bool {
+	if matchLink(p.query, link) && (p.after == nil || p.before(*p.after, link)) {
+		p.links = append(p.links, link)
+	}
+	return len(p.links) > p.limit
+}
+
+func (p *pager) before(a models.Link, b models.Link) bool {
+	if p.page.Descending {
+		return linkBefore(b, a)
+	}
+	return linkBefore(a, b)
+}
+
+// result cuts the page, links collected out of order are sorted first.
+func (p *pager) result() models.LinkPage {
+	sort.Slice(p.links, func(i, j int) bool {
+		return p.before(p.links[i], p.links[j])
+	})
+	page := models.LinkPage{Links: p.links}
+	if page.Links == nil {
+		page.Links = make([]models.Link, 0)
+	}
+	if len(p.links) > p.limit {
+		page.Links = p.links[:p.limit]
+		page.NextCursor = encodeCursor(page.Links[p.limit-1])
+	}
+	return page
+}
+
+func pageLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultPageLimit
+	case limit > MaxPageLimit:
+		return MaxPageLimit
+	}
+	return limit
+}
+
+func linkBefore(a models.Link, b models.Link) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Key < b.Key
+}
+
+// matchLink reports whether link is selected by query, deleted links only
+// when the query includes them.
+func matchLink(query models.LinkQuery, link models.Link) bool {
+	switch {
+	case link.Deleted && !query.IncludeDeleted:
+		return false
+	case query.KeyPrefix != "" && !strings.HasPrefix(link.Key, query.KeyPrefix):
+		return false
+	case query.URL != "" && !strings.Contains(strings.ToLower(link.OriginalURL), strings.ToLower(query.URL)):
+		return false
+	case query.Owner != "" && link.UserID != query.Owner:
+		return false
+	case query.Tag != "" && !slices.Contains(link.Tags, query.Tag):
+		return false
+	case !query.CreatedAfter.IsZero() && link.CreatedAt.Before(query.CreatedAfter):
+		return false
+	case !query.CreatedBefore.IsZero() && !link.CreatedAt.Before(query.CreatedBefore):
+		return false
+	}
+	tokens := linkTokens(link)
+	for _, token := range searchTokens(query.Search) {
+		if !slices.Contains(tokens, token) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeCursor(link models.Link) string {
+	position := strconv.FormatInt(link.CreatedAt.UnixNano(), 10) + ":" + link.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+func decodeCursor(cursor string) (models.Link, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.Link{}, errInvalidCursor
+	}
+	nanos, key, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return models.Link{}, errInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return models.Link{}, errInvalidCursor
+	}
+	return models.Link{Key: key, CreatedAt: time.Unix(0, createdAt).UTC()}, nil
+}
+
+// positionKey sorts like linkBefore when compared as bytes, the kv and Redis
+// backends index links by it.
+func positionKey(link models.Link) string {
+	var nanos [8]byte
+	binary.BigEndian.PutUint64(nanos[:], uint64(link.CreatedAt.UnixNano())^1<<63)
+	return fmt.Sprintf("%x", nanos) + link.Key
+}
+
+// positionLinkKey is the key of the link at position.
+func positionLinkKey(position string) string {
+	if len(position) < 16 {
+		return ""
+	}
+	return position[16:]
+}
+
+// Pages of audit events follow the order of the log. A cursor is the sequence
+// number of the last event of a page, a cursor past the end of the log was
+// never handed out and is rejected.
+type auditPager struct {
+	query  models.AuditQuery
+	after  int64
+	limit  int
+	events []models.AuditEvent
+}
+
+func newAuditPager(query models.AuditQuery, page models.PageRequest, last int64) (*auditPager, error) {
+	p := &auditPager{query: query, limit: pageLimit(page.Limit)}
+	if page.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		p.after, err = strconv.ParseInt(string(data), 10, 64)
+		if err != nil || p.after <= 0 || p.after > last {
+			return nil, errInvalidCursor
+		}
+	}
+	return p, nil
+}
+
+// add collects event when it matches, backends visit events in log order
+// after the cursor and stop once it returns true.
+func (p *auditPager) add(event models.AuditEvent) bool {
+	if event.Seq > p.after && matchAudit(p.query, event) {
+		p.events = append(p.events, event)
+	}
+	return len(p.events) > p.limit
+}
+
+func (p *auditPager) result() models.AuditPage {
+	page := models.AuditPage{Events: p.events}
+	if page.Events == nil {
+		page.Events = make([]models.AuditEvent, 0)
+	}
+	if len(p.events) > p.limit {
+		page.Events = p.events[:p.limit]
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(page.Events[p.limit-1].Seq, 10)))
+	}
+	return page
+}
+
+func matchAudit(query models.AuditQuery, event models.AuditEvent) bool {
+	switch {
+	case query.Actor != "" && event.Actor != query.Actor:
+		return false
+	case query.Action != "" && event.Action != query.Action:
+		return false
+	case query.Key != "" && event.Key != query.Key:
+		return false
+	case !query.Since.IsZero() && event.Time.Before(query.Since):
+		return false
+	case !query.Until.IsZero() && !event.Time.Before(query.Until):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,874 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisLinksKey       = "shortener:links"
+	redisURLsKey        = "shortener:urls"
+	redisMetaKey        = "shortener:meta"
+	redisIdempotencyKey = "shortener:idempotency:"
+	redisAPIKeysKey     = "shortener:api_keys"
+	redisAuditKey       = "shortener:audit"
+	redisHistoryKey     = "shortener:history:"
+	redisClicksKey      = "shortener:clicks"
+	// Members are the positionKey of every link, all with score 0 so ranges
+	// by lex walk them in page order.
+	redisCreatedKey = "shortener:created"
+)
+
+const redisScanCount = 1000
+
+// maxWatchAttempts bounds the retries of a transaction whose watched hashes
+// were changed meanwhile, the hashes are shared by all links so any write of
+// another link aborts it.
+const maxWatchAttempts = 16
+
+type RedisStorage struct {
+	client  *redis.Client
+	config  *config.Config
+	indexMu sync.Mutex
+	indexed bool
+}
+
+type RowRedis struct {
+	UserID    string               `json:"user_id,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	Deleted   bool                 `json:"is_deleted,omitempty"`
+	Disabled  bool                 `json:"is_disabled,omitempty"`
+	Title     string               `json:"title,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+	Notes     string               `json:"notes,omitempty"`
+	Metadata  *models.LinkMetadata `json:"metadata,omitempty"`
+	Version   int64                `json:"version,omitempty"`
+}
+
+func newRowRedis(link models.Link) (string, error) {
+	data, err := json.Marshal(RowRedis{
+		UserID:    link.UserID,
+		CreatedAt: link.CreatedAt,
+		Deleted:   link.Deleted,
+		Disabled:  link.Disabled,
+		Title:     link.Title,
+		Tags:      link.Tags,
+		Notes:     link.Notes,
+		Metadata:  link.Metadata,
+		Version:   link.Version,
+	})
+	return string(data), err
+}
+
+// Link returns the link stored as key, links stored before versions were
+// tracked are version 1.
+func (r RowRedis) Link(key string, url string) models.Link {
+	version := r.Version
+	if version == 0 {
+		version = 1
+	}
+	return models.Link{
+		Key:         key,
+		OriginalURL: url,
+		UserID:      r.UserID,
+		CreatedAt:   r.CreatedAt,
+		Deleted:     r.Deleted,
+		Disabled:    r.Disabled,
+		Version:     version,
+		LinkDetails: models.LinkDetails{Title: r.Title, Tags: r.Tags, Notes: r.Notes},
+		Metadata:    r.Metadata,
+	}
+}
+
+func isRedisSpec(spec string) bool {
+	return strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://")
+}
+
+func NewRedisStorage(client *redis.Client, config *config.Config) *RedisStorage {
+	return &RedisStorage{client: client, config: config}
+}
+
+func (c *RedisStorage) Ping(ctx context.Context) error {
+	return redisError(c.client.Ping(ctx).Err())
+}
+
+func (c *RedisStorage) Close() error {
+	return c.client.Close()
+}
+
+// addScript indexes and links every url of a batch in one step, so no url is
+// left indexed without its link and no link without its audit events. ARGV
+// holds the meta and position prefix of the new links, then the index, url,
+// audit events and candidate keys of every url. The events of a created link
+// get its key and an id like audit.CreatedID. The result holds a created flag
+// and the key of every url, the flag is -1 when no candidate key is free.
+var addScript = redis.NewScript(`
+local attempts = tonumber(ARGV[3])
+local result = {}
+local i = 4
+while i <= #ARGV do
+	local index, url, events = ARGV[i], ARGV[i + 1], ARGV[i + 2]
+	local created, key = -1, ''
+	local existing = redis.call('HGET', KEYS[1], index)
+	if existing then
+		created, key = 0, existing
+	else
+		for j = i + 3, i + 2 + attempts do
+			if redis.call('HSETNX', KEYS[2], ARGV[j], url) == 1 then
+				created, key = 1, ARGV[j]
+				redis.call('HSET', KEYS[1], index, key)
+				redis.call('HSET', KEYS[3], key, ARGV[1])
+				redis.call('ZADD', KEYS[4], 0, ARGV[2] .. key)
+				for _, event in ipairs(cjson.decode(events)) do
+					event.id = string.sub(redis.sha1hex(event.id .. ':' .. key), 1, 16)
+					event.key = key
+					redis.call('RPUSH', KEYS[5], cjson.encode(event))
+				end
+				break
+			end
+		end
+	end
+	table.insert(result, created)
+	table.insert(result, key)
+	i = i + 3 + attempts
+end
+return result`)
+
+// addedURL is the outcome of addScript for one url.
+type addedURL struct {
+	key     string
+	created bool
+}
+
+func (c *RedisStorage) add(ctx context.Context, urls []string) ([]addedURL, error) {
+	domain := domains.FromContext(ctx)
+	link := models.Link{UserID: auth.UserID(ctx), CreatedAt: time.Now().UTC(), Version: 1}
+	meta, err := newRowRedis(link)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{meta, positionKey(link), maxKeyAttempts}
+	for _, url := range urls {
+		events := make([]models.AuditEvent, 0)
+		for _, event := range audit.FromContext(ctx) {
+			if event.Key == "" {
+				event.New = url
+				events = append(events, event)
+			}
+		}
+		data, err := json.Marshal(events)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, domains.IndexKey(domain, url), url, data)
+		for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+			key, err := urlKey(domain, url, attempt)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, key)
+		}
+	}
+	keys := []string{redisURLsKey, redisLinksKey, redisMetaKey, redisCreatedKey, redisAuditKey}
+	result, err := addScript.Run(ctx, c.client, keys, args...).Slice()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	added := make([]addedURL, len(urls))
+	for i := range added {
+		created, _ := result[2*i].(int64)
+		if created < 0 {
+			return nil, errNoFreeKey
+		}
+		key, _ := result[2*i+1].(string)
+		added[i] = addedURL{key: key, created: created == 1}
+	}
+	return added, nil
+}
+
+func (c *RedisStorage) Add(ctx context.Context, url string) (string, error) {
+	added, err := c.add(ctx, []string{url})
+	if err != nil {
+		return "", err
+	}
+	if !added[0].created {
+		return added[0].key, appErrors.ErrConflict
+	}
+	return added[0].key, nil
+}
+
+func (c *RedisStorage) Get(ctx context.Context, key string) (string, error) {
+	var urlCmd, metaCmd *redis.StringCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		urlCmd = pipe.HGet(ctx, redisLinksKey, key)
+		metaCmd = pipe.HGet(ctx, redisMetaKey, key)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", redisError(err)
+	}
+	url, err := urlCmd.Result()
+	if err != nil {
+		return "", redisError(err)
+	}
+	if data, err := metaCmd.Result(); err == nil {
+		var row RowRedis
+		if err := json.Unmarshal([]byte(data), &row); err != nil {
+			return "", err
+		}
+		if row.Deleted {
+			return "", appErrors.ErrDeleted
+		}
+		if row.Disabled {
+			return "", appErrors.ErrDisabled
+		}
+	}
+	return url, nil
+}
+
+func (c *RedisStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	urls := make([]string, len(requestURLs))
+	for i, url := range requestURLs {
+		urls[i] = url.OriginalURL
+	}
+	added, err := c.add(ctx, urls)
+	if err != nil {
+		return nil, err
+	}
+
+	shortURLs := make([]models.URLRowShort, 0)
+	for i, url := range requestURLs {
+		shortURL := models.URLRowShort{
+			CorrelationID: url.CorrelationID,
+			ShortURL:      fmt.Sprintf("%s/%s", c.config.ShortAddr, added[i].key),
+			Created:       added[i].created,
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	return shortURLs, nil
+}
+
+func (c *RedisStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	var cursor uint64
+	for {
+		fields, next, err := c.client.HScan(ctx, redisLinksKey, cursor, "*", redisScanCount).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		keys := make([]string, 0, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			keys = append(keys, fields[i])
+		}
+		metas := make([]interface{}, len(keys))
+		if len(keys) > 0 {
+			metas, err = c.client.HMGet(ctx, redisMetaKey, keys...).Result()
+			if err != nil {
+				return redisError(err)
+			}
+		}
+		for i, key := range keys {
+			var row RowRedis
+			if data, ok := metas[i].(string); ok {
+				if err := json.Unmarshal([]byte(data), &row); err != nil {
+					return err
+				}
+			}
+			if err := fn(row.Link(key, fields[2*i+1])); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (c *RedisStorage) Import(ctx context.Context, links []models.Link) error {
+	setCmds := make([]*redis.BoolCmd, len(links))
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, link := range links {
+			setCmds[i] = pipe.HSetNX(ctx, redisLinksKey, link.Key, link.OriginalURL)
+		}
+		return nil
+	})
+	if err != nil {
+		return redisError(err)
+	}
+	_, err = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, link := range links {
+			if !setCmds[i].Val() {
+				continue
+			}
+			meta, err := newRowRedis(link)
+			if err != nil {
+				return err
+			}
+			pipe.HSetNX(ctx, redisURLsKey, urlIndex(link.Key, link.OriginalURL), link.Key)
+			pipe.HSet(ctx, redisMetaKey, link.Key, meta)
+			pipe.ZAdd(ctx, redisCreatedKey, redis.Z{Member: positionKey(link)})
+		}
+		return nil
+	})
+	return redisError(err)
+}
+
+func (c *RedisStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return c.getLink(ctx, c.client, key)
+}
+
+func (c *RedisStorage) getLink(ctx context.Context, client redis.Cmdable, key string) (models.Link, error) {
+	var urlCmd, metaCmd *redis.StringCmd
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		urlCmd = pipe.HGet(ctx, redisLinksKey, key)
+		metaCmd = pipe.HGet(ctx, redisMetaKey, key)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return models.Link{}, redisError(err)
+	}
+	url, err := urlCmd.Result()
+	if err != nil {
+		return models.Link{}, redisError(err)
+	}
+	var row RowRedis
+	if data, err := metaCmd.Result(); err == nil {
+		if err := json.Unmarshal([]byte(data), &row); err != nil {
+			return models.Link{}, err
+		}
+	}
+	return row.Link(key, url), nil
+}
+
+// ListLinks walks the creation time index from the cursor on and stops once
+// the page is full. Unfiltered pages take a single range.
+func (c *RedisStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	p, err := newPager(query, page)
+	if err != nil {
+		return models.LinkPage{}, err
+	}
+	if err := c.indexCreated(ctx); err != nil {
+		return models.LinkPage{}, err
+	}
+	batch := int64(redisScanCount)
+	if query == (models.LinkQuery{}) {
+		batch = int64(p.limit + 1)
+	}
+	from := "-"
+	if page.Descending {
+		from = "+"
+	}
+	if p.after != nil {
+		from = "(" + positionKey(*p.after)
+	}
+	for {
+		var positions []string
+		if page.Descending {
+			positions, err = c.client.ZRevRangeByLex(ctx, redisCreatedKey, &redis.ZRangeBy{Min: "-", Max: from, Count: batch}).Result()
+		} else {
+			positions, err = c.client.ZRangeByLex(ctx, redisCreatedKey, &redis.ZRangeBy{Min: from, Max: "+", Count: batch}).Result()
+		}
+		if err != nil {
+			return models.LinkPage{}, redisError(err)
+		}
+		links, err := c.positionLinks(ctx, positions)
+		if err != nil {
+			return models.LinkPage{}, err
+		}
+		for _, link := range links {
+			if p.add(link) {
+				return p.result(), nil
+			}
+		}
+		if int64(len(positions)) < batch {
+			return p.result(), nil
+		}
+		from = "(" + positions[len(positions)-1]
+	}
+}
+
+// positionLinks reads the links at positions, links deleted since the range
+// was read are left out.
+func (c *RedisStorage) positionLinks(ctx context.Context, positions []string) ([]models.Link, error) {
+	if len(positions) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(positions))
+	for _, position := range positions {
+		keys = append(keys, positionLinkKey(position))
+	}
+	var urlsCmd, metasCmd *redis.SliceCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		urlsCmd = pipe.HMGet(ctx, redisLinksKey, keys...)
+		metasCmd = pipe.HMGet(ctx, redisMetaKey, keys...)
+		return nil
+	})
+	if err != nil {
+		return nil, redisError(err)
+	}
+	links := make([]models.Link, 0, len(keys))
+	for i, key := range keys {
+		url, ok := urlsCmd.Val()[i].(string)
+		if !ok {
+			continue
+		}
+		link := models.Link{Key: key, OriginalURL: url}
+		if data, ok := metasCmd.Val()[i].(string); ok {
+			var row RowRedis
+			if err := json.Unmarshal([]byte(data), &row); err != nil {
+				return nil, err
+			}
+			link = row.Link(key, url)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// indexCreated adds the links stored before the creation time index existed
+// to it, once per process.
+func (c *RedisStorage) indexCreated(ctx context.Context) error {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	if c.indexed {
+		return nil
+	}
+	var linksCmd, indexedCmd *redis.IntCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		linksCmd = pipe.HLen(ctx, redisLinksKey)
+		indexedCmd = pipe.ZCard(ctx, redisCreatedKey)
+		return nil
+	})
+	if err != nil {
+		return redisError(err)
+	}
+	if indexedCmd.Val() < linksCmd.Val() {
+		members := make([]redis.Z, 0, redisScanCount)
+		flush := func() error {
+			if len(members) == 0 {
+				return nil
+			}
+			err := c.client.ZAdd(ctx, redisCreatedKey, members...).Err()
+			members = members[:0]
+			return redisError(err)
+		}
+		err := c.Iterate(ctx, func(link models.Link) error {
+			members = append(members, redis.Z{Member: positionKey(link)})
+			if len(members) == redisScanCount {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	c.indexed = true
+	return nil
+}
+
+// UpdateLink and DeleteLink read and write several hashes, WATCH makes them
+// fail instead of resurrecting a link deleted concurrently.
+func (c *RedisStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	err := c.watch(ctx, func(tx *redis.Tx) error {
+		stored, err := c.getLink(ctx, tx, link.Key)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(stored, link); err != nil {
+			return err
+		}
+		updated := updatedLink(stored, link)
+		meta, err := newRowRedis(updated)
+		if err != nil {
+			return err
+		}
+		events, err := encodeAudit(audit.Events(ctx, link.Key, updated.OriginalURL))
+		if err != nil {
+			return err
+		}
+		replaced := replacedVersion(stored, updated)
+		var indexed, version string
+		if replaced != nil {
+			taken, err := tx.HGet(ctx, redisURLsKey, urlIndex(link.Key, updated.OriginalURL)).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if taken != "" && taken != link.Key {
+				return appErrors.ErrURLTaken
+			}
+			indexed, err = tx.HGet(ctx, redisURLsKey, urlIndex(link.Key, stored.OriginalURL)).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			data, err := json.Marshal(replaced)
+			if err != nil {
+				return err
+			}
+			version = string(data)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisMetaKey, link.Key, meta)
+			if replaced != nil {
+				if indexed == link.Key {
+					pipe.HDel(ctx, redisURLsKey, urlIndex(link.Key, stored.OriginalURL))
+				}
+				pipe.HSet(ctx, redisLinksKey, link.Key, updated.OriginalURL)
+				pipe.HSet(ctx, redisURLsKey, urlIndex(link.Key, updated.OriginalURL), link.Key)
+				pipe.RPush(ctx, redisHistoryKey+link.Key, version)
+			}
+			if len(events) > 0 {
+				pipe.RPush(ctx, redisAuditKey, events...)
+			}
+			return nil
+		})
+		return err
+	}, redisLinksKey, redisMetaKey, redisURLsKey)
+	return redisError(err)
+}
+
+func (c *RedisStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	values, err := c.client.LRange(ctx, redisHistoryKey+key, 0, -1).Result()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	versions := make([]models.LinkVersion, 0, len(values))
+	for _, data := range values {
+		var version models.LinkVersion
+		if err := json.Unmarshal([]byte(data), &version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// PutLink stores link as it is under its key, replacing the stored one.
+func (c *RedisStorage) PutLink(ctx context.Context, link models.Link) error {
+	meta, err := newRowRedis(link)
+	if err != nil {
+		return err
+	}
+	err = c.watch(ctx, func(tx *redis.Tx) error {
+		stored, err := c.getLink(ctx, tx, link.Key)
+		if err != nil && !errors.Is(err, appErrors.ErrNotFound) {
+			return err
+		}
+		exists := err == nil
+		var indexed string
+		if exists {
+			indexed, err = tx.HGet(ctx, redisURLsKey, urlIndex(link.Key, stored.OriginalURL)).Result()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if indexed == link.Key {
+				pipe.HDel(ctx, redisURLsKey, urlIndex(link.Key, stored.OriginalURL))
+			}
+			if exists {
+				pipe.ZRem(ctx, redisCreatedKey, positionKey(stored))
+			}
+			pipe.HSet(ctx, redisLinksKey, link.Key, link.OriginalURL)
+			pipe.HSet(ctx, redisMetaKey, link.Key, meta)
+			pipe.HSet(ctx, redisURLsKey, urlIndex(link.Key, link.OriginalURL), link.Key)
+			pipe.ZAdd(ctx, redisCreatedKey, redis.Z{Member: positionKey(link)})
+			return nil
+		})
+		return err
+	}, redisLinksKey, redisMetaKey, redisURLsKey)
+	return redisError(err)
+}
+
+// SetMetadata only rewrites the meta hash and keeps the version of the link,
+// metadata is not an edit of it.
+func (c *RedisStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	err := c.watch(ctx, func(tx *redis.Tx) error {
+		stored, err := c.getLink(ctx, tx, key)
+		if err != nil || !fetchedFor(stored, url) {
+			return err
+		}
+		stored.Metadata = &metadata
+		meta, err := newRowRedis(stored)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisMetaKey, key, meta)
+			return nil
+		})
+		return err
+	}, redisLinksKey, redisMetaKey)
+	return redisError(err)
+}
+
+func (c *RedisStorage) DeleteLink(ctx context.Context, key string) error {
+	err := c.watch(ctx, func(tx *redis.Tx) error {
+		stored, err := c.getLink(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		indexed, err := tx.HGet(ctx, redisURLsKey, urlIndex(key, stored.OriginalURL)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		events, err := encodeAudit(audit.Events(ctx, key, ""))
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, redisLinksKey, key)
+			pipe.HDel(ctx, redisMetaKey, key)
+			pipe.Del(ctx, redisHistoryKey+key)
+			pipe.HDel(ctx, redisClicksKey, key)
+			pipe.ZRem(ctx, redisCreatedKey, positionKey(stored))
+			if indexed == key {
+				pipe.HDel(ctx, redisURLsKey, urlIndex(key, stored.OriginalURL))
+			}
+			if len(events) > 0 {
+				pipe.RPush(ctx, redisAuditKey, events...)
+			}
+			return nil
+		})
+		return err
+	}, redisLinksKey, redisMetaKey, redisURLsKey)
+	return redisError(err)
+}
+
+// countClickScript only counts clicks of existing links, so a click racing
+// the deletion of its link leaves no counter behind.
+var countClickScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+return redis.call('HINCRBY', KEYS[2], ARGV[1], 1)`)
+
+func (c *RedisStorage) CountClick(ctx context.Context, key string) error {
+	clicks, err := countClickScript.Run(ctx, c.client, []string{redisLinksKey, redisClicksKey}, key).Int64()
+	if err != nil {
+		return redisError(err)
+	}
+	if clicks < 0 {
+		return appErrors.ErrKey
+	}
+	return nil
+}
+
+func (c *RedisStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	clicks, err := c.client.HGet(ctx, redisClicksKey, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return clicks, redisError(err)
+}
+
+func (c *RedisStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return redisError(c.client.RPush(ctx, redisAuditKey, data).Err())
+}
+
+// encodeAudit encodes events for an RPUSH in the transaction of the change
+// they describe.
+func encodeAudit(events []models.AuditEvent) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+// ListAudit reads the audit list from the event after the cursor, the
+// sequence number of an event is its position in the list.
+func (c *RedisStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	last, err := c.client.LLen(ctx, redisAuditKey).Result()
+	if err != nil {
+		return models.AuditPage{}, redisError(err)
+	}
+	p, err := newAuditPager(query, page, last)
+	if err != nil {
+		return models.AuditPage{}, err
+	}
+	err = c.scanAudit(ctx, p.after, func(event models.AuditEvent) error {
+		if p.add(event) {
+			return errPageFull
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return models.AuditPage{}, err
+	}
+	return p.result(), nil
+}
+
+var errPageFull = errors.New("page is full")
+
+func (c *RedisStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.scanAudit(ctx, 0, fn)
+}
+
+// scanAudit calls fn for the events after the first skip ones.
+func (c *RedisStorage) scanAudit(ctx context.Context, skip int64, fn func(models.AuditEvent) error) error {
+	for start := skip; ; start += redisScanCount {
+		values, err := c.client.LRange(ctx, redisAuditKey, start, start+redisScanCount-1).Result()
+		if err != nil {
+			return redisError(err)
+		}
+		for i, data := range values {
+			var event models.AuditEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return err
+			}
+			event.Seq = start + int64(i) + 1
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		if len(values) < redisScanCount {
+			return nil
+		}
+	}
+}
+
+func (c *RedisStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	data, err := c.client.Get(ctx, redisIdempotencyKey+key).Bytes()
+	if err != nil {
+		return models.IdempotencyRecord{}, redisError(err)
+	}
+	var record models.IdempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return models.IdempotencyRecord{}, err
+	}
+	if !record.ExpiresAt.After(time.Now()) {
+		return models.IdempotencyRecord{}, appErrors.ErrKey
+	}
+	return record, nil
+}
+
+func (c *RedisStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(record.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return redisError(c.client.Set(ctx, redisIdempotencyKey+record.Key, data, ttl).Err())
+}
+
+func (c *RedisStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	data, err := json.Marshal(NewRowAPIKey(key))
+	if err != nil {
+		return err
+	}
+	created, err := c.client.HSetNX(ctx, redisAPIKeysKey, key.ID, data).Result()
+	if err != nil {
+		return redisError(err)
+	}
+	if !created {
+		return appErrors.ErrConflict
+	}
+	return nil
+}
+
+func (c *RedisStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	data, err := c.client.HGet(ctx, redisAPIKeysKey, id).Bytes()
+	if err != nil {
+		return models.APIKey{}, redisError(err)
+	}
+	var row RowAPIKey
+	if err := json.Unmarshal(data, &row); err != nil {
+		return models.APIKey{}, err
+	}
+	return row.APIKey(), nil
+}
+
+func (c *RedisStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	values, err := c.client.HVals(ctx, redisAPIKeysKey).Result()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	keys := make([]models.APIKey, 0, len(values))
+	for _, data := range values {
+		var row RowAPIKey
+		if err := json.Unmarshal([]byte(data), &row); err != nil {
+			return nil, err
+		}
+		keys = append(keys, row.APIKey())
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+// RevokeAPIKey is a read-modify-write of a single hash field guarded by WATCH,
+// so concurrent revocations of the same key cannot lose each other's update.
+func (c *RedisStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	err := c.watch(ctx, func(tx *redis.Tx) error {
+		key, err := c.GetAPIKey(ctx, id)
+		if err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		key.RevokedAt = &at
+		data, err := json.Marshal(NewRowAPIKey(key))
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, redisAPIKeysKey, id, data)
+			return nil
+		})
+		return err
+	}, redisAPIKeysKey)
+	return redisError(err)
+}
+
+// watch runs fn in a transaction watching keys again while other writes
+// abort it. The version of a link is checked by fn on every attempt.
+func (c *RedisStorage) watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < maxWatchAttempts; attempt++ {
+		err := c.client.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return appErrors.Wrap(appErrors.ErrUnavailable, "redis", redis.TxFailedErr)
+}
+
+func redisError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, redis.Nil):
+		return appErrors.ErrKey
+	case errors.Is(err, redis.ErrClosed), errors.Is(err, io.EOF), errors.As(err, &netErr):
+		return appErrors.Wrap(appErrors.ErrUnavailable, "redis", err)
+	}
+	return err
+}
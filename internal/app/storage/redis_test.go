@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStorage(t *testing.T) {
+	server := miniredis.RunT(t)
+	configTest := config.Config{
+		ShortAddr:   "http://127.0.0.1:8080",
+		StorageSpec: fmt.Sprintf("redis://%s/0", server.Addr()),
+	}
+	storageTest, err := NewStorage(&configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storageTest.Close()
+	ctx := context.Background()
+
+	if err := storageTest.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key, err := storageTest.Add(ctx, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflictKey, err := storageTest.Add(ctx, "https://example.com"); err != appErrors.ErrConflict || conflictKey != key {
+		t.Errorf("Expected conflict with key %s, got %s, %v", key, conflictKey, err)
+	}
+	if url, err := storageTest.Get(ctx, key); err != nil || url != "https://example.com" {
+		t.Errorf("Expected https://example.com, got %s, %v", url, err)
+	}
+	if _, err := storageTest.Get(ctx, "missing"); err != appErrors.ErrKey {
+		t.Errorf("Expected ErrKey, got %v", err)
+	}
+
+	orgKey, _ := GetURLHash("https://example.org")
+	shortURLs, err := storageTest.AddByBatch(ctx, []models.URLRowOriginal{
+		{CorrelationID: "1", OriginalURL: "https://example.com"},
+		{CorrelationID: "2", OriginalURL: "https://example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []models.URLRowShort{
+		{CorrelationID: "1", ShortURL: configTest.ShortAddr + "/" + key},
+		{CorrelationID: "2", ShortURL: configTest.ShortAddr + "/" + orgKey, Created: true},
+	}
+	for i := range expected {
+		if shortURLs[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], shortURLs[i])
+		}
+	}
+	if url := server.HGet(redisLinksKey, orgKey); url != "https://example.org" {
+		t.Errorf("Expected batch url to be stored, got %q", url)
+	}
+}
+
+func TestRedisStorage_ImportIterate(t *testing.T) {
+	server := miniredis.RunT(t)
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	storageTest := NewRedisStorage(redis.NewClient(&redis.Options{Addr: server.Addr()}), &configTest)
+	defer storageTest.Close()
+	ctx := context.Background()
+
+	links := []models.Link{
+		{Key: "abc", OriginalURL: "https://example.com", UserID: "user", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Version: 1},
+		{Key: "def", OriginalURL: "https://example.org", Deleted: true, Version: 1},
+	}
+	for i := 0; i < 2; i++ {
+		if err := storageTest.Import(ctx, links); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(map[string]models.Link)
+	err := storageTest.Iterate(ctx, func(link models.Link) error {
+		got[link.Key] = link
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(links) {
+		t.Fatalf("Expected %d links, got %d", len(links), len(got))
+	}
+	for _, link := range links {
+		if !reflect.DeepEqual(got[link.Key], link) {
+			t.Errorf("Expected %+v, got %+v", link, got[link.Key])
+		}
+	}
+	if key := server.HGet(redisURLsKey, "https://example.org"); key != "def" {
+		t.Errorf("Expected url index to point to def, got %q", key)
+	}
+}
+
+func TestRedisStorage_ListLinksIndexesExistingLinks(t *testing.T) {
+	server := miniredis.RunT(t)
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	ctx := context.Background()
+	server.HSet(redisLinksKey, "old", "https://example.com/old")
+	server.HSet(redisMetaKey, "old", `{"created_at":"2020-01-01T00:00:00Z"}`)
+	server.HSet(redisLinksKey, "bare", "https://example.com/bare")
+	storageTest := NewRedisStorage(redis.NewClient(&redis.Options{Addr: server.Addr()}), &configTest)
+	defer storageTest.Close()
+	key, err := storageTest.Add(ctx, "https://example.com/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := storageTest.ListLinks(ctx, models.LinkQuery{}, models.PageRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(page.Links))
+	for _, link := range page.Links {
+		keys = append(keys, link.Key)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint([]string{"bare", "old", key}) {
+		t.Errorf("Expected links without an index entry to be indexed, got %v", keys)
+	}
+	if err := storageTest.DeleteLink(ctx, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := server.ZMembers(redisCreatedKey); len(members) != 2 {
+		t.Errorf("Expected the deleted link to leave the index, got %v", members)
+	}
+}
+
+func TestRedisStorage_ConcurrentLinkChanges(t *testing.T) {
+	server := miniredis.RunT(t)
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	storageTest := NewRedisStorage(redis.NewClient(&redis.Options{Addr: server.Addr()}), &configTest)
+	defer storageTest.Close()
+	ctx := context.Background()
+
+	links := make([]models.Link, 8)
+	for i := range links {
+		key, err := storageTest.Add(ctx, fmt.Sprintf("https://example.com/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links[i], _ = storageTest.GetLink(ctx, key)
+	}
+	// Changes of other links abort the watched transactions, they are
+	// retried instead of failing as stale or unexpected.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(links)*2)
+	for i, link := range links {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs <- storageTest.DeleteLink(ctx, link.Key)
+				return
+			}
+			link.Disabled = true
+			errs <- storageTest.UpdateLink(ctx, link)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := storageTest.Add(ctx, fmt.Sprintf("https://example.org/%d", i))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected concurrent changes of other links to succeed, got %v", err)
+		}
+	}
+}
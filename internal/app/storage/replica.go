@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = time.Second
+)
+
+type replica struct {
+	db      *sqlx.DB
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over the healthy replicas. Owners who wrote within
+// the window read from the primary, so they see their own changes.
+type replicaSet struct {
+	sync.Mutex
+	replicas []*replica
+	next     atomic.Uint64
+	window   time.Duration
+	written  map[string]time.Time
+}
+
+func newReplicaSet(dbs []*sqlx.DB, window time.Duration) *replicaSet {
+	replicas := make([]*replica, 0, len(dbs))
+	for _, db := range dbs {
+		r := &replica{db: db}
+		r.healthy.Store(true)
+		replicas = append(replicas, r)
+	}
+	return &replicaSet{replicas: replicas, window: window, written: make(map[string]time.Time)}
+}
+
+func (c *replicaSet) pick(owner string) *replica {
+	if owner != "" && c.recentlyWritten(owner) {
+		return nil
+	}
+	start := c.next.Add(1)
+	for i := range c.replicas {
+		r := c.replicas[(int(start)+i)%len(c.replicas)]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (c *replicaSet) markWritten(owner string) {
+	if c.window <= 0 || owner == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.written[owner] = time.Now().Add(c.window)
+}
+
+func (c *replicaSet) recentlyWritten(owner string) bool {
+	c.Lock()
+	defer c.Unlock()
+	expires, ok := c.written[owner]
+	return ok && time.Now().Before(expires)
+}
+
+func (c *replicaSet) check(ctx context.Context) {
+	for _, r := range c.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+		if healthy := err == nil; r.healthy.Swap(healthy) != healthy {
+			Sugar.Infoln("database replica healthy", healthy, err)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for owner, expires := range c.written {
+		if now.After(expires) {
+			delete(c.written, owner)
+		}
+	}
+}
+
+func (c *replicaSet) failed(r *replica, err error) {
+	if r.healthy.Swap(false) {
+		Sugar.Warnln("database replica failed, falling back to primary", err)
+	}
+}
+
+func (c *replicaSet) Close() error {
+	errs := make([]error, 0, len(c.replicas))
+	for _, r := range c.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+const retryBaseDelay = 50 * time.Millisecond
+
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	lastErr   error
+	probing   bool
+}
+
+// ResilientStorage counts clicks behind a breaker of their own, so failing
+// click writes never open the breaker of the redirect lookups.
+type ResilientStorage struct {
+	storage      StorageExpected
+	retries      int
+	baseDelay    time.Duration
+	breaker      *breaker
+	clickBreaker *breaker
+}
+
+func NewResilientStorage(storage StorageExpected, config *config.Config) *ResilientStorage {
+	return &ResilientStorage{
+		storage:      storage,
+		retries:      config.StorageRetries,
+		baseDelay:    retryBaseDelay,
+		breaker:      newBreaker(config),
+		clickBreaker: newBreaker(config),
+	}
+}
+
+func newBreaker(config *config.Config) *breaker {
+	return &breaker{
+		threshold: config.BreakerThreshold,
+		cooldown:  config.BreakerCooldown,
+		state:     breakerClosed,
+	}
+}
+
+func (c *ResilientStorage) Ping(ctx context.Context) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.Ping(ctx)
+	})
+}
+
+func (c *ResilientStorage) Close() error {
+	return c.storage.Close()
+}
+
+func (c *ResilientStorage) Add(ctx context.Context, url string) (string, error) {
+	var key string
+	err := c.call(ctx, false, func() error {
+		var err error
+		key, err = c.storage.Add(ctx, url)
+		return err
+	})
+	return key, err
+}
+
+func (c *ResilientStorage) Get(ctx context.Context, key string) (string, error) {
+	var url string
+	err := c.call(ctx, true, func() error {
+		var err error
+		url, err = c.storage.Get(ctx, key)
+		return err
+	})
+	return url, err
+}
+
+func (c *ResilientStorage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	var shortURLs []models.URLRowShort
+	err := c.call(ctx, false, func() error {
+		var err error
+		shortURLs, err = c.storage.AddByBatch(ctx, requestURLs)
+		return err
+	})
+	return shortURLs, err
+}
+
+func (c *ResilientStorage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.Iterate(ctx, fn)
+	})
+}
+
+func (c *ResilientStorage) Import(ctx context.Context, links []models.Link) error {
+	return c.call(ctx, true, func() error {
+		return c.storage.Import(ctx, links)
+	})
+}
+
+func (c *ResilientStorage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	var link models.Link
+	err := c.call(ctx, true, func() error {
+		var err error
+		link, err = c.storage.GetLink(ctx, key)
+		return err
+	})
+	return link, err
+}
+
+// UpdateLink is not retried, a retry of an update whose commit went through
+// would fail on the version it bumped or record its history twice.
+func (c *ResilientStorage) UpdateLink(ctx context.Context, link models.Link) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.UpdateLink(ctx, link)
+	})
+}
+
+func (c *ResilientStorage) PutLink(ctx context.Context, link models.Link) error {
+	return c.call(ctx, true, func() error {
+		return c.storage.PutLink(ctx, link)
+	})
+}
+
+func (c *ResilientStorage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	return c.call(ctx, true, func() error {
+		return c.storage.SetMetadata(ctx, key, url, metadata)
+	})
+}
+
+func (c *ResilientStorage) DeleteLink(ctx context.Context, key string) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.DeleteLink(ctx, key)
+	})
+}
+
+func (c *ResilientStorage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	var versions []models.LinkVersion
+	err := c.call(ctx, true, func() error {
+		var err error
+		versions, err = c.storage.LinkHistory(ctx, key)
+		return err
+	})
+	return versions, err
+}
+
+func (c *ResilientStorage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	var result models.LinkPage
+	err := c.call(ctx, true, func() error {
+		var err error
+		result, err = c.storage.ListLinks(ctx, query, page)
+		return err
+	})
+	return result, err
+}
+
+func (c *ResilientStorage) CountClick(ctx context.Context, key string) error {
+	return c.callWith(ctx, c.clickBreaker, false, func() error {
+		return c.storage.CountClick(ctx, key)
+	})
+}
+
+func (c *ResilientStorage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	var clicks int64
+	err := c.call(ctx, true, func() error {
+		var err error
+		clicks, err = c.storage.LinkClicks(ctx, key)
+		return err
+	})
+	return clicks, err
+}
+
+func (c *ResilientStorage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.AppendAudit(ctx, event)
+	})
+}
+
+func (c *ResilientStorage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.IterateAudit(ctx, fn)
+	})
+}
+
+func (c *ResilientStorage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	var result models.AuditPage
+	err := c.call(ctx, true, func() error {
+		var err error
+		result, err = c.storage.ListAudit(ctx, query, page)
+		return err
+	})
+	return result, err
+}
+
+func (c *ResilientStorage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := c.call(ctx, true, func() error {
+		var err error
+		record, err = c.storage.GetIdempotency(ctx, key)
+		return err
+	})
+	return record, err
+}
+
+func (c *ResilientStorage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	return c.call(ctx, true, func() error {
+		return c.storage.SaveIdempotency(ctx, record)
+	})
+}
+
+func (c *ResilientStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	return c.call(ctx, false, func() error {
+		return c.storage.CreateAPIKey(ctx, key)
+	})
+}
+
+func (c *ResilientStorage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	var key models.APIKey
+	err := c.call(ctx, true, func() error {
+		var err error
+		key, err = c.storage.GetAPIKey(ctx, id)
+		return err
+	})
+	return key, err
+}
+
+func (c *ResilientStorage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := c.call(ctx, true, func() error {
+		var err error
+		keys, err = c.storage.ListAPIKeys(ctx)
+		return err
+	})
+	return keys, err
+}
+
+func (c *ResilientStorage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return c.call(ctx, true, func() error {
+		return c.storage.RevokeAPIKey(ctx, id, at)
+	})
+}
+
+// Health reports the breaker of the storage calls, a click breaker that is not
+// closed only degrades the storage as redirects keep working.
+func (c *ResilientStorage) Health() models.Health {
+	c.clickBreaker.Lock()
+	clickState := c.clickBreaker.state
+	c.clickBreaker.Unlock()
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+	health := models.Health{
+		Status:              models.HealthOK,
+		Breaker:             c.breaker.state,
+		ClickBreaker:        clickState,
+		ConsecutiveFailures: c.breaker.failures,
+	}
+	if c.breaker.lastErr != nil {
+		health.LastError = c.breaker.lastErr.Error()
+	}
+	switch {
+	case c.breaker.state == breakerOpen:
+		health.Status = models.HealthUnavailable
+		health.RetryAt = c.breaker.openedAt.Add(c.breaker.cooldown).UTC().Format(time.RFC3339)
+	case c.breaker.state == breakerHalfOpen || c.breaker.failures > 0 || clickState != breakerClosed:
+		health.Status = models.HealthDegraded
+	}
+	return health
+}
+
+func (c *ResilientStorage) call(ctx context.Context, idempotent bool, fn func() error) error {
+	return c.callWith(ctx, c.breaker, idempotent, fn)
+}
+
+func (c *ResilientStorage) callWith(ctx context.Context, b *breaker, idempotent bool, fn func() error) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := c.wait(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		if err := b.allow(); err != nil {
+			return err
+		}
+		err = fn()
+		b.record(err)
+		if !isRetryable(err) {
+			return err
+		}
+	}
+	if errors.Is(err, appErrors.ErrUnavailable) {
+		return err
+	}
+	return appErrors.Wrap(appErrors.ErrUnavailable, "storage", err)
+}
+
+func (c *ResilientStorage) wait(ctx context.Context, attempt int) error {
+	delay := c.baseDelay << (attempt - 1)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return appErrors.ErrUnavailable
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+	case breakerHalfOpen:
+		if b.probing {
+			return appErrors.ErrUnavailable
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *breaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if !isFailure(err) {
+		b.failures = 0
+		b.state = breakerClosed
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.threshold > 0 && (b.state == breakerHalfOpen || b.failures >= b.threshold) {
+		if b.state != breakerOpen {
+			Sugar.Warnln("storage circuit breaker opened after", b.failures, "failures:", err)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func isFailure(err error) bool {
+	return isRetryable(err) || errors.Is(err, appErrors.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), strings.HasPrefix(pgErr.Code, "53"):
+			return true
+		}
+		switch pgErr.Code {
+		case pgerrcode.SerializationFailure, pgerrcode.DeadlockDetected,
+			pgerrcode.AdminShutdown, pgerrcode.CrashShutdown, pgerrcode.CannotConnectNow:
+			return true
+		}
+		return false
+	}
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
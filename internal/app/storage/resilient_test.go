@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+type flakyStorage struct {
+	*InmemoryStorage
+	failures int
+	calls    int
+	err      error
+	clickErr error
+}
+
+func (c *flakyStorage) CountClick(ctx context.Context, key string) error {
+	if c.clickErr != nil {
+		return c.clickErr
+	}
+	return c.InmemoryStorage.CountClick(ctx, key)
+}
+
+func (c *flakyStorage) Get(ctx context.Context, key string) (string, error) {
+	c.calls++
+	if c.failures > 0 {
+		c.failures--
+		return "", c.err
+	}
+	return c.InmemoryStorage.Get(ctx, key)
+}
+
+func newTestResilientStorage(failures int, err error) (*ResilientStorage, *flakyStorage) {
+	configTest := config.Config{
+		ShortAddr:        "http://127.0.0.1:8080",
+		StorageRetries:   2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  50 * time.Millisecond,
+	}
+	backend := &flakyStorage{InmemoryStorage: NewInmemoryStorage(&configTest), failures: failures, err: err}
+	backend.Put(models.Link{Key: "abc", OriginalURL: "https://example.com"})
+	resilient := NewResilientStorage(backend, &configTest)
+	resilient.baseDelay = time.Millisecond
+	return resilient, backend
+}
+
+func TestResilientStorage_Retry(t *testing.T) {
+	resilient, backend := newTestResilientStorage(2, &pgconn.PgError{Code: pgerrcode.ConnectionFailure})
+	ctx := context.Background()
+
+	if url, err := resilient.Get(ctx, "abc"); err != nil || url != "https://example.com" {
+		t.Errorf("Expected retried read to succeed, got %q, %v", url, err)
+	}
+	if backend.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", backend.calls)
+	}
+	if health := resilient.Health(); health.Status != models.HealthOK {
+		t.Errorf("Expected healthy storage, got %+v", health)
+	}
+
+	resilient, backend = newTestResilientStorage(1, &pgconn.PgError{Code: pgerrcode.UniqueViolation})
+	if _, err := resilient.Get(ctx, "abc"); err == nil {
+		t.Errorf("Expected non-retryable error to be returned")
+	}
+	if backend.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", backend.calls)
+	}
+}
+
+func TestResilientStorage_Breaker(t *testing.T) {
+	resilient, backend := newTestResilientStorage(100, &pgconn.PgError{Code: pgerrcode.AdminShutdown})
+	ctx := context.Background()
+
+	resilient.Get(ctx, "abc")
+	resilient.Get(ctx, "abc")
+	if backend.calls != 3 {
+		t.Errorf("Expected breaker to open after 3 calls, got %d", backend.calls)
+	}
+	if _, err := resilient.Get(ctx, "abc"); err != appErrors.ErrUnavailable {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+	if health := resilient.Health(); health.Status != models.HealthUnavailable || health.Breaker != breakerOpen {
+		t.Errorf("Expected open breaker, got %+v", health)
+	}
+
+	backend.failures = 0
+	time.Sleep(60 * time.Millisecond)
+	if url, err := resilient.Get(ctx, "abc"); err != nil || url != "https://example.com" {
+		t.Errorf("Expected probe to succeed, got %q, %v", url, err)
+	}
+	if health := resilient.Health(); health.Status != models.HealthOK || health.Breaker != breakerClosed {
+		t.Errorf("Expected closed breaker, got %+v", health)
+	}
+	if _, err := resilient.Get(ctx, "missing"); err != appErrors.ErrKey {
+		t.Errorf("Expected ErrKey, got %v", err)
+	}
+	if health := resilient.Health(); health.ConsecutiveFailures != 0 {
+		t.Errorf("Expected missing key not to count as failure, got %+v", health)
+	}
+}
+
+func TestResilientStorage_ClickBreaker(t *testing.T) {
+	resilient, backend := newTestResilientStorage(0, nil)
+	backend.clickErr = &pgconn.PgError{Code: pgerrcode.AdminShutdown}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		resilient.CountClick(ctx, "abc")
+	}
+	if err := resilient.CountClick(ctx, "abc"); err != appErrors.ErrUnavailable {
+		t.Errorf("Expected the click breaker to be open, got %v", err)
+	}
+	if url, err := resilient.Get(ctx, "abc"); err != nil || url != "https://example.com" {
+		t.Errorf("Expected failing clicks not to stop redirects, got %q, %v", url, err)
+	}
+	if health := resilient.Health(); health.Status != models.HealthDegraded || health.Breaker != breakerClosed ||
+		health.ClickBreaker != breakerOpen {
+		t.Errorf("Expected closed storage breaker and open click breaker, got %+v", health)
+	}
+}
@@ -4,56 +4,158 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
 	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
 	"github.com/TPizik/url-shortener/internal/app/models"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
 )
 
+var Sugar = *zap.NewNop().Sugar()
+
+// clickFlushInterval is how often the file and kv backends write the clicks
+// counted in memory.
+const clickFlushInterval = time.Second
+
 type StorageExpected interface {
 	Get(ctx context.Context, key string) (string, error)
 	Add(ctx context.Context, key string) (string, error)
 	AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error)
+	Iterate(ctx context.Context, fn func(models.Link) error) error
+	Import(ctx context.Context, links []models.Link) error
+	GetLink(ctx context.Context, key string) (models.Link, error)
+	UpdateLink(ctx context.Context, link models.Link) error
+	PutLink(ctx context.Context, link models.Link) error
+	SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error
+	DeleteLink(ctx context.Context, key string) error
+	LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error)
+	ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error)
+	CountClick(ctx context.Context, key string) error
+	LinkClicks(ctx context.Context, key string) (int64, error)
+	AppendAudit(ctx context.Context, event models.AuditEvent) error
+	IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error
+	ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error)
+	GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error)
+	SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error
+	CreateAPIKey(ctx context.Context, key models.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
 	Ping(ctx context.Context) error
 	Close() error
 }
 
 type Storage struct {
-	storage StorageExpected
+	storage      StorageExpected
+	resilient    *ResilientStorage
+	maxURLLength int
 }
 
 func NewStorage(config *config.Config) (*Storage, error) {
-	switch {
-	case config.DBDSN != "":
-		db, err := sqlx.Open("pgx", config.DBDSN)
-		if err != nil {
-			return nil, err
-		}
-		storage, err := NewDatabaseStorage(db, config)
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		return nil, err
+	}
+	Sugar = *logger.Sugar()
+
+	backend, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.SecondaryStorageSpec != "" {
+		secondaryConfig := config.WithStorage(config.SecondaryStorageSpec)
+		secondary, err := newBackend(&secondaryConfig)
 		if err != nil {
+			backend.Close()
 			return nil, err
 		}
-		err = storage.Migrate()
+		backend = NewDualStorage(backend, secondary, config)
+	}
+	var resilient *ResilientStorage
+	if config.StorageRetries > 0 || config.BreakerThreshold > 0 {
+		resilient = NewResilientStorage(backend, config)
+		backend = resilient
+	}
+	if config.CacheSize > 0 {
+		backend = NewCacheStorage(backend, config)
+	}
+	return &Storage{storage: backend, resilient: resilient, maxURLLength: config.MaxURLLength}, nil
+}
+
+func newBackend(config *config.Config) (StorageExpected, error) {
+	switch {
+	case strings.HasPrefix(config.StorageSpec, kvScheme):
+		return NewKVStorage(strings.TrimPrefix(config.StorageSpec, kvScheme), config)
+	case isRedisSpec(config.StorageSpec):
+		options, err := redis.ParseURL(config.StorageSpec)
 		if err != nil {
 			return nil, err
 		}
-		return &Storage{storage: storage}, nil
+		return NewRedisStorage(redis.NewClient(options), config), nil
+	case strings.HasPrefix(config.StorageSpec, fileScheme):
+		return newFileBackend(strings.TrimPrefix(config.StorageSpec, fileScheme), config)
+	case isPostgresSpec(config.StorageSpec):
+		return newDatabaseBackend(config.StorageSpec, config)
+	case config.StorageSpec != "":
+		return nil, fmt.Errorf("unsupported storage %q", config.StorageSpec)
+	case config.DBDSN != "":
+		return newDatabaseBackend(config.DBDSN, config)
 	case config.FileStoragePath != "":
-		storage, err := NewFileStorage(config.FileStoragePath, config)
-		if err != nil {
-			return nil, err
-		}
-		err = storage.Load()
-		if err != nil {
-			return nil, err
-		}
-		return &Storage{storage: storage}, nil
+		return newFileBackend(config.FileStoragePath, config)
 	default:
-		storage := NewInmemoryStorage(config)
-		return &Storage{storage: storage}, nil
+		return NewInmemoryStorage(config), nil
+	}
+}
+
+func newDatabaseBackend(dsn string, config *config.Config) (StorageExpected, error) {
+	db, err := sqlx.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewDatabaseStorage(db, config)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.Migrate()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.DBReplicaDSNs) > 0 {
+		replicas := make([]*sqlx.DB, 0, len(config.DBReplicaDSNs))
+		for _, replicaDSN := range config.DBReplicaDSNs {
+			replica, err := sqlx.Open("pgx", replicaDSN)
+			if err != nil {
+				return nil, err
+			}
+			replicas = append(replicas, replica)
+		}
+		storage.SetReplicas(replicas, config.DBReplicaWindow)
+		go storage.RunReplicaChecks(replicaCheckInterval)
 	}
+	return storage, nil
+}
+
+func newFileBackend(filename string, config *config.Config) (StorageExpected, error) {
+	storage, err := NewFileStorage(filename, config)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	Sugar.Infoln("file storage", filename, storage.Report())
+	return storage, nil
 }
 
 func (c *Storage) Ping(ctx context.Context) error {
@@ -65,6 +167,9 @@ func (c *Storage) Close() error {
 }
 
 func (c *Storage) Add(ctx context.Context, url string) (string, error) {
+	if err := c.validateURL(url); err != nil {
+		return "", err
+	}
 	key, err := c.storage.Add(ctx, url)
 	if err != nil && err == appErrors.ErrConflict {
 		return key, err
@@ -86,6 +191,11 @@ func (c *Storage) Get(ctx context.Context, key string) (string, error) {
 }
 
 func (c *Storage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOriginal) ([]models.URLRowShort, error) {
+	for _, url := range requestURLs {
+		if err := c.validateURL(url.OriginalURL); err != nil {
+			return nil, err
+		}
+	}
 	url, err := c.storage.AddByBatch(ctx, requestURLs)
 	if err != nil {
 		return nil, err
@@ -94,6 +204,191 @@ func (c *Storage) AddByBatch(ctx context.Context, requestURLs []models.URLRowOri
 	return url, nil
 }
 
+func (c *Storage) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	return c.storage.Iterate(ctx, fn)
+}
+
+func (c *Storage) Import(ctx context.Context, links []models.Link) error {
+	for _, link := range links {
+		if err := c.validateURL(link.OriginalURL); err != nil {
+			return appErrors.Wrap(appErrors.ErrValidation, "link "+link.Key, err)
+		}
+	}
+	return c.storage.Import(ctx, links)
+}
+
+func (c *Storage) GetLink(ctx context.Context, key string) (models.Link, error) {
+	return c.storage.GetLink(ctx, key)
+}
+
+func (c *Storage) UpdateLink(ctx context.Context, link models.Link) error {
+	if err := c.validateURL(link.OriginalURL); err != nil {
+		return err
+	}
+	return c.storage.UpdateLink(ctx, link)
+}
+
+func (c *Storage) SetMetadata(ctx context.Context, key string, url string, metadata models.LinkMetadata) error {
+	return c.storage.SetMetadata(ctx, key, url, metadata)
+}
+
+func (c *Storage) DeleteLink(ctx context.Context, key string) error {
+	return c.storage.DeleteLink(ctx, key)
+}
+
+func (c *Storage) LinkHistory(ctx context.Context, key string) ([]models.LinkVersion, error) {
+	return c.storage.LinkHistory(ctx, key)
+}
+
+func (c *Storage) ListLinks(ctx context.Context, query models.LinkQuery, page models.PageRequest) (models.LinkPage, error) {
+	return c.storage.ListLinks(ctx, query, page)
+}
+
+func (c *Storage) CountClick(ctx context.Context, key string) error {
+	return c.storage.CountClick(ctx, key)
+}
+
+func (c *Storage) LinkClicks(ctx context.Context, key string) (int64, error) {
+	return c.storage.LinkClicks(ctx, key)
+}
+
+func (c *Storage) AppendAudit(ctx context.Context, event models.AuditEvent) error {
+	return c.storage.AppendAudit(ctx, event)
+}
+
+func (c *Storage) IterateAudit(ctx context.Context, fn func(models.AuditEvent) error) error {
+	return c.storage.IterateAudit(ctx, fn)
+}
+
+func (c *Storage) ListAudit(ctx context.Context, query models.AuditQuery, page models.PageRequest) (models.AuditPage, error) {
+	return c.storage.ListAudit(ctx, query, page)
+}
+
+func (c *Storage) GetIdempotency(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	return c.storage.GetIdempotency(ctx, key)
+}
+
+func (c *Storage) SaveIdempotency(ctx context.Context, record models.IdempotencyRecord) error {
+	return c.storage.SaveIdempotency(ctx, record)
+}
+
+func (c *Storage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	return c.storage.CreateAPIKey(ctx, key)
+}
+
+func (c *Storage) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	return c.storage.GetAPIKey(ctx, id)
+}
+
+func (c *Storage) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	return c.storage.ListAPIKeys(ctx)
+}
+
+func (c *Storage) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return c.storage.RevokeAPIKey(ctx, id, at)
+}
+
+func (c *Storage) Health() models.Health {
+	if c.resilient == nil {
+		return models.Health{Status: models.HealthOK}
+	}
+	return c.resilient.Health()
+}
+
+func (c *Storage) validateURL(url string) error {
+	if c.maxURLLength > 0 && len(url) > c.maxURLLength {
+		return appErrors.ErrURLTooLong
+	}
+	return nil
+}
+
+// checkVersion rejects an update made to an older version of stored, an
+// update without a version applies to any version.
+func checkVersion(stored models.Link, update models.Link) error {
+	if update.Version != 0 && update.Version != stored.Version {
+		return appErrors.ErrStaleVersion
+	}
+	return nil
+}
+
+// updatedLink applies the mutable fields of update to stored as its next
+// version. Metadata is stored apart by SetMetadata, an update keeps it unless
+// it replaces the destination the metadata describes.
+func updatedLink(stored models.Link, update models.Link) models.Link {
+	stored.Version++
+	if stored.OriginalURL != update.OriginalURL {
+		stored.Metadata = nil
+	}
+	stored.OriginalURL = update.OriginalURL
+	stored.UserID = update.UserID
+	stored.Deleted = update.Deleted
+	stored.Disabled = update.Disabled
+	stored.LinkDetails = update.LinkDetails
+	return stored
+}
+
+// fetchedFor reports whether metadata fetched from url belongs to stored, a
+// link changed or deleted since keeps the metadata of its current destination.
+func fetchedFor(stored models.Link, url string) bool {
+	return !stored.Deleted && stored.OriginalURL == url
+}
+
+// searchTokens splits texts into the lower case words full-text search
+// matches, every backend indexes the same words.
+func searchTokens(texts ...string) []string {
+	tokens := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				tokens = append(tokens, word)
+			}
+		}
+	}
+	return tokens
+}
+
+func linkTokens(link models.Link) []string {
+	return searchTokens(link.OriginalURL, link.Title, link.Notes)
+}
+
+// maxKeyAttempts bounds the search for a free key when the hash of a url is
+// already taken by a link whose destination was edited.
+const maxKeyAttempts = 16
+
+var errNoFreeKey = errors.New("no free key for url")
+
+// urlKey returns the candidate key for url on domain, the first attempt is
+// the plain GetURLHash so unedited links keep their historical keys.
+func urlKey(domain string, url string, attempt int) (string, error) {
+	if attempt > 0 {
+		url += "\x00" + strconv.Itoa(attempt)
+	}
+	key, err := GetURLHash(url)
+	return domains.Key(domain, key), err
+}
+
+// urlIndex returns the entry of url in the url to key index for the link
+// stored as key.
+func urlIndex(key string, url string) string {
+	domain, _ := domains.Split(key)
+	return domains.IndexKey(domain, url)
+}
+
+// replacedVersion is the history entry for the destination stored loses when
+// it is updated to updated, nil when the destination does not change.
+func replacedVersion(stored models.Link, updated models.Link) *models.LinkVersion {
+	if stored.OriginalURL == updated.OriginalURL {
+		return nil
+	}
+	now := time.Now().UTC()
+	return &models.LinkVersion{URL: stored.OriginalURL, ReplacedAt: &now}
+}
+
 func GetURLHash(url string) (string, error) {
 	h := sha256.New()
 	_, err := h.Write([]byte(url))
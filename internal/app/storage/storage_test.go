@@ -0,0 +1,910 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/audit"
+	"github.com/TPizik/url-shortener/internal/app/auth"
+	"github.com/TPizik/url-shortener/internal/app/config"
+	"github.com/TPizik/url-shortener/internal/app/domains"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestBackends(t *testing.T) map[string]StorageExpected {
+	t.Helper()
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	dir := t.TempDir()
+	backends := map[string]StorageExpected{
+		"inmemory": NewInmemoryStorage(&configTest),
+		"file":     newTestFileStorage(t, filepath.Join(dir, "storage.txt")),
+	}
+
+	kv, err := NewKVStorage(filepath.Join(dir, "links.db"), &configTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends["kv"] = kv
+
+	redisConfig := configTest
+	redisConfig.StorageSpec = fmt.Sprintf("redis://%s/0", miniredis.RunT(t).Addr())
+	redisStorage, err := newBackend(&redisConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends["redis"] = redisStorage
+
+	dbStorage, _ := NewDatabaseStorage(newTestDB(t), &configTest)
+	if err := dbStorage.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	backends["database"] = dbStorage
+
+	t.Cleanup(func() {
+		for name, backend := range backends {
+			if name != "file" {
+				backend.Close()
+			}
+		}
+	})
+	return backends
+}
+
+func TestStorage_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := backend.GetIdempotency(ctx, "missing"); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found, got %v", err)
+			}
+
+			record := models.IdempotencyRecord{
+				Key:         "key",
+				Fingerprint: "fingerprint",
+				Status:      201,
+				ContentType: "application/json",
+				Body:        []byte(`{"result":"http://127.0.0.1:8080/abc"}`),
+				ExpiresAt:   time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+			}
+			if err := backend.SaveIdempotency(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := backend.GetIdempotency(ctx, record.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Fingerprint != record.Fingerprint || stored.Status != record.Status ||
+				stored.ContentType != record.ContentType || !bytes.Equal(stored.Body, record.Body) ||
+				!stored.ExpiresAt.Equal(record.ExpiresAt) {
+				t.Errorf("Expected %+v, got %+v", record, stored)
+			}
+
+			record.Fingerprint = "other"
+			if err := backend.SaveIdempotency(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetIdempotency(ctx, record.Key); err != nil || stored.Fingerprint != "other" {
+				t.Errorf("Expected overwritten record, got %+v, %v", stored, err)
+			}
+
+			expired := record
+			expired.Key = "expired"
+			expired.ExpiresAt = time.Now().Add(50 * time.Millisecond)
+			if err := backend.SaveIdempotency(ctx, expired); err != nil {
+				t.Fatal(err)
+			}
+			renewed := expired
+			renewed.Key = "renewed"
+			if err := backend.SaveIdempotency(ctx, renewed); err != nil {
+				t.Fatal(err)
+			}
+			renewed.ExpiresAt = record.ExpiresAt
+			if err := backend.SaveIdempotency(ctx, renewed); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(60 * time.Millisecond)
+			if _, err := backend.GetIdempotency(ctx, expired.Key); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected expired record to be not found, got %v", err)
+			}
+			if err := backend.SaveIdempotency(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.GetIdempotency(ctx, renewed.Key); err != nil {
+				t.Errorf("Expected renewed record to outlive its first expiry, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStorage_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := backend.GetAPIKey(ctx, "missing"); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found, got %v", err)
+			}
+			if err := backend.RevokeAPIKey(ctx, "missing", time.Now()); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found on revoke, got %v", err)
+			}
+
+			key, _, err := auth.NewAPIKey("ci", "team", []string{auth.ScopeShorten, auth.ScopeRead})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key.CreatedAt = key.CreatedAt.Truncate(time.Second)
+			if err := backend.CreateAPIKey(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.CreateAPIKey(ctx, key); !errors.Is(err, appErrors.ErrConflict) {
+				t.Errorf("Expected conflict, got %v", err)
+			}
+			stored, err := backend.GetAPIKey(ctx, key.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Name != key.Name || stored.Owner != key.Owner || stored.Hash != key.Hash ||
+				strings.Join(stored.Scopes, ",") != "shorten,read" || !stored.CreatedAt.Equal(key.CreatedAt) ||
+				stored.RevokedAt != nil {
+				t.Errorf("Expected %+v, got %+v", key, stored)
+			}
+
+			revokedAt := time.Now().UTC().Truncate(time.Second)
+			if err := backend.RevokeAPIKey(ctx, key.ID, revokedAt); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.RevokeAPIKey(ctx, key.ID, revokedAt.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := backend.ListAPIKeys(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || keys[0].RevokedAt == nil || !keys[0].RevokedAt.Equal(revokedAt) {
+				t.Errorf("Expected one key revoked at %v, got %+v", revokedAt, keys)
+			}
+
+			owned := auth.WithPrincipal(ctx, auth.Principal{KeyID: key.ID, Owner: key.Owner})
+			shortKey, err := backend.Add(owned, "https://example.com/"+name+"/owned")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var owner string
+			err = backend.Iterate(ctx, func(link models.Link) error {
+				if link.Key == shortKey {
+					owner = link.UserID
+				}
+				return nil
+			})
+			if err != nil || owner != key.Owner {
+				t.Errorf("Expected link owned by %s, got %q, %v", key.Owner, owner, err)
+			}
+		})
+	}
+}
+
+func TestStorage_LinkAdmin(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/admin"
+			key, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.GetLink(ctx, "missing"); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found, got %v", err)
+			}
+			if err := backend.UpdateLink(ctx, models.Link{Key: "missing"}); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found on update, got %v", err)
+			}
+
+			link, err := backend.GetLink(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link.UserID = "bob"
+			link.Disabled = true
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.Get(ctx, key); !errors.Is(err, appErrors.ErrDisabled) {
+				t.Errorf("Expected disabled link, got %v", err)
+			}
+			stored, err := backend.GetLink(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.UserID != "bob" || !stored.Disabled || stored.OriginalURL != url {
+				t.Errorf("Unexpected updated link %+v", stored)
+			}
+
+			if stored.Version != link.Version+1 {
+				t.Errorf("Expected version %d after the update, got %d", link.Version+1, stored.Version)
+			}
+			link.Disabled = false
+			if err := backend.UpdateLink(ctx, link); !errors.Is(err, appErrors.ErrStaleVersion) {
+				t.Errorf("Expected an update of the replaced version to be rejected, got %v", err)
+			}
+
+			stored.Disabled = false
+			if err := backend.UpdateLink(ctx, stored); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := backend.Get(ctx, key); err != nil || got != url {
+				t.Errorf("Expected enabled link %s, got %q, %v", url, got, err)
+			}
+
+			if err := backend.DeleteLink(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.Get(ctx, key); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected deleted link to be not found, got %v", err)
+			}
+			if err := backend.DeleteLink(ctx, key); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected not found on second delete, got %v", err)
+			}
+			if readded, err := backend.Add(ctx, url); err != nil || readded != key {
+				t.Errorf("Expected deleted url to be added again as %s, got %q, %v", key, readded, err)
+			}
+		})
+	}
+}
+
+func TestStorage_PutLink(t *testing.T) {
+	ctx := context.Background()
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/put"
+			link := models.Link{Key: "put" + name, OriginalURL: url, UserID: "alice", CreatedAt: createdAt, Version: 3,
+				LinkDetails: models.LinkDetails{Title: "Put"}}
+			if err := backend.PutLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			link.OriginalURL = url + "/v2"
+			link.Version = 4
+			if err := backend.PutLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, link.Key); err != nil || stored.OriginalURL != link.OriginalURL ||
+				stored.Version != 4 || stored.Title != "Put" || !stored.CreatedAt.Equal(createdAt) {
+				t.Errorf("Expected the link as it was put, got %+v, %v", stored, err)
+			}
+			if key, err := backend.Add(ctx, link.OriginalURL); (err != nil && !errors.Is(err, appErrors.ErrConflict)) || key != link.Key {
+				t.Errorf("Expected the put url to be indexed as %s, got %q, %v", link.Key, key, err)
+			}
+			if key, err := backend.Add(ctx, url); err != nil || key == link.Key {
+				t.Errorf("Expected the replaced url to get a new link, got %q, %v", key, err)
+			}
+			page, err := backend.ListLinks(ctx, models.LinkQuery{Owner: "alice"}, models.PageRequest{})
+			if err != nil || len(page.Links) != 1 || page.Links[0].Key != link.Key {
+				t.Errorf("Expected the link to be listed once, got %+v, %v", page, err)
+			}
+		})
+	}
+}
+
+func TestStorage_EditURL(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/flyer"
+			edited := "https://example.com/" + name + "/campaign"
+			key, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			otherURL := "https://example.com/" + name + "/other"
+			if _, err := backend.Add(ctx, otherURL); err != nil {
+				t.Fatal(err)
+			}
+
+			link, err := backend.GetLink(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link.OriginalURL = otherURL
+			if err := backend.UpdateLink(ctx, link); !errors.Is(err, appErrors.ErrConflict) {
+				t.Errorf("Expected conflict on url of another link, got %v", err)
+			}
+			link.OriginalURL = edited
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := backend.Get(ctx, key); err != nil || got != edited {
+				t.Errorf("Expected edited url %s, got %q, %v", edited, got, err)
+			}
+			history, err := backend.LinkHistory(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 || history[0].URL != url || history[0].ReplacedAt == nil {
+				t.Errorf("Unexpected history %+v", history)
+			}
+
+			if same, err := backend.Add(ctx, edited); (err != nil && !errors.Is(err, appErrors.ErrConflict)) || same != key {
+				t.Errorf("Expected edited url to keep key %s, got %q, %v", key, same, err)
+			}
+			readded, err := backend.Add(ctx, url)
+			if err != nil || readded == key {
+				t.Fatalf("Expected previous url to get a new key, got %q, %v", readded, err)
+			}
+			if got, err := backend.Get(ctx, readded); err != nil || got != url {
+				t.Errorf("Expected %s for the new key, got %q, %v", url, got, err)
+			}
+			if got, err := backend.Get(ctx, key); err != nil || got != edited {
+				t.Errorf("Expected edited link to be kept, got %q, %v", got, err)
+			}
+
+			batchURL := "https://example.com/" + name + "/batch"
+			batchKey, err := backend.Add(ctx, batchURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.UpdateLink(ctx, models.Link{Key: batchKey, OriginalURL: batchURL + "/edited"}); err != nil {
+				t.Fatal(err)
+			}
+			shortURLs, err := backend.AddByBatch(ctx, []models.URLRowOriginal{{CorrelationID: "1", OriginalURL: batchURL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shortURLs[0].ShortURL == "http://127.0.0.1:8080/"+batchKey {
+				t.Errorf("Expected batch url to get a new key, got %s", shortURLs[0].ShortURL)
+			}
+			if got, err := backend.Get(ctx, batchKey); err != nil || got != batchURL+"/edited" {
+				t.Errorf("Expected edited batch link to be kept, got %q, %v", got, err)
+			}
+
+			if err := backend.DeleteLink(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if history, err := backend.LinkHistory(ctx, key); err != nil || len(history) != 0 {
+				t.Errorf("Expected history to be deleted with the link, got %+v, %v", history, err)
+			}
+		})
+	}
+}
+
+func TestStorage_Domains(t *testing.T) {
+	ctx := context.Background()
+	brandCtx := domains.WithDomain(ctx, "go.brand.example")
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/brand"
+			key, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			brandKey, err := backend.Add(brandCtx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if brandKey != key+"@go.brand.example" {
+				t.Errorf("Expected key %s on the brand domain, got %s", key, brandKey)
+			}
+			if again, err := backend.Add(brandCtx, url); (err != nil && !errors.Is(err, appErrors.ErrConflict)) || again != brandKey {
+				t.Errorf("Expected %s again, got %q, %v", brandKey, again, err)
+			}
+
+			if err := backend.UpdateLink(ctx, models.Link{Key: brandKey, OriginalURL: url + "/edited"}); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := backend.Get(ctx, key); err != nil || got != url {
+				t.Errorf("Expected default domain link to keep %s, got %q, %v", url, got, err)
+			}
+			if got, err := backend.Get(ctx, brandKey); err != nil || got != url+"/edited" {
+				t.Errorf("Expected edited brand link, got %q, %v", got, err)
+			}
+
+			shortURLs, err := backend.AddByBatch(brandCtx, []models.URLRowOriginal{{CorrelationID: "1", OriginalURL: url}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			batchKey := shortURLs[0].ShortURL[strings.LastIndex(shortURLs[0].ShortURL, "/")+1:]
+			if batchKey == key || !strings.HasSuffix(batchKey, "@go.brand.example") {
+				t.Errorf("Expected a new brand key, got %s", batchKey)
+			}
+
+			if err := backend.DeleteLink(ctx, brandKey); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := backend.Get(ctx, key); err != nil || got != url {
+				t.Errorf("Expected default domain link to survive, got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestStorage_LinkMetadata(t *testing.T) {
+	ctx := context.Background()
+	metadata := &models.LinkMetadata{
+		Title:       "Example",
+		Description: "An example page",
+		Image:       "https://example.com/og.png",
+		FetchedAt:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			key, err := backend.Add(ctx, "https://example.com/"+name+"/metadata")
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := backend.GetLink(ctx, key)
+			if err != nil || link.Metadata != nil {
+				t.Fatalf("Expected a link without metadata, got %+v, %v", link, err)
+			}
+			if err := backend.SetMetadata(ctx, key, link.OriginalURL, *metadata); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, key); err != nil || !reflect.DeepEqual(stored.Metadata, metadata) {
+				t.Errorf("Expected metadata %+v, got %+v, %v", metadata, stored.Metadata, err)
+			}
+			page, err := backend.ListLinks(ctx, models.LinkQuery{KeyPrefix: key}, models.PageRequest{})
+			if err != nil || len(page.Links) != 1 || !reflect.DeepEqual(page.Links[0].Metadata, metadata) {
+				t.Errorf("Expected listed metadata %+v, got %+v, %v", metadata, page.Links, err)
+			}
+
+			link.Title = "Renamed"
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, key); err != nil || !reflect.DeepEqual(stored.Metadata, metadata) {
+				t.Errorf("Expected an edit of the details to keep metadata, got %+v, %v", stored.Metadata, err)
+			}
+			link.Version++
+			link.OriginalURL += "/moved"
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, key); err != nil || stored.Metadata != nil {
+				t.Errorf("Expected cleared metadata, got %+v, %v", stored.Metadata, err)
+			}
+		})
+	}
+}
+
+func TestStorage_SetMetadata(t *testing.T) {
+	ctx := context.Background()
+	metadata := models.LinkMetadata{Title: "Example", FetchedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/set-metadata"
+			key, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := backend.GetLink(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.SetMetadata(ctx, key, url, metadata); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, key); err != nil || !reflect.DeepEqual(stored.Metadata, &metadata) || stored.Version != link.Version {
+				t.Errorf("Expected metadata under version %d, got %+v, %v", link.Version, stored, err)
+			}
+
+			// An edit based on the version read before the metadata was
+			// stored goes through.
+			link.OriginalURL = url + "/v2"
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatalf("Expected the edit to go through, got %v", err)
+			}
+			if err := backend.SetMetadata(ctx, key, url, metadata); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, key); err != nil || stored.Metadata != nil {
+				t.Errorf("Expected no metadata of the replaced destination, got %+v, %v", stored.Metadata, err)
+			}
+			if err := backend.SetMetadata(ctx, "missing", url, metadata); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected metadata of a missing link to be not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStorage_Clicks(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			url := "https://example.com/" + name + "/clicks"
+			key, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := backend.Add(ctx, url+"/other")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := backend.CountClick(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if clicks, err := backend.LinkClicks(ctx, key); err != nil || clicks != 3 {
+				t.Errorf("Expected 3 clicks, got %d, %v", clicks, err)
+			}
+			if clicks, err := backend.LinkClicks(ctx, other); err != nil || clicks != 0 {
+				t.Errorf("Expected no clicks of the other link, got %d, %v", clicks, err)
+			}
+			if err := backend.CountClick(ctx, "missing"); !errors.Is(err, appErrors.ErrNotFound) {
+				t.Errorf("Expected a click of a missing link to be not found, got %v", err)
+			}
+
+			if err := backend.DeleteLink(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			again, err := backend.Add(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clicks, err := backend.LinkClicks(ctx, again); err != nil || clicks != 0 {
+				t.Errorf("Expected clicks of the deleted link to be dropped, got %d, %v", clicks, err)
+			}
+		})
+	}
+}
+
+func TestStorage_UserLinks(t *testing.T) {
+	ctx := context.Background()
+	alice := auth.WithPrincipal(ctx, auth.Principal{Owner: "alice"})
+	bob := auth.WithPrincipal(ctx, auth.Principal{Owner: "bob"})
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			add := func(ctx context.Context, url string, details models.LinkDetails) string {
+				t.Helper()
+				key, err := backend.Add(ctx, url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				link, _ := backend.GetLink(ctx, key)
+				link.LinkDetails = details
+				if err := backend.UpdateLink(ctx, link); err != nil {
+					t.Fatal(err)
+				}
+				return key
+			}
+			launch := add(alice, "https://example.com/"+name+"/launch", models.LinkDetails{Title: "Spring Launch", Tags: []string{"campaign", "q2"}})
+			flyer := add(alice, "https://example.com/"+name+"/flyer", models.LinkDetails{Tags: []string{"print"}, Notes: "Handed out at the launch event"})
+			deleted := add(alice, "https://example.com/"+name+"/old-launch", models.LinkDetails{Tags: []string{"campaign"}})
+			bobLaunch := add(bob, "https://example.com/"+name+"/bob-launch", models.LinkDetails{Tags: []string{"campaign"}})
+			link, _ := backend.GetLink(ctx, deleted)
+			link.Deleted = true
+			if err := backend.UpdateLink(ctx, link); err != nil {
+				t.Fatal(err)
+			}
+			if stored, err := backend.GetLink(ctx, launch); err != nil || stored.Title != "Spring Launch" || fmt.Sprint(stored.Tags) != "[campaign q2]" {
+				t.Errorf("Expected the details to be stored, got %+v, %v", stored, err)
+			}
+
+			tests := []struct {
+				name  string
+				query models.LinkQuery
+				keys  []string
+			}{
+				{name: "all", query: models.LinkQuery{Owner: "alice"}, keys: []string{launch, flyer}},
+				{name: "tag", query: models.LinkQuery{Owner: "alice", Tag: "campaign"}, keys: []string{launch}},
+				{name: "tag prefix", query: models.LinkQuery{Owner: "alice", Tag: "camp"}},
+				{name: "title word", query: models.LinkQuery{Owner: "alice", Search: "SPRING"}, keys: []string{launch}},
+				{name: "notes and url words", query: models.LinkQuery{Owner: "alice", Search: "launch"}, keys: []string{launch, flyer}},
+				{name: "every word", query: models.LinkQuery{Owner: "alice", Search: "launch event"}, keys: []string{flyer}},
+				{name: "url path", query: models.LinkQuery{Owner: "alice", Search: "flyer"}, keys: []string{flyer}},
+				{name: "tag and query", query: models.LinkQuery{Owner: "alice", Tag: "print", Search: "spring"}},
+				{name: "unknown word", query: models.LinkQuery{Owner: "alice", Search: "autumn"}},
+				{name: "other owner", query: models.LinkQuery{Owner: "bob", Tag: "campaign"}, keys: []string{bobLaunch}},
+			}
+			for _, tt := range tests {
+				page, err := backend.ListLinks(ctx, tt.query, models.PageRequest{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys := make([]string, 0, len(page.Links))
+				for _, link := range page.Links {
+					keys = append(keys, link.Key)
+				}
+				slices.Sort(keys)
+				slices.Sort(tt.keys)
+				if fmt.Sprint(keys) != fmt.Sprint(tt.keys) {
+					t.Errorf("%s: expected %v, got %v", tt.name, tt.keys, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestStorage_ListLinks(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			owners := []string{"alice", "bob", "carol"}
+			for i := 0; i < 60; i++ {
+				owned := auth.WithPrincipal(ctx, auth.Principal{Owner: owners[i%len(owners)]})
+				if _, err := backend.Add(owned, fmt.Sprintf("https://example.com/%s/list/%d", name, i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var all []models.Link
+			backend.Iterate(ctx, func(link models.Link) error {
+				all = append(all, link)
+				return nil
+			})
+			slices.SortFunc(all, func(a, b models.Link) int {
+				if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+					return c
+				}
+				return strings.Compare(a.Key, b.Key)
+			})
+			deleted := all[7]
+			deleted.Deleted = true
+			if err := backend.UpdateLink(ctx, deleted); err != nil {
+				t.Fatal(err)
+			}
+			all[7] = deleted
+
+			keysOf := func(links []models.Link) []string {
+				keys := make([]string, 0, len(links))
+				for _, link := range links {
+					keys = append(keys, link.Key)
+				}
+				return keys
+			}
+			collect := func(query models.LinkQuery, page models.PageRequest) []string {
+				t.Helper()
+				keys := make([]string, 0)
+				for pages := 0; pages < 100; pages++ {
+					result, err := backend.ListLinks(ctx, query, page)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if page.Limit > 0 && len(result.Links) > page.Limit {
+						t.Fatalf("Expected at most %d links, got %d", page.Limit, len(result.Links))
+					}
+					keys = append(keys, keysOf(result.Links)...)
+					if result.NextCursor == "" {
+						return keys
+					}
+					page.Cursor = result.NextCursor
+				}
+				t.Fatal("Expected paging to end")
+				return nil
+			}
+			visible := slices.DeleteFunc(slices.Clone(all), func(link models.Link) bool { return link.Deleted })
+			reversed := slices.Clone(visible)
+			slices.Reverse(reversed)
+			bobs := slices.DeleteFunc(slices.Clone(all), func(link models.Link) bool { return link.UserID != "bob" })
+
+			tests := []struct {
+				name  string
+				query models.LinkQuery
+				page  models.PageRequest
+				keys  []string
+			}{
+				{name: "ascending", page: models.PageRequest{Limit: 7}, keys: keysOf(visible)},
+				{name: "descending", page: models.PageRequest{Limit: 7, Descending: true}, keys: keysOf(reversed)},
+				{name: "including deleted", query: models.LinkQuery{IncludeDeleted: true}, page: models.PageRequest{Limit: 25}, keys: keysOf(all)},
+				{name: "owner", query: models.LinkQuery{Owner: "bob", IncludeDeleted: true}, page: models.PageRequest{Limit: 3}, keys: keysOf(bobs)},
+				{name: "url", query: models.LinkQuery{URL: "/LIST/5"}, page: models.PageRequest{Limit: 2}, keys: keysOf(slices.DeleteFunc(slices.Clone(visible), func(link models.Link) bool {
+					return !strings.Contains(link.OriginalURL, "/list/5")
+				}))},
+				{name: "key prefix", query: models.LinkQuery{KeyPrefix: all[3].Key, IncludeDeleted: true}, keys: []string{all[3].Key}},
+				{name: "created range", query: models.LinkQuery{CreatedAfter: all[10].CreatedAt, CreatedBefore: all[20].CreatedAt}, page: models.PageRequest{Limit: 4},
+					keys: keysOf(slices.DeleteFunc(slices.Clone(visible), func(link models.Link) bool {
+						return link.CreatedAt.Before(all[10].CreatedAt) || !link.CreatedAt.Before(all[20].CreatedAt)
+					}))},
+			}
+			for _, tt := range tests {
+				if keys := collect(tt.query, tt.page); fmt.Sprint(keys) != fmt.Sprint(tt.keys) {
+					t.Errorf("%s: expected %v, got %v", tt.name, tt.keys, keys)
+				}
+			}
+
+			first, err := backend.ListLinks(ctx, models.LinkQuery{}, models.PageRequest{})
+			if err != nil || len(first.Links) != DefaultPageLimit || first.NextCursor == "" {
+				t.Errorf("Expected a default page of %d links, got %d, %v", DefaultPageLimit, len(first.Links), err)
+			}
+			capped, err := backend.ListLinks(ctx, models.LinkQuery{}, models.PageRequest{Limit: MaxPageLimit + 1})
+			if err != nil || len(capped.Links) != len(visible) || capped.NextCursor != "" {
+				t.Errorf("Expected all %d links on a capped page, got %d, %v", len(visible), len(capped.Links), err)
+			}
+			if _, err := backend.ListLinks(ctx, models.LinkQuery{}, models.PageRequest{Cursor: "not a cursor"}); !errors.Is(err, appErrors.ErrValidation) {
+				t.Errorf("Expected invalid cursor to be a validation error, got %v", err)
+			}
+		})
+	}
+}
+
+// Links inserted while paging must neither shift nor repeat the links that
+// existed when paging started.
+func TestStorage_ListLinksConcurrentInserts(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		for _, descending := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s descending=%t", name, descending), func(t *testing.T) {
+				prefix := fmt.Sprintf("https://example.com/%s/%t/", name, descending)
+				existing := make(map[string]bool)
+				for i := 0; i < 40; i++ {
+					key, err := backend.Add(ctx, fmt.Sprintf("%sexisting/%d", prefix, i))
+					if err != nil {
+						t.Fatal(err)
+					}
+					existing[key] = true
+				}
+				query := models.LinkQuery{URL: prefix}
+
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 40; i++ {
+						if _, err := backend.Add(ctx, fmt.Sprintf("%sinserted/%d", prefix, i)); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+
+				seen := make(map[string]bool)
+				var previous *models.Link
+				page := models.PageRequest{Limit: 3, Descending: descending}
+				for {
+					result, err := backend.ListLinks(ctx, query, page)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, link := range result.Links {
+						if seen[link.Key] {
+							t.Fatalf("Link %s listed twice", link.Key)
+						}
+						seen[link.Key] = true
+						if previous != nil && linkBefore(*previous, link) == descending {
+							t.Fatalf("Link %s listed out of order after %s", link.Key, previous.Key)
+						}
+						current := link
+						previous = &current
+					}
+					if result.NextCursor == "" {
+						break
+					}
+					page.Cursor = result.NextCursor
+				}
+				wg.Wait()
+				for key := range existing {
+					if !seen[key] {
+						t.Errorf("Existing link %s was skipped", key)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStorage_Audit(t *testing.T) {
+	ctx := context.Background()
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC().Truncate(time.Second)
+			for i := 0; i < 3; i++ {
+				event := models.AuditEvent{
+					ID:        fmt.Sprintf("event-%d", i),
+					Time:      now.Add(time.Duration(i) * time.Second),
+					Actor:     "admin",
+					Action:    "reassign",
+					Key:       "abc",
+					Old:       fmt.Sprintf("owner-%d", i),
+					New:       fmt.Sprintf("owner-%d", i+1),
+					IP:        "192.0.2.1",
+					RequestID: fmt.Sprintf("request-%d", i),
+				}
+				if err := backend.AppendAudit(ctx, event); err != nil {
+					t.Fatal(err)
+				}
+			}
+			events := make([]models.AuditEvent, 0)
+			err := backend.IterateAudit(ctx, func(event models.AuditEvent) error {
+				events = append(events, event)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 3 {
+				t.Fatalf("Expected 3 events, got %d", len(events))
+			}
+			for i, event := range events {
+				if event.ID != fmt.Sprintf("event-%d", i) || event.Old != fmt.Sprintf("owner-%d", i) ||
+					event.Actor != "admin" || !event.Time.Equal(now.Add(time.Duration(i)*time.Second)) ||
+					event.IP != "192.0.2.1" || event.RequestID != fmt.Sprintf("request-%d", i) {
+					t.Errorf("Unexpected event %d %+v", i, event)
+				}
+			}
+		})
+	}
+}
+
+func TestStorage_AuditWithChanges(t *testing.T) {
+	for name, backend := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			created := models.AuditEvent{ID: "create", Actor: "user", Action: "create", Time: time.Now().UTC().Truncate(time.Second)}
+			key, err := backend.Add(audit.WithEvents(ctx, created), "https://example.com/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			shortURLs, err := backend.AddByBatch(audit.WithEvents(ctx, created), []models.URLRowOriginal{
+				{CorrelationID: "1", OriginalURL: "https://example.com/a"},
+				{CorrelationID: "2", OriginalURL: "https://example.com/b"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shortURLs[0].Created || !shortURLs[1].Created {
+				t.Errorf("Expected only the second url to be created, got %+v", shortURLs)
+			}
+
+			link, err := backend.GetLink(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale := link
+			stale.Version = link.Version + 1
+			stale.Disabled = true
+			failed := models.AuditEvent{ID: "failed", Actor: "user", Action: "disable", Key: key, Time: created.Time}
+			if err := backend.UpdateLink(audit.WithEvents(ctx, failed), stale); !errors.Is(err, appErrors.ErrStaleVersion) {
+				t.Fatalf("Expected a stale version, got %v", err)
+			}
+			link.Disabled = true
+			updated := models.AuditEvent{ID: "update", Actor: "admin", Action: "disable", Key: key, Time: created.Time}
+			if err := backend.UpdateLink(audit.WithEvents(ctx, updated), link); err != nil {
+				t.Fatal(err)
+			}
+			deleted := models.AuditEvent{ID: "delete", Actor: "admin", Action: "delete", Key: key, Time: created.Time}
+			if err := backend.DeleteLink(audit.WithEvents(ctx, deleted), key); err != nil {
+				t.Fatal(err)
+			}
+
+			page, err := backend.ListAudit(ctx, models.AuditQuery{}, models.PageRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(page.Events))
+			for _, event := range page.Events {
+				ids = append(ids, event.ID)
+			}
+			orgKey := strings.TrimPrefix(shortURLs[1].ShortURL, "http://127.0.0.1:8080/")
+			want := []string{audit.CreatedID("create", key), audit.CreatedID("create", orgKey), "update", "delete"}
+			if !slices.Equal(ids, want) {
+				t.Fatalf("Expected events %v, got %v", want, ids)
+			}
+			if event := page.Events[1]; event.Key != orgKey || event.New != "https://example.com/b" || event.Actor != "user" {
+				t.Errorf("Unexpected create event %+v", event)
+			}
+
+			first, err := backend.ListAudit(ctx, models.AuditQuery{Actor: "admin"}, models.PageRequest{Limit: 1})
+			if err != nil || len(first.Events) != 1 || first.Events[0].ID != "update" || first.NextCursor == "" {
+				t.Fatalf("Expected the update event and a cursor, got %+v, %v", first, err)
+			}
+			second, err := backend.ListAudit(ctx, models.AuditQuery{Actor: "admin"}, models.PageRequest{Limit: 1, Cursor: first.NextCursor})
+			if err != nil || len(second.Events) != 1 || second.Events[0].ID != "delete" {
+				t.Fatalf("Expected the delete event, got %+v, %v", second, err)
+			}
+			if byKey, err := backend.ListAudit(ctx, models.AuditQuery{Key: orgKey}, models.PageRequest{}); err != nil || len(byKey.Events) != 1 {
+				t.Errorf("Expected one event of %s, got %+v, %v", orgKey, byKey, err)
+			}
+			for _, cursor := range []string{"!", "MA", "OTk"} {
+				if _, err := backend.ListAudit(ctx, models.AuditQuery{}, models.PageRequest{Cursor: cursor}); !errors.Is(err, appErrors.ErrValidation) {
+					t.Errorf("Expected cursor %q to be rejected, got %v", cursor, err)
+				}
+			}
+		})
+	}
+}
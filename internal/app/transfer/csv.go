@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+var csvHeader = []string{"key", "original_url", "user_id", "created_at", "is_deleted"}
+
+type CSVReader struct {
+	r io.Reader
+}
+
+type CSVWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSVReader(r io.Reader) *CSVReader {
+	return &CSVReader{r: r}
+}
+
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+func (c *CSVReader) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	reader := csv.NewReader(c.r)
+	reader.FieldsPerRecord = len(csvHeader)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, column := range csvHeader {
+		if header[i] != column {
+			return fmt.Errorf("unexpected csv column %q, expected %q", header[i], column)
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		link, err := parseCSVRecord(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+}
+
+func parseCSVRecord(record []string) (models.Link, error) {
+	link := models.Link{Key: record[0], OriginalURL: record[1], UserID: record[2]}
+	if record[3] != "" {
+		createdAt, err := time.Parse(time.RFC3339Nano, record[3])
+		if err != nil {
+			return link, err
+		}
+		link.CreatedAt = createdAt
+	}
+	if record[4] != "" {
+		deleted, err := strconv.ParseBool(record[4])
+		if err != nil {
+			return link, err
+		}
+		link.Deleted = deleted
+	}
+	return link, nil
+}
+
+func (c *CSVWriter) Import(ctx context.Context, links []models.Link) error {
+	if !c.header {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	for _, link := range links {
+		record := []string{
+			link.Key,
+			link.OriginalURL,
+			link.UserID,
+			link.CreatedAt.Format(time.RFC3339Nano),
+			strconv.FormatBool(link.Deleted),
+		}
+		if err := c.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CSVWriter) Flush() error {
+	if !c.header {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
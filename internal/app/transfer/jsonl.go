@@ -0,0 +1,69 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+type JSONLReader struct {
+	r io.Reader
+}
+
+type JSONLWriter struct {
+	w *bufio.Writer
+}
+
+func NewJSONLReader(r io.Reader) *JSONLReader {
+	return &JSONLReader{r: r}
+}
+
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{w: bufio.NewWriter(w)}
+}
+
+func (c *JSONLReader) Iterate(ctx context.Context, fn func(models.Link) error) error {
+	reader := bufio.NewReader(c.r)
+	line := 0
+	for {
+		rawRow, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line++
+		if rawRow = bytes.TrimSpace(rawRow); len(rawRow) > 0 {
+			var link models.Link
+			if err := json.Unmarshal(rawRow, &link); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if err := fn(link); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (c *JSONLWriter) Import(ctx context.Context, links []models.Link) error {
+	for _, link := range links {
+		data, err := json.Marshal(link)
+		if err != nil {
+			return err
+		}
+		if _, err := c.w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *JSONLWriter) Flush() error {
+	return c.w.Flush()
+}
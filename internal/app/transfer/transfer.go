@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"context"
+
+	"github.com/TPizik/url-shortener/internal/app/models"
+)
+
+const DefaultBatchSize = 500
+
+type Source interface {
+	Iterate(ctx context.Context, fn func(models.Link) error) error
+}
+
+type Sink interface {
+	Import(ctx context.Context, links []models.Link) error
+}
+
+type Progress func(copied int)
+
+func Copy(ctx context.Context, src Source, dst Sink, batchSize int, progress Progress) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	copied := 0
+	batch := make([]models.Link, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := dst.Import(ctx, batch); err != nil {
+			return err
+		}
+		copied += len(batch)
+		batch = batch[:0]
+		if progress != nil {
+			progress(copied)
+		}
+		return nil
+	}
+
+	err := src.Iterate(ctx, func(link models.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = append(batch, link)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return copied, err
+	}
+	if err := flush(); err != nil {
+		return copied, err
+	}
+	return copied, nil
+}
@@ -0,0 +1,103 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TPizik/url-shortener/internal/app/config"
+	appErrors "github.com/TPizik/url-shortener/internal/app/errors"
+	"github.com/TPizik/url-shortener/internal/app/models"
+	"github.com/TPizik/url-shortener/internal/app/storage"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testLinks = []models.Link{
+	{Key: "abc", OriginalURL: "https://example.com", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{Key: "def", OriginalURL: "https://example.org", UserID: "user", CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), Deleted: true},
+	{Key: "ghi", OriginalURL: "https://example.net/?a=1,b=\"2\"", CreatedAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+}
+
+func collect(t *testing.T, src Source) []models.Link {
+	t.Helper()
+	links := make([]models.Link, 0)
+	err := src.Iterate(context.Background(), func(link models.Link) error {
+		links = append(links, link)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return links
+}
+
+func assertLinks(t *testing.T, expected []models.Link, got []models.Link) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d links, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i].Key != expected[i].Key || got[i].OriginalURL != expected[i].OriginalURL ||
+			got[i].UserID != expected[i].UserID || !got[i].CreatedAt.Equal(expected[i].CreatedAt) ||
+			got[i].Deleted != expected[i].Deleted {
+			t.Errorf("Expected %+v, got %+v", expected[i], got[i])
+		}
+	}
+}
+
+func TestCopy_Files(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	ctx := context.Background()
+	src := storage.NewInmemoryStorage(&configTest)
+	src.Import(ctx, testLinks)
+
+	var jsonl bytes.Buffer
+	jsonlWriter := NewJSONLWriter(&jsonl)
+	if copied, err := Copy(ctx, src, jsonlWriter, 2, nil); err != nil || copied != len(testLinks) {
+		t.Fatalf("Expected %d links exported, got %d, %v", len(testLinks), copied, err)
+	}
+	jsonlWriter.Flush()
+	assertLinks(t, testLinks, collect(t, NewJSONLReader(&jsonl)))
+
+	var csv bytes.Buffer
+	csvWriter := NewCSVWriter(&csv)
+	if _, err := Copy(ctx, src, csvWriter, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	csvWriter.Flush()
+	assertLinks(t, testLinks, collect(t, NewCSVReader(&csv)))
+}
+
+func TestCopy_Storages(t *testing.T) {
+	configTest := config.Config{ShortAddr: "http://127.0.0.1:8080"}
+	ctx := context.Background()
+	src := storage.NewInmemoryStorage(&configTest)
+	src.Import(ctx, testLinks)
+
+	db, _ := sqlx.Open("sqlite3", ":memory:")
+	dst, _ := storage.NewDatabaseStorage(db, &configTest)
+	if err := dst.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	progress := make([]int, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := Copy(ctx, src, dst, 2, func(copied int) { progress = append(progress, copied) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(progress) != 4 || progress[1] != len(testLinks) {
+		t.Errorf("Unexpected progress %v", progress)
+	}
+	assertLinks(t, testLinks, collect(t, dst))
+	if url, err := dst.Get(ctx, "abc"); err != nil || url != "https://example.com" {
+		t.Errorf("Expected https://example.com, got %s, %v", url, err)
+	}
+	if _, err := dst.Get(ctx, "def"); !errors.Is(err, appErrors.ErrGone) {
+		t.Errorf("Expected gone error, got %v", err)
+	}
+}